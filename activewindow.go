@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// devices often come without zoneinfo, C8Y_ACTIVE_TIMEZONE must work regardless
+	_ "time/tzdata"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// activeRange is a time range on a set of weekdays, in minutes of the day
+// a range ending before it starts (22:00-06:00) runs past midnight and belongs to the weekday it starts on
+type activeRange struct {
+	days       [7]bool
+	start, end int
+}
+
+// ActiveWindow are the hours measurements and periodic events are published in, e.g. business hours of metered devices
+// ranges are wall-clock times in the window's timezone, so they keep their local hours across daylight saving time changes.
+// Outside the window the connection stays up and operations are handled as usual
+type ActiveWindow struct {
+	spec     []string
+	location *time.Location
+	ranges   []activeRange
+}
+
+// parseActiveWindow parses ranges like "Mon-Fri 08:00-18:00", "Sat 09:00-12:00" or "22:00-06:00" (every day)
+// an empty spec is no window, the device is always active
+func parseActiveWindow(spec []string, timezone string) (*ActiveWindow, error) {
+	if len(spec) == 0 {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %w", err)
+	}
+	w := &ActiveWindow{spec: spec, location: location}
+	for _, entry := range spec {
+		r, err := parseActiveRange(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		w.ranges = append(w.ranges, r)
+	}
+	return w, nil
+}
+
+func parseActiveRange(entry string) (activeRange, error) {
+	var r activeRange
+	days, hours, ok := strings.Cut(entry, " ")
+	if !ok {
+		days, hours = "", entry
+	}
+	if days == "" {
+		r.days = [7]bool{true, true, true, true, true, true, true}
+	} else {
+		first, last, isRange := strings.Cut(strings.ToLower(days), "-")
+		from, ok1 := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !isRange {
+			to, ok2 = from, ok1
+		}
+		if !ok1 || !ok2 {
+			return r, fmt.Errorf("invalid weekdays %q, expected e.g. Mon or Mon-Fri", days)
+		}
+		// ranges may wrap around the week, e.g. Fri-Mon
+		for d := from; ; d = (d + 1) % 7 {
+			r.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	start, end, ok := strings.Cut(strings.TrimSpace(hours), "-")
+	if !ok {
+		return r, fmt.Errorf("invalid hours %q, expected e.g. 08:00-18:00", hours)
+	}
+	var err error
+	if r.start, err = parseMinuteOfDay(start); err != nil {
+		return r, err
+	}
+	if r.end, err = parseMinuteOfDay(end); err != nil {
+		return r, err
+	}
+	if r.start == r.end {
+		return r, fmt.Errorf("range %s is empty", hours)
+	}
+	return r, nil
+}
+
+// parseMinuteOfDay parses HH:MM, 24:00 is the end of the day
+func parseMinuteOfDay(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute > 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// Active reports whether t is within the window, a nil window is always active
+func (w *ActiveWindow) Active(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	local := t.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	yesterday := (day + 6) % 7
+	for _, r := range w.ranges {
+		if r.start < r.end {
+			if r.days[day] && minute >= r.start && minute < r.end {
+				return true
+			}
+			continue
+		}
+		// past midnight: the evening of a listed day or the morning after it
+		if (r.days[day] && minute >= r.start) || (r.days[yesterday] && minute < r.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run reports the state of the window as c8y_ActiveWindow fragment, at start and whenever it changes
+// the device leaves availability monitoring while inactive. The state is checked every minute, the resolution of the ranges
+func (w *ActiveWindow) Run(ctx context.Context, client mqtt.Client, serial string, requiredInterval *RequiredInterval) {
+	if w == nil {
+		return
+	}
+	var reported *bool
+	for {
+		now := time.Now()
+		if active := w.Active(now); reported == nil || *reported != active {
+			logger.Info("Active window", "active", active, "timezone", w.location)
+			if err := requiredInterval.SetInactive(!active); err != nil {
+				logger.Warn("Failed to update availability monitoring", "err", err)
+			}
+			if err := w.report(client, serial, active, now); err != nil {
+				logger.Warn("Failed to report the active window", "err", err)
+			} else {
+				reported = &active
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+	}
+}
+
+func (w *ActiveWindow) report(client mqtt.Client, serial string, active bool, now time.Time) error {
+	doc, err := json.Marshal(map[string]any{"c8y_ActiveWindow": map[string]any{
+		"active":   active,
+		"since":    formatTimestamp(now),
+		"hours":    w.spec,
+		"timezone": w.location.String(),
+	}})
+	if err != nil {
+		return err
+	}
+	return publishJsonViaMqttMessage(client, "inventory/managedObjects/update/"+serial, string(doc))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// AgentInfo is the agent the device reports to run (122)
+// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#122
+type AgentInfo struct {
+	Name       string
+	Version    string
+	URL        string
+	Maintainer string
+}
+
+// SmartRest returns the 122 line, fields like a maintainer "Doe, John" are quoted as needed
+func (a AgentInfo) SmartRest() string {
+	return buildSmartRest("122", a.Name, a.Version, a.URL, a.Maintainer)
+}
+
+// buildVersion is the version of this binary: the module version when installed with "go install ...@v1.2.3",
+// otherwise the VCS revision the binary was built from
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value[:min(len(setting.Value), 12)]
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if modified {
+		return revision + "-dirty"
+	}
+	return revision
+}
+
+// agent keeps the reported agent information up to date, UpdateAgentInfo changes it at runtime
+var agent = &agentReporter{info: AgentInfo{
+	Name:       "your-device-agent",
+	Version:    buildVersion(),
+	URL:        "https://cumulocity.com",
+	Maintainer: "Korbinian Butz",
+}}
+
+type agentReporter struct {
+	mu         sync.Mutex
+	info       AgentInfo
+	client     mqtt.Client
+	serial     string
+	properties *PropertyCache
+	// fragment carrying the version on the device twin (and events), empty if only 122 reports it
+	fragment string
+	onEvents bool
+}
+
+// tagVersion sets the fragment the agent version is published in besides c8y_Agent, see C8Y_VERSION_FRAGMENT
+// with onEvents events carry it too, so data can be correlated with the version producing it
+func (a *agentReporter) tagVersion(fragment string, onEvents bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fragment, a.onEvents = fragment, onEvents
+}
+
+// eventFragment returns the version fragment to attach to events, ok is false if events aren't tagged
+func (a *agentReporter) eventFragment() (name string, value map[string]any, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fragment == "" || !a.onEvents {
+		return "", nil, false
+	}
+	return a.fragment, a.versionFragment(), true
+}
+
+// versionFragment is the value of the version fragment, called with mu held
+func (a *agentReporter) versionFragment() map[string]any {
+	return map[string]any{"name": a.info.Name, "version": a.info.Version}
+}
+
+// attach publishes the agent information once connected, later updates are published right away
+func (a *agentReporter) attach(client mqtt.Client, serial string, properties *PropertyCache) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.client, a.serial, a.properties = client, serial, properties
+	return a.publish()
+}
+
+// publish sends 122 if the information differs from the one published last, called with mu held
+// the error is the one of 122, the version fragment is best effort
+func (a *agentReporter) publish() error {
+	if a.client == nil {
+		return nil
+	}
+	var err error
+	line := a.info.SmartRest()
+	if a.properties.Changed("agent", line) {
+		err = publishSmartRestMessage(a.client, line)
+	} else {
+		logger.Debug("Device property unchanged, not publishing", "property", "agent")
+	}
+	if a.fragment == "" {
+		return err
+	}
+	doc, jsonErr := json.Marshal(map[string]any{a.fragment: a.versionFragment()})
+	if jsonErr != nil {
+		logger.Warn("Failed to publish the version fragment", "err", jsonErr)
+		return err
+	}
+	if a.properties.Changed("versionFragment", string(doc)) {
+		publishJsonViaMqttMessage(a.client, "inventory/managedObjects/update/"+a.serial, string(doc))
+	} else {
+		logger.Debug("Device property unchanged, not publishing", "property", "versionFragment")
+	}
+	return err
+}
+
+// UpdateAgentInfo changes the reported agent information, e.g. after the agent updated itself
+// it is published right away if connected, otherwise along with the other device properties
+func UpdateAgentInfo(info AgentInfo) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	agent.info = info
+	agent.publish()
+	if agent.properties != nil {
+		if err := agent.properties.Save(); err != nil {
+			logger.Warn("Failed to save property cache", "err", err)
+		}
+	}
+}
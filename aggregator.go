@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Aggregator collects samples of signals sampled faster than they are published, and publishes min/max/avg per window
+// the aggregates are published as series <series>_min, <series>_max and <series>_avg of the sample's fragment,
+// a window without samples of a signal publishes nothing for it
+type Aggregator struct {
+	publisher *MeasurementPublisher
+	window    time.Duration
+
+	mu      sync.Mutex
+	signals map[aggregateKey]*aggregate
+}
+
+type aggregateKey struct {
+	fragment string
+	series   string
+	unit     string
+}
+
+type aggregate struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func NewAggregator(publisher *MeasurementPublisher, window time.Duration) *Aggregator {
+	return &Aggregator{publisher: publisher, window: window, signals: map[aggregateKey]*aggregate{}}
+}
+
+// Add records a sample, its time is ignored as aggregates carry the end of their window
+func (a *Aggregator) Add(m Measurement) {
+	key := aggregateKey{m.Fragment, m.Series, m.Unit}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	agg, ok := a.signals[key]
+	if !ok {
+		a.signals[key] = &aggregate{count: 1, sum: m.Value, min: m.Value, max: m.Value}
+		return
+	}
+	agg.count++
+	agg.sum += m.Value
+	agg.min = min(agg.min, m.Value)
+	agg.max = max(agg.max, m.Value)
+}
+
+// Run publishes the aggregates at the end of every window
+func (a *Aggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// publish the samples of the unfinished window, they would be lost otherwise
+			a.flush(time.Now())
+			return
+		case end := <-ticker.C:
+			a.flush(end)
+		}
+	}
+}
+
+func (a *Aggregator) flush(end time.Time) {
+	a.mu.Lock()
+	signals := a.signals
+	a.signals = make(map[aggregateKey]*aggregate, len(signals))
+	a.mu.Unlock()
+
+	measurements := make([]Measurement, 0, 3*len(signals))
+	for key, agg := range signals {
+		measurements = append(measurements,
+			Measurement{Fragment: key.fragment, Series: key.series + "_min", Value: agg.min, Unit: key.unit, Time: end},
+			Measurement{Fragment: key.fragment, Series: key.series + "_max", Value: agg.max, Unit: key.unit, Time: end},
+			Measurement{Fragment: key.fragment, Series: key.series + "_avg", Value: agg.sum / float64(agg.count), Unit: key.unit, Time: end},
+		)
+	}
+	a.publisher.Publish(measurements)
+}
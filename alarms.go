@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tidwall/sjson"
+)
+
+// Alarm is a Cumulocity alarm, Fragments carry additional context like the affected component or measured values
+// alarms without fragments and external id are sent as SmartREST (301-304), all others via the JSON-over-MQTT API
+type Alarm struct {
+	Type string
+	Text string
+	// CRITICAL, MAJOR, MINOR or WARNING
+	Severity string
+	// zero value means "now"
+	Time      time.Time
+	Fragments map[string]any
+	// optional, attached as c8y_ExternalId fragment for correlation with external systems
+	ExternalID *ExternalID
+}
+
+// toJSON renders the alarm, a zero Time is replaced with the current time
+func (a Alarm) toJSON() (string, error) {
+	t := a.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	json := "{}"
+	json, _ = sjson.Set(json, "time", formatTimestamp(t))
+	json, _ = sjson.Set(json, "text", a.Text)
+	json, _ = sjson.Set(json, "type", a.Type)
+	json, _ = sjson.Set(json, "severity", strings.ToUpper(a.Severity))
+	for name, value := range a.Fragments {
+		var err error
+		if json, err = sjson.Set(json, sjsonKey(name), value); err != nil {
+			return "", fmt.Errorf("setting fragment %s: %w", name, err)
+		}
+	}
+	if a.ExternalID != nil {
+		if err := a.ExternalID.validate(); err != nil {
+			return "", err
+		}
+		json, _ = sjson.Set(json, "c8y_ExternalId", a.ExternalID.fragment())
+	}
+	return json, nil
+}
+
+// RaiseAlarm creates the alarm, or increases the count of an active alarm of the same type
+func RaiseAlarm(client mqtt.Client, a Alarm) error {
+	templateId, ok := alarmTemplates[strings.ToUpper(a.Severity)]
+	if !ok {
+		return fmt.Errorf("unknown alarm severity %q", a.Severity)
+	}
+	if a.Type == "" || a.Text == "" {
+		return fmt.Errorf("alarm needs type and text")
+	}
+	if len(a.Fragments) == 0 && a.ExternalID == nil {
+		fields := []string{a.Type, a.Text}
+		if !a.Time.IsZero() {
+			fields = append(fields, formatTimestamp(a.Time))
+		}
+		return publishSmartRestMessage(client, buildSmartRest(templateId, fields...))
+	}
+	json, err := a.toJSON()
+	if err != nil {
+		return err
+	}
+	if err := publishJsonViaMqttMessage(client, "alarm/alarms/create", json); err != nil {
+		return err
+	}
+	raisedAlarms.raised(a.Type)
+	return nil
+}
+
+// UpdateAlarmSeverity changes the severity of the active alarm of the given type (305)
+func UpdateAlarmSeverity(client mqtt.Client, alarmType string, severity string) error {
+	severity = strings.ToUpper(severity)
+	if _, ok := alarmTemplates[severity]; !ok {
+		return fmt.Errorf("unknown alarm severity %q", severity)
+	}
+	// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#305
+	return publishSmartRestMessage(client, buildSmartRest("305", alarmType, severity))
+}
+
+// ClearAlarm clears the active alarm of the given type (306)
+func ClearAlarm(client mqtt.Client, alarmType string) error {
+	// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#306
+	return publishSmartRestMessage(client, buildSmartRest("306", alarmType))
+}
+
+// AlarmTracker remembers the alarm types this process raised (301-304) and hasn't cleared (306) yet
+// only those are cleared on shutdown, alarms raised by others (e.g. the platform's availability monitoring) are left alone
+type AlarmTracker struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func NewAlarmTracker() *AlarmTracker {
+	return &AlarmTracker{active: map[string]bool{}}
+}
+
+// Observe records the alarms raised and cleared by a published SmartREST message, a nil tracker records nothing
+func (a *AlarmTracker) Observe(message string) {
+	if a == nil {
+		return
+	}
+	records, _ := parseSmartRest([]byte(message))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		switch record[0] {
+		// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#alarm-templates
+		case "301", "302", "303", "304":
+			a.active[record[1]] = true
+		case "306":
+			delete(a.active, record[1])
+		}
+	}
+}
+
+// raised records an alarm raised other than via SmartREST, e.g. via the JSON API
+func (a *AlarmTracker) raised(alarmType string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active[alarmType] = true
+}
+
+// ClearAll clears the alarms raised by this process, except for the types in keep
+func (a *AlarmTracker) ClearAll(client mqtt.Client, keep []string) {
+	a.mu.Lock()
+	var types []string
+	for alarmType := range a.active {
+		if !slices.Contains(keep, alarmType) {
+			types = append(types, alarmType)
+		}
+	}
+	a.mu.Unlock()
+
+	slices.Sort(types)
+	for _, alarmType := range types {
+		logger.Info("Clearing alarm raised by this device", "type", alarmType)
+		publishSmartRestMessage(client, buildSmartRest("306", alarmType))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRaiseAlarmSimple(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		alarm Alarm
+		want  string
+	}{
+		{"critical", Alarm{Type: "c8y_TemperatureAlarm", Text: "Too hot", Severity: "CRITICAL"}, "301,c8y_TemperatureAlarm,Too hot"},
+		{"major", Alarm{Type: "c8y_TemperatureAlarm", Text: "Too hot", Severity: "MAJOR"}, "302,c8y_TemperatureAlarm,Too hot"},
+		{"minor, lower case", Alarm{Type: "c8y_TemperatureAlarm", Text: "Too hot", Severity: "minor"}, "303,c8y_TemperatureAlarm,Too hot"},
+		{"warning with time", Alarm{Type: "c8y_TemperatureAlarm", Text: "Too hot", Severity: "WARNING", Time: at}, "304,c8y_TemperatureAlarm,Too hot,2024-05-01T12:30:00.000Z"},
+		{"text with separator", Alarm{Type: "c8y_TemperatureAlarm", Text: "Too hot, 80 C", Severity: "MAJOR"}, `302,c8y_TemperatureAlarm,"Too hot, 80 C"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raisedAlarms = NewAlarmTracker()
+			client := &recordingClient{}
+			if err := RaiseAlarm(client, tt.alarm); err != nil {
+				t.Fatal(err)
+			}
+			if published := client.messages("s/us"); len(published) != 1 || published[0] != tt.want {
+				t.Errorf("published %q, want %q", published, tt.want)
+			}
+			if json := client.messages("alarm/alarms/create"); len(json) > 0 {
+				t.Errorf("simple alarm published as JSON: %q", json)
+			}
+			if !raisedAlarms.active[tt.alarm.Type] {
+				t.Error("raised alarm not tracked")
+			}
+		})
+	}
+}
+
+func TestRaiseAlarmRich(t *testing.T) {
+	raisedAlarms = NewAlarmTracker()
+	client := &recordingClient{}
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	err := RaiseAlarm(client, Alarm{
+		Type:       "c8y_TemperatureAlarm",
+		Text:       "Too hot",
+		Severity:   "major",
+		Time:       at,
+		Fragments:  map[string]any{"c8y_Details": map[string]any{"sensor": "T1", "value": 81.5}},
+		ExternalID: &ExternalID{Type: "servicenow_incident", Value: "INC0001"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if smartRest := client.messages("s/us"); len(smartRest) > 0 {
+		t.Errorf("rich alarm published as SmartREST: %q", smartRest)
+	}
+	published := client.messages("alarm/alarms/create")
+	if len(published) != 1 {
+		t.Fatalf("published %q, want one JSON alarm", published)
+	}
+	var doc struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		Severity   string `json:"severity"`
+		Time       string `json:"time"`
+		C8yDetails struct {
+			Sensor string  `json:"sensor"`
+			Value  float64 `json:"value"`
+		} `json:"c8y_Details"`
+		C8yExternalID map[string]string `json:"c8y_ExternalId"`
+	}
+	if err := json.Unmarshal([]byte(published[0]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Type != "c8y_TemperatureAlarm" || doc.Text != "Too hot" || doc.Severity != "MAJOR" || doc.Time != "2024-05-01T12:30:00.000Z" {
+		t.Errorf("alarm %+v doesn't match what was raised", doc)
+	}
+	if doc.C8yDetails.Sensor != "T1" || doc.C8yDetails.Value != 81.5 {
+		t.Errorf("fragment c8y_Details = %+v, want sensor T1 and value 81.5", doc.C8yDetails)
+	}
+	if doc.C8yExternalID["externalId"] != "INC0001" {
+		t.Errorf("c8y_ExternalId = %v, want the external id", doc.C8yExternalID)
+	}
+	if !raisedAlarms.active["c8y_TemperatureAlarm"] {
+		t.Error("alarm raised via JSON not tracked")
+	}
+}
+
+func TestRaiseAlarmInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		alarm   Alarm
+		wantErr string
+	}{
+		{"unknown severity", Alarm{Type: "c8y_TemperatureAlarm", Text: "Too hot", Severity: "FATAL"}, `unknown alarm severity "FATAL"`},
+		{"no type", Alarm{Text: "Too hot", Severity: "MAJOR"}, "alarm needs type and text"},
+		{"no text", Alarm{Type: "c8y_TemperatureAlarm", Severity: "MAJOR"}, "alarm needs type and text"},
+		{"invalid external id", Alarm{Type: "c8y_TemperatureAlarm", Text: "Too hot", Severity: "MAJOR", ExternalID: &ExternalID{Type: "no spaces allowed", Value: "1"}}, "external id type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingClient{}
+			err := RaiseAlarm(client, tt.alarm)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if len(client.published) > 0 {
+				t.Errorf("published %v for an invalid alarm", client.published)
+			}
+		})
+	}
+}
+
+func TestUpdateAndClearAlarm(t *testing.T) {
+	raisedAlarms = NewAlarmTracker()
+	client := &recordingClient{}
+	if err := RaiseAlarm(client, Alarm{Type: "c8y_TemperatureAlarm", Text: "Too hot", Severity: "MINOR"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateAlarmSeverity(client, "c8y_TemperatureAlarm", "critical"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateAlarmSeverity(client, "c8y_TemperatureAlarm", "FATAL"); err == nil {
+		t.Error("unknown severity accepted")
+	}
+	if err := ClearAlarm(client, "c8y_TemperatureAlarm"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"303,c8y_TemperatureAlarm,Too hot", "305,c8y_TemperatureAlarm,CRITICAL", "306,c8y_TemperatureAlarm"}
+	if published := client.messages("s/us"); strings.Join(published, "\n") != strings.Join(want, "\n") {
+		t.Errorf("published %q, want %q", published, want)
+	}
+	if raisedAlarms.active["c8y_TemperatureAlarm"] {
+		t.Error("cleared alarm still tracked as active")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is one line of the operation audit log
+// Payload holds the raw CSV as received from the platform, so an operation can be replayed from the log
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	TemplateID string    `json:"templateId"`
+	Fields     []string  `json:"fields"`
+	Payload    string    `json:"payload"`
+	DurationMs int64     `json:"durationMs"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	// creation time of the operation in the platform and the time it waited until the device picked it up, if known
+	CreatedAt       time.Time `json:"createdAt,omitzero"`
+	PickupLatencyMs int64     `json:"pickupLatencyMs,omitempty"`
+	// sha256 of the previous line, chaining the records makes manual edits of the file detectable
+	PrevHash string `json:"prevHash"`
+}
+
+// AuditLogger appends every received operation and its outcome to a JSONL file
+// The file is rotated once it exceeds maxBytes, keeping the configured number of backups
+type AuditLogger struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+	prevHash string
+}
+
+func NewAuditLogger(path string, maxBytes int64, backups int) (*AuditLogger, error) {
+	a := &AuditLogger{path: path, maxBytes: maxBytes, backups: backups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLogger) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log %s: %w", a.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("reading audit log %s: %w", a.path, err)
+	}
+
+	// continue the hash chain from the last line of an existing file
+	a.prevHash = ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		a.prevHash = hashLine(scanner.Bytes())
+	}
+
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// Write appends the record to the log. A nil AuditLogger is valid and discards all records
+func (a *AuditLogger) Write(rec AuditRecord) {
+	recentOperations.Add(rec)
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec.PrevHash = a.prevHash
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logger.Error("Failed to encode audit record", "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if a.size+int64(len(line)) > a.maxBytes && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			logger.Error("Failed to rotate audit log", "path", a.path, "err", err)
+			return
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		logger.Error("Failed to write audit record", "path", a.path, "err", err)
+		return
+	}
+	a.prevHash = hashLine(line[:len(line)-1])
+}
+
+// rotate shifts audit.jsonl.N-1 to audit.jsonl.N (dropping the oldest) and starts a fresh file
+// the hash chain is kept across files, so the first line of the new file references the last line of the rotated one
+func (a *AuditLogger) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.backups == 0 {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := a.backups - 1; i >= 1; i-- {
+			src := fmt.Sprintf("%s.%d", a.path, i)
+			if err := os.Rename(src, fmt.Sprintf("%s.%d", a.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	}
+	prevHash := a.prevHash
+	if err := a.open(); err != nil {
+		return err
+	}
+	a.prevHash = prevHash
+	return nil
+}
+
+func (a *AuditLogger) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// requiredIntervalMinutes derives the required interval (117) from what the device actually sends
+// the platform marks a device unavailable if nothing arrives within this interval, so it has to cover the slowest
+// periodic signal, stretched by the jitter and multiplied with a safety factor for a delayed or lost message
+func requiredIntervalMinutes(cfg Config) int {
+	slowest := cfg.MeasurementInterval
+	if cfg.PowerSource != "" {
+		slowest = max(slowest, cfg.BatteryInterval)
+	}
+	withJitter := float64(slowest) * (1 + cfg.JitterFraction)
+	minutes := math.Ceil(withJitter * cfg.RequiredIntervalFactor / float64(time.Minute))
+	return max(int(minutes), 1)
+}
+
+// Availability is the c8y_RequiredAvailability fragment of the device twin
+type Availability struct {
+	// minutes without data after which the platform marks the device unavailable
+	Interval int
+	// false excludes the device from availability monitoring (maintenance), no availability alarms are raised then
+	Monitored bool
+}
+
+// responseInterval is the value of c8y_RequiredAvailability.responseInterval, a negative interval means maintenance
+func (a Availability) responseInterval() int {
+	if !a.Monitored {
+		return -1
+	}
+	return a.Interval
+}
+
+// RequiredInterval keeps the required interval of the device twin in sync with the measurement schedule
+// while in maintenance mode, with telemetry paused or outside the active hours the device isn't monitored, the interval is restored afterwards
+type RequiredInterval struct {
+	client mqtt.Client
+	serial string
+
+	mu          sync.Mutex
+	interval    int
+	maintenance bool
+	paused      bool
+	inactive    bool
+	published   *Availability
+}
+
+func NewRequiredInterval(client mqtt.Client, serial string) *RequiredInterval {
+	return &RequiredInterval{client: client, serial: serial}
+}
+
+// Publish updates the interval derived from cfg, it is only sent if it differs from the last published one
+func (r *RequiredInterval) Publish(cfg Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interval = requiredIntervalMinutes(cfg)
+	return r.publish()
+}
+
+// SetMaintenanceMode excludes the device from availability monitoring (e.g. during planned downtime) or includes it again
+func (r *RequiredInterval) SetMaintenanceMode(on bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maintenance = on
+	return r.publish()
+}
+
+// SetTelemetryPaused excludes the device from availability monitoring while it sends no measurements on purpose
+// it is independent of the maintenance mode, the device is monitored again once neither applies
+func (r *RequiredInterval) SetTelemetryPaused(paused bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = paused
+	return r.publish()
+}
+
+// SetInactive excludes the device from availability monitoring outside its active hours, see ActiveWindow
+func (r *RequiredInterval) SetInactive(inactive bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inactive = inactive
+	return r.publish()
+}
+
+// publish sends the availability if it changed, called with mu held
+// the interval goes via 117, maintenance via the fragment as the template is meant for intervals
+func (r *RequiredInterval) publish() error {
+	a := Availability{Interval: r.interval, Monitored: !r.maintenance && !r.paused && !r.inactive}
+	if r.published != nil && *r.published == a {
+		return nil
+	}
+	var err error
+	if a.Monitored {
+		// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#117
+		err = publishSmartRestMessage(r.client, buildSmartRest("117", strconv.Itoa(a.Interval)))
+	} else {
+		doc := fmt.Sprintf(`{"c8y_RequiredAvailability":{"responseInterval":%d}}`, a.responseInterval())
+		err = publishJsonViaMqttMessage(r.client, "inventory/managedObjects/update/"+r.serial, doc)
+	}
+	if err != nil {
+		return err
+	}
+	r.published = &a
+	return nil
+}
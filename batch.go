@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Batch collects measurement, event and alarm rows of different static templates and publishes them as one s/us message
+// every row is validated on its own, an invalid row is dropped while the rest of the batch is still published
+type Batch struct {
+	rows    []string
+	dropped []DroppedRow
+	index   int
+}
+
+// DroppedRow is a row that has been left out of the batch, Index counts all rows added in the order they were added
+type DroppedRow struct {
+	Index    int
+	Template string
+	Err      error
+}
+
+// alarm severities and their templates
+// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#alarm-templates
+var alarmTemplates = map[string]string{
+	"CRITICAL": "301",
+	"MAJOR":    "302",
+	"MINOR":    "303",
+	"WARNING":  "304",
+}
+
+func (b *Batch) add(templateId string, row string, err error) {
+	b.index++
+	if err != nil {
+		b.dropped = append(b.dropped, DroppedRow{Index: b.index, Template: templateId, Err: err})
+		return
+	}
+	b.rows = append(b.rows, row)
+}
+
+// Measurement adds a single measurement (200)
+func (b *Batch) Measurement(m Measurement) {
+	row, err := measurementTemplate200.render(m)
+	b.add("200", row, err)
+}
+
+// Measurements adds measurements of one type sharing a time (201), a zero time means "now"
+func (b *Batch) Measurements(measurementType string, t time.Time, measurements ...Measurement) {
+	row, err := build201(measurementType, t, measurements)
+	b.add("201", row, err)
+}
+
+func build201(measurementType string, t time.Time, measurements []Measurement) (string, error) {
+	if measurementType == "" || len(measurements) == 0 {
+		return "", fmt.Errorf("201 needs a type and at least one measurement")
+	}
+	fields := []string{measurementType, ""}
+	if !t.IsZero() {
+		fields[1] = formatTimestamp(t)
+	}
+	for _, m := range measurements {
+		if m.Fragment == "" || m.Series == "" {
+			return "", fmt.Errorf("201 measurement needs fragment and series")
+		}
+		fields = append(fields, m.Fragment, m.Series, strconv.FormatFloat(m.Value, 'f', -1, 64), m.Unit)
+	}
+	return buildSmartRest("201", fields...), nil
+}
+
+// Event adds an event (400)
+func (b *Batch) Event(eventType string, text string) {
+	if eventType == "" || text == "" {
+		b.add("400", "", fmt.Errorf("event needs type and text"))
+		return
+	}
+	if ok, _ := eventSuppressor.Allow(eventType, text); !ok {
+		// not an invalid row, so not in the dropped ones either
+		b.index++
+		return
+	}
+	b.add("400", buildSmartRest("400", eventType, text), nil)
+}
+
+// Alarm adds an alarm (301-304 depending on the severity: CRITICAL, MAJOR, MINOR, WARNING)
+func (b *Batch) Alarm(severity string, alarmType string, text string) {
+	templateId, ok := alarmTemplates[strings.ToUpper(severity)]
+	switch {
+	case !ok:
+		b.add("30x", "", fmt.Errorf("unknown alarm severity %q", severity))
+	case alarmType == "" || text == "":
+		b.add(templateId, "", fmt.Errorf("alarm needs type and text"))
+	default:
+		b.add(templateId, buildSmartRest(templateId, alarmType, text), nil)
+	}
+}
+
+// Publish sends the valid rows in one message and returns the rows that have been dropped, each is logged with a warning
+func (b *Batch) Publish(client mqtt.Client) []DroppedRow {
+	for _, d := range b.dropped {
+		logger.Warn("Dropping invalid row from batch", "row", d.Index, "template", d.Template, "err", d.Err)
+	}
+	if len(b.rows) > 0 {
+		publishSmartRestMessage(client, strings.Join(b.rows, "\n"))
+	}
+	return b.dropped
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ChildDevice is a device attached to this device (acting as gateway)
+// Fragments are set on the child's managed object as they are, e.g. {"c8y_Hardware": {"model": "TH-1"}, "sensors": [...]}
+type ChildDevice struct {
+	// external id (c8y_Serial) of the child
+	ID        string
+	Name      string
+	Type      string
+	Fragments map[string]any
+}
+
+// ChildRegistry registers child devices with their full metadata and remembers their managed object ids
+//
+// SmartREST 101 only takes id, name and type, and JSON-over-MQTT doesn't return the id of a created object. So the child is
+// created and linked to this device with 101, its id is resolved via the identity API once the platform has assigned it,
+// and the fragments are then written via JSON-over-MQTT (inventory/managedObjects/update/<id>).
+// The external id -> managed object id mapping is stored in a local JSON file, so registered children are known after a restart.
+type ChildRegistry struct {
+	client mqtt.Client
+	rest   *RestClient
+	path   string
+
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+// NewChildRegistry loads the mapping of already registered children from path, a missing file is an empty registry
+func NewChildRegistry(client mqtt.Client, rest *RestClient, path string) (*ChildRegistry, error) {
+	c := &ChildRegistry{client: client, rest: rest, path: path, ids: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.ids); err != nil {
+		return nil, fmt.Errorf("invalid child registry %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// ManagedObjectID returns the id of a registered child
+func (c *ChildRegistry) ManagedObjectID(childID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.ids[childID]
+	return id, ok
+}
+
+// validate checks the fields 101 needs
+func (child ChildDevice) validate() error {
+	if child.ID == "" || child.Name == "" || child.Type == "" {
+		return fmt.Errorf("child device needs id, name and type")
+	}
+	return nil
+}
+
+// Register creates the child (if it doesn't exist yet), applies its fragments and returns its managed object id
+func (c *ChildRegistry) Register(ctx context.Context, child ChildDevice) (string, error) {
+	if err := child.validate(); err != nil {
+		return "", err
+	}
+	id, known := c.ManagedObjectID(child.ID)
+	if !known {
+		// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#101
+		publishSmartRestMessage(c.client, buildSmartRest("101", child.ID, child.Name, child.Type))
+		var err error
+		if id, err = c.awaitID(ctx, child.ID); err != nil {
+			return "", err
+		}
+		if err := c.store(map[string]string{child.ID: id}); err != nil {
+			return "", err
+		}
+		logger.Info("Registered child device", "child", child.ID, "id", id)
+	}
+	if err := c.applyFragments(child, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// BulkRegistration is the outcome of RegisterAll
+type BulkRegistration struct {
+	// managed object ids of the registered children, by external id
+	Registered map[string]string
+	// why the other children couldn't be registered, by external id
+	Failed map[string]error
+}
+
+// RegisterAll registers many children at once, for gateways with a large number of them. Instead of one 101 per
+// child and waiting for its id, the 101 lines of all new children go as multi-line SmartREST payloads of up to
+// maxPayload bytes, and the ids are resolved for all of them afterwards. Children that are invalid, whose id doesn't
+// show up (e.g. as the platform rejected the line on s/e) or whose fragments couldn't be set are reported in Failed,
+// the others are registered regardless
+func (c *ChildRegistry) RegisterAll(ctx context.Context, children []ChildDevice, maxPayload int) BulkRegistration {
+	result := BulkRegistration{Registered: map[string]string{}, Failed: map[string]error{}}
+	var lines []string
+	pending := map[string]ChildDevice{}
+	for _, child := range children {
+		if err := child.validate(); err != nil {
+			result.Failed[child.ID] = err
+			continue
+		}
+		if id, known := c.ManagedObjectID(child.ID); known {
+			result.Registered[child.ID] = id
+			continue
+		}
+		if _, dup := pending[child.ID]; !dup {
+			pending[child.ID] = child
+			// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#101
+			lines = append(lines, buildSmartRest("101", child.ID, child.Name, child.Type))
+		}
+	}
+	for _, payload := range chunkLines(lines, maxPayload) {
+		if err := publishSmartRestMessage(c.client, payload); err != nil {
+			logger.Warn("Failed to publish child registrations, their ids are looked up regardless", "err", err)
+		}
+	}
+
+	created := c.awaitIDs(ctx, slices.Collect(maps.Keys(pending)))
+	if err := c.store(created); err != nil {
+		logger.Warn("Failed to persist child registry", "path", c.path, "err", err)
+	}
+	for childID := range pending {
+		id, ok := created[childID]
+		if !ok {
+			result.Failed[childID] = fmt.Errorf("child %s didn't get an id", childID)
+			continue
+		}
+		result.Registered[childID] = id
+	}
+	for _, child := range children {
+		id, ok := result.Registered[child.ID]
+		if !ok {
+			continue
+		}
+		if err := c.applyFragments(child, id); err != nil {
+			delete(result.Registered, child.ID)
+			result.Failed[child.ID] = err
+		}
+	}
+	logger.Info("Registered child devices", "registered", len(result.Registered), "new", len(created), "failed", len(result.Failed))
+	return result
+}
+
+// chunkLines joins the lines to payloads of at most maxPayload bytes, a longer line makes a payload of its own
+func chunkLines(lines []string, maxPayload int) []string {
+	var payloads []string
+	var sb strings.Builder
+	for _, line := range lines {
+		if sb.Len() > 0 && sb.Len()+1+len(line) > maxPayload {
+			payloads = append(payloads, sb.String())
+			sb.Reset()
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(line)
+	}
+	if sb.Len() > 0 {
+		payloads = append(payloads, sb.String())
+	}
+	return payloads
+}
+
+// applyFragments sets the fragments of the child on its managed object
+func (c *ChildRegistry) applyFragments(child ChildDevice, id string) error {
+	if len(child.Fragments) == 0 {
+		return nil
+	}
+	doc, err := json.Marshal(child.Fragments)
+	if err != nil {
+		return fmt.Errorf("encoding fragments of child %s: %w", child.ID, err)
+	}
+	return publishJsonViaMqttMessage(c.client, "inventory/managedObjects/update/"+id, string(doc))
+}
+
+// awaitID polls the identity API until the platform has processed the 101 and assigned an id to the child
+func (c *ChildRegistry) awaitID(ctx context.Context, childID string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for {
+		id, err := c.rest.ManagedObjectID(ctx, childID)
+		if err == nil {
+			return id, nil
+		}
+		var statusErr *httpStatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+			return "", err
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("child %s didn't get an id: %w", childID, ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// awaitIDs polls the identity API until all children have an id or the time is up, it returns the ids found
+// the time grows with the number of children, the platform works through a large batch of 101 lines one by one
+func (c *ChildRegistry) awaitIDs(ctx context.Context, childIDs []string) map[string]string {
+	ids := map[string]string{}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second+time.Duration(len(childIDs))*100*time.Millisecond)
+	defer cancel()
+	for {
+		for _, childID := range childIDs {
+			if _, ok := ids[childID]; ok {
+				continue
+			}
+			id, err := c.rest.ManagedObjectID(ctx, childID)
+			if err == nil {
+				ids[childID] = id
+				continue
+			}
+			var statusErr *httpStatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+				logger.Debug("Looking up child device failed", "child", childID, "err", err)
+			}
+		}
+		if len(ids) == len(childIDs) {
+			return ids
+		}
+		select {
+		case <-ctx.Done():
+			return ids
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// store adds the ids of children to the registry and persists it
+func (c *ChildRegistry) store(ids map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	maps.Copy(c.ids, ids)
+	data, err := json.MarshalIndent(c.ids, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write next to the registry and rename, a crash mid-write must not leave a truncated registry behind
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChildRegistryStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "children.json")
+	children, err := NewChildRegistry(&recordingClient{}, nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := children.store(map[string]string{"child-1": "4711"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := children.store(map[string]string{"child-2": "4712"}); err != nil {
+		t.Fatal(err)
+	}
+	// the registry is written via a temporary file, which is renamed
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	reloaded, err := NewChildRegistry(&recordingClient{}, nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for child, want := range map[string]string{"child-1": "4711", "child-2": "4712"} {
+		if id, ok := reloaded.ManagedObjectID(child); !ok || id != want {
+			t.Errorf("%s = %q, want %q", child, id, want)
+		}
+	}
+}
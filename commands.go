@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CommandHandler executes a named command with the arguments of the operation and returns its output
+type CommandHandler func(args string) (string, error)
+
+// named commands a shell operation (511) can address instead of running arbitrary shell, see RegisterCommand
+var commands = struct {
+	mu       sync.RWMutex
+	handlers map[string]CommandHandler
+}{handlers: map[string]CommandHandler{}}
+
+// RegisterCommand makes a device specific command (e.g. "recalibrate" or "self-test") available to shell operations
+// operations carrying the command type as additional field (511,serial,args,name) are routed to it,
+// operations without command type are executed by the shell
+func RegisterCommand(name string, fn func(args string) (string, error)) {
+	commands.mu.Lock()
+	defer commands.mu.Unlock()
+	commands.handlers[name] = fn
+}
+
+// runNamedCommand executes the registered command, an unknown name is an error
+func runNamedCommand(name string, args string) (string, error) {
+	commands.mu.RLock()
+	fn, ok := commands.handlers[name]
+	commands.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown command %q", name)
+	}
+	return fn(args)
+}
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds all settings of the device agent that can be changed without touching the code
+// Values are read from environment variables (a local .env file is loaded into the environment on startup)
+type Config struct {
+	DeviceName   string
+	DeviceSerial string
+	// type of the device twin, defaults to the one of the device preset
+	DeviceType string
+	// name of the device preset the defaults come from, see DevicePreset
+	DevicePreset string
+
+	// MQTT endpoints of the tenant, paho tries them in order
+	Brokers []string
+	// REST endpoint of the tenant, derived from the broker address if not set
+	BaseURL string
+	// tenant id, prepended to the username ("tenant/user") if the username doesn't contain it already
+	Tenant string
+	// username as used for MQTT and REST, including the tenant prefix
+	Username string
+	Password string
+	// where the credentials are read from: "env", "file" (CredentialsFile) or "keyring" (OS keyring, CredentialsFile as fallback)
+	CredentialsBackend string
+	// file with USERNAME/PASSWORD (.env format)
+	CredentialsFile string
+	// interval to re-read the credentials, the device reconnects if they changed. 0 disables refreshing
+	CredentialsRefresh time.Duration
+	// "basic", "cert" or "both", derived from the configured credentials if empty
+	AuthMode string
+	// PEM files for certificate based device authentication
+	ClientCert string
+	ClientKey  string
+	// PEM file with the CA certificates to trust, the system pool is used if empty
+	CACert string
+	// PKCS#11 module (.so) giving access to the private key of the client certificate, e.g. in a TPM or smartcard
+	// the certificate is read from the token as well unless ClientCert is set, ClientKey must be empty
+	PKCS11Module string
+	// token holding the key, by slot number (-1 if unset) or label
+	PKCS11Slot       int
+	PKCS11TokenLabel string
+	PKCS11Pin        string
+	// label of the key pair (and certificate) on the token
+	PKCS11KeyLabel string
+
+	// MQTT client id, defaults to the device serial
+	ClientID       string
+	KeepAlive      time.Duration
+	ConnectTimeout time.Duration
+	AutoReconnect  bool
+	// false resumes the broker session on reconnect, keeping subscriptions and queued QoS 1 operations
+	CleanSession         bool
+	MaxReconnectInterval time.Duration
+	// local URL connection state changes are posted to, empty disables it
+	ConnectionWebhook        string
+	ConnectionWebhookTimeout time.Duration
+	// local address the state of the client is served on (GET /state), empty disables it
+	StateAddr string
+	// file the start of an ongoing outage is persisted in
+	OutageStatePath string
+	// outages lasting at least the duration raise an alarm of the severity, the longest reached threshold wins
+	OutageAlarms []outageThreshold
+	// time to wait before reconnecting after the platform disconnected the device for exceeding the tenant's quota, 0 disables it
+	QuotaBackoff time.Duration
+	// SmartREST message the broker publishes on behalf of the device when it disconnects unexpectedly
+	WillMessage string
+	// directory for persisting in-flight QoS 1 messages, in-memory if empty
+	StoreDir string
+	// topics subscribed on every connect, the operation and error topics are added by main
+	Subscriptions []Subscription `reload:"-"`
+	// QoS per topic overriding the QoS of the subscriptions above, also those added by main
+	SubscribeQoS map[string]byte
+	// largest message accepted on the subscribed topics, in bytes
+	InboundMaxSize int
+
+	LogLevel slog.Level
+	// add source file and line to log lines, costly at high log volume
+	LogSource bool
+
+	// path of the JSONL operation audit log, empty disables auditing
+	AuditLogPath string
+	// size in bytes after which the audit log is rotated
+	AuditLogMaxBytes int64
+	// number of rotated audit log files to keep (audit.jsonl.1 ... audit.jsonl.N)
+	AuditLogBackups int
+	// publish a c8y_OperationReceived event for every operation as soon as it arrives, before it is executed
+	OperationReceivedEvents bool
+
+	// time between two measurement cycles
+	MeasurementInterval time.Duration
+	// lower bound of the measurement interval, smaller intervals are raised to it so a typo can't flood the tenant
+	MinInterval time.Duration
+	// max deviation of the measurement interval as fraction of it (0..1), spreads the load of a fleet
+	JitterFraction float64
+	// the required interval (117) is the slowest periodic signal multiplied with this factor
+	RequiredIntervalFactor float64
+	// SmartREST template measurements are sent with, static 200 by default
+	MeasurementTemplate measurementTemplate
+	// window of the min/max/avg aggregation of fast sampled signals, 0 disables aggregation
+	AggregationWindow time.Duration
+	// interval fast signals are sampled with
+	SampleInterval time.Duration
+	// aggregates of the periodic summary by signal, empty disables the rollup
+	RollupSpec rollupSpec
+	// end of the rollup periods
+	RollupSchedule cronSchedule
+	// hours measurements and periodic events are published in, nil if always
+	ActiveWindow *ActiveWindow
+	// liveness measurement independent of the data measurements, 0 disables it
+	HeartbeatInterval time.Duration
+	HeartbeatFragment string
+	HeartbeatSeries   string
+	// interval to check whether the system clock is synchronized, 0 disables it, see ClockMonitor
+	TimeSyncInterval time.Duration
+	// error bound beyond which the clock counts as unsynced
+	TimeSyncMaxError time.Duration
+	// how long the clock may be unsynced before the alarm is raised
+	TimeSyncAlarmAfter time.Duration
+	// interval to read the network configuration, published as c8y_Network when changed, 0 disables it
+	NetworkInfoInterval time.Duration
+	// read the cellular modem from ModemManager (mmcli) for c8y_Mobile
+	NetworkModem bool
+	// raw sensor values by source key, translated to measurements, see loadSensorMappings
+	SensorMappings map[string]SensorMapping
+	// decimals measurement values are rounded to, by signal
+	MeasurementPrecision measurementPrecision
+	// "mqtt" (default), "rest" or "auto" (REST only for batches exceeding MqttMaxPayload)
+	MeasurementTransport string
+	// max measurements buffered while telemetry is paused in buffer mode
+	PauseBufferSize int
+	// largest SmartREST payload sent via MQTT in "auto" mode
+	MqttMaxPayload int
+	// max number of measurements per REST bulk request
+	RestChunkSize int
+
+	// JSONL file with historical events imported on startup
+	EventBacklog string
+	// max number of backlog events published per second
+	EventImportRate int
+	// backlog events older than this are skipped, 0 imports everything
+	EventMaxAge time.Duration
+	// fragment of the device twin carrying the agent version besides c8y_Agent, empty disables it
+	VersionFragment string
+	// attach the version fragment to events as well
+	VersionOnEvents bool
+	// events repeating the previous one of their type within this window are suppressed, 0 disables it
+	EventDedupWindow time.Duration
+	// attach the number of suppressed events to the next event of the type
+	EventDedupCount bool
+	// JSONL file with historical measurements uploaded on startup
+	MeasurementBacklog string
+
+	// execute shell operations for real instead of simulating them
+	ShellEnabled bool
+	ShellTimeout time.Duration
+	// min time between two output chunks streamed to the platform
+	ShellProgressInterval time.Duration
+	// output beyond this size is dropped
+	ShellMaxOutput int
+
+	// reboot the host on restart operations instead of simulating it
+	RestartEnabled bool
+	// command rebooting the host, split at whitespace and executed without a shell
+	RestartCommand string
+	// file marking a restart in progress, the operation is set to successful on the next start
+	RestartMarkerPath string
+
+	// "demo" or "sysfs[:<name>]", empty disables battery reporting
+	PowerSource string
+	// interval of battery measurements
+	BatteryInterval time.Duration
+	// level in percent below which the low battery alarm is raised
+	BatteryLowThreshold float64
+	// the alarm is cleared once the level is this many percent above the threshold
+	BatteryHysteresis float64
+
+	// host[:port] of the SNMP agent to poll, empty disables SNMP (needs a build with -tags snmp)
+	SNMPTarget string
+	// community of SNMP v1/v2c requests
+	SNMPCommunity string
+	// "1" or "2c"
+	SNMPVersion string
+	// polled OIDs with the measurement they are translated to, see loadSensorMappings
+	SNMPMappings map[string]SensorMapping
+	// interval and timeout of SNMP polls
+	SNMPInterval time.Duration
+	SNMPTimeout  time.Duration
+	// host[:port] of a redundant SNMP agent taking over when the target fails, see FailoverSource
+	SNMPFailoverTarget string
+	// successful polls of the recovered target before switching back to it
+	SNMPFailoverRecovery int
+	// local UDP address InfluxDB line protocol is received on, empty disables it
+	LineProtocolAddr    string
+	LineProtocolMapping lineProtocolMapping
+
+	// max MQTT messages per second, reduced automatically while the platform throttles. 0 disables the limit
+	PublishRate float64
+	// time without throttling signals after which the publish rate is raised again
+	PublishRecovery time.Duration
+	// consecutive failed measurement publishes raising a c8y_DataPublishFailure alarm, 0 disables the alarm
+	PublishFailureThreshold int
+	// QoS 1 publishes timing out in a row before telemetry is sent with QoS 0, 0 disables the downgrade
+	QoSDowngradeThreshold int
+	// time to wait for the acknowledgement of a QoS 1 publish while the downgrade is enabled
+	AckTimeout time.Duration
+
+	// compare the system clock with the Date header of the platform before connecting
+	ClockCheck bool
+	// clock skew above which a warning is logged
+	MaxClockSkew time.Duration
+
+	// attach the current position to measurements and events, for tracking where readings were taken
+	AttachPosition bool
+	// positions older than this aren't attached anymore
+	PositionMaxAge time.Duration
+
+	// time zone of timestamps sent to the platform, UTC unless integrations need a local offset
+	TimestampLocation *time.Location
+
+	// validate required fields of JSON-over-MQTT documents (events, alarms, measurements) before publishing
+	JSONStrict bool
+
+	// number of times 100 is published until the device exists, startup fails afterwards
+	CreateAttempts int
+	// time to wait for the device to exist after the first 100, grows with each attempt
+	CreateTimeout time.Duration
+
+	// send c8y_ProvisioningComplete once the device is created, declared its capabilities and sent its first measurement
+	ProvisioningEvent bool
+	// file remembering the provisioning event has been sent
+	ProvisioningFlagPath string
+
+	// file remembering the device properties published last, unchanged properties aren't published again
+	PropertyCachePath string
+	// time to wait before connecting on start
+	StartupDelay time.Duration
+	// pause between the capability and property publishes on start, 0 sends them at once
+	StartupStagger time.Duration
+	// time to wait for s/e errors after the capability and property publishes, and retries of the failed ones
+	StartupVerifyTime time.Duration
+	StartupRetries    int
+	// file storing the managed object ids of registered child devices
+	ChildRegistryPath string
+
+	// log file types offered for retrieval (118) and where their content comes from
+	LogfileTypes []string
+	LogSources   map[string]LogSource
+
+	// min time between two progress updates of a running operation
+	ProgressInterval time.Duration
+
+	// time background tasks get to finish on shutdown
+	ShutdownTimeout time.Duration
+
+	// clear the alarms raised by this process on a graceful shutdown
+	ClearAlarmsOnShutdown bool
+	// alarm types that are never cleared on shutdown
+	PersistentAlarms []string
+
+	// protocols remote access sessions may be opened for
+	RemoteAccessProtocols []string
+
+	// "groups" (default, conflicting operations run one after another) or "serial" (all operations one after another)
+	OperationConcurrency string
+	// once more operations are waiting than this, OperationQueuePolicy applies. 0 disables it
+	OperationQueueThreshold int
+	// "prioritize" (priority operations pass the waiting ones) or "shed" (operations without priority are rejected)
+	OperationQueuePolicy string
+	// templates of the operations with priority
+	OperationPriority []string
+	// file the recently handled operations are persisted in
+	OperationDedupPath string
+	// an operation received again within this window isn't executed again, 0 disables deduplication
+	OperationDedupWindow time.Duration
+	// max number of handled operations remembered
+	OperationDedupSize int
+	// messages of the failure codes reported with failed operations, defaults with translations applied
+	FailureMessages map[failureCode]string
+}
+
+func loadConfig() (Config, error) {
+	var cfg Config
+	var err error
+
+	if err := checkSecretFiles(); err != nil {
+		return cfg, err
+	}
+	// a connection string provides defaults for the broker, credentials and connection settings, see parseConnectionString
+	connection := map[string]string{}
+	if s := envString("C8Y_CONNECTION", ""); s != "" {
+		if connection, err = parseConnectionString(s); err != nil {
+			return cfg, fmt.Errorf("invalid value for C8Y_CONNECTION: %w", err)
+		}
+	}
+	connectionEnv.Store(&connection)
+
+	cfg.DeviceName = envString("C8Y_DEVICE_NAME_PREFIX", "") + envString("C8Y_DEVICE_NAME", "showcase-device-01")
+	cfg.DeviceSerial = envString("C8Y_DEVICE_SERIAL", "kobu-sn-7123")
+	// --device-preset takes precedence over the environment
+	cfg.DevicePreset = *devicePresetName
+	if cfg.DevicePreset == "" {
+		cfg.DevicePreset = envString("C8Y_DEVICE_PRESET", "")
+	}
+	preset, err := lookupDevicePreset(cfg.DevicePreset)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.DeviceType = envString("C8Y_DEVICE_TYPE", cmp.Or(preset.DeviceType, "yourDeviceType"))
+
+	cfg.Brokers = envList("C8Y_BROKER", []string{"mqtts://mqtt.eu-latest.cumulocity.com:8883"})
+	cfg.BaseURL = envString("C8Y_BASEURL", "")
+	if cfg.BaseURL == "" {
+		if cfg.BaseURL, err = baseURLFromBroker(cfg.Brokers[0]); err != nil {
+			return cfg, err
+		}
+	}
+	cfg.Tenant = envString("C8Y_TENANT", "")
+	cfg.CredentialsFile = envString("C8Y_CREDENTIALS_FILE", "")
+	// a credentials file without explicit backend keeps working as before
+	defaultBackend := credentialsEnv
+	if cfg.CredentialsFile != "" {
+		defaultBackend = credentialsFile
+	}
+	cfg.CredentialsBackend = envString("C8Y_CREDENTIALS_BACKEND", defaultBackend)
+	switch cfg.CredentialsBackend {
+	case credentialsEnv, credentialsKeyring:
+	case credentialsFile:
+		if cfg.CredentialsFile == "" {
+			return cfg, fmt.Errorf("C8Y_CREDENTIALS_BACKEND file needs C8Y_CREDENTIALS_FILE")
+		}
+	default:
+		return cfg, fmt.Errorf("C8Y_CREDENTIALS_BACKEND must be one of env, file, keyring, got %q", cfg.CredentialsBackend)
+	}
+	if cfg.CredentialsRefresh, err = envDuration("C8Y_CREDENTIALS_REFRESH", 0); err != nil {
+		return cfg, err
+	}
+	// from a file or the keyring the credentials are only known once the device fetches them
+	if cfg.CredentialsBackend == credentialsEnv {
+		if cfg.Username, err = composeUsername(cfg.Tenant, envString("USERNAME", "")); err != nil {
+			return cfg, err
+		}
+		cfg.Password = envString("PASSWORD", "")
+	}
+	cfg.AuthMode = envString("C8Y_AUTH_MODE", "")
+	cfg.ClientCert = envString("C8Y_CLIENT_CERT", "")
+	cfg.ClientKey = envString("C8Y_CLIENT_KEY", "")
+	cfg.CACert = envString("C8Y_CA_CERT", "")
+	cfg.PKCS11Module = envString("C8Y_PKCS11_MODULE", "")
+	if cfg.PKCS11Slot, err = envInt("C8Y_PKCS11_SLOT", -1); err != nil {
+		return cfg, err
+	}
+	cfg.PKCS11TokenLabel = envString("C8Y_PKCS11_TOKEN_LABEL", "")
+	cfg.PKCS11Pin = envString("C8Y_PKCS11_PIN", "")
+	cfg.PKCS11KeyLabel = envString("C8Y_PKCS11_KEY_LABEL", "")
+	if cfg.PKCS11Module != "" {
+		switch {
+		case !pkcs11Supported:
+			return cfg, fmt.Errorf("C8Y_PKCS11_MODULE is set, but the client was built without PKCS#11 support (-tags pkcs11)")
+		case (cfg.PKCS11Slot < 0) == (cfg.PKCS11TokenLabel == ""):
+			return cfg, fmt.Errorf("C8Y_PKCS11_MODULE needs either C8Y_PKCS11_SLOT or C8Y_PKCS11_TOKEN_LABEL")
+		case cfg.PKCS11KeyLabel == "":
+			return cfg, fmt.Errorf("C8Y_PKCS11_MODULE needs C8Y_PKCS11_KEY_LABEL")
+		case cfg.ClientKey != "":
+			return cfg, fmt.Errorf("C8Y_CLIENT_KEY must not be set together with C8Y_PKCS11_MODULE, the key is on the token")
+		}
+	}
+
+	cfg.ClientID = envString("C8Y_CLIENT_ID", cfg.DeviceSerial)
+	if cfg.KeepAlive, err = envDuration("C8Y_KEEPALIVE", 60*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ConnectTimeout, err = envDuration("C8Y_CONNECT_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.AutoReconnect, err = envBool("C8Y_AUTO_RECONNECT", true); err != nil {
+		return cfg, err
+	}
+	if cfg.CleanSession, err = envBool("C8Y_CLEAN_SESSION", true); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxReconnectInterval, err = envDuration("C8Y_MAX_RECONNECT_INTERVAL", 10*time.Minute); err != nil {
+		return cfg, err
+	}
+	cfg.ConnectionWebhook = envString("C8Y_CONNECTION_WEBHOOK", "")
+	cfg.StateAddr = envString("C8Y_STATE_ADDR", "")
+	if cfg.ConnectionWebhookTimeout, err = envDuration("C8Y_CONNECTION_WEBHOOK_TIMEOUT", 2*time.Second); err != nil {
+		return cfg, err
+	}
+	cfg.OutageStatePath = envString("C8Y_OUTAGE_STATE", "outage.json")
+	if cfg.OutageAlarms, err = parseOutageThresholds(envList("C8Y_OUTAGE_ALARMS", []string{"1h=MAJOR", "24h=CRITICAL"})); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_OUTAGE_ALARMS: %w", err)
+	}
+	if cfg.QuotaBackoff, err = envDuration("C8Y_QUOTA_BACKOFF", 15*time.Minute); err != nil {
+		return cfg, err
+	}
+	cfg.WillMessage = envString("C8Y_WILL_MESSAGE", "")
+	cfg.StoreDir = envString("C8Y_MQTT_STORE_DIR", "")
+	if cfg.Subscriptions, err = parseSubscriptions(envList("C8Y_SUBSCRIPTIONS", nil)); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_SUBSCRIPTIONS: %w", err)
+	}
+	if cfg.SubscribeQoS, err = parseSubscribeQoS(envList("C8Y_SUBSCRIBE_QOS", nil)); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_SUBSCRIBE_QOS: %w", err)
+	}
+	if cfg.InboundMaxSize, err = envInt("C8Y_INBOUND_MAX_SIZE", 256*1024); err != nil {
+		return cfg, err
+	}
+	if cfg.InboundMaxSize <= 0 {
+		return cfg, fmt.Errorf("C8Y_INBOUND_MAX_SIZE must be positive, got %d", cfg.InboundMaxSize)
+	}
+
+	if err = cfg.LogLevel.UnmarshalText([]byte(envString("C8Y_LOG_LEVEL", "info"))); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_LOG_LEVEL: %w", err)
+	}
+	if cfg.LogSource, err = envBool("C8Y_LOG_SOURCE", true); err != nil {
+		return cfg, err
+	}
+
+	cfg.AuditLogPath = envString("C8Y_AUDIT_LOG", "")
+	if cfg.AuditLogMaxBytes, err = envInt64("C8Y_AUDIT_LOG_MAX_BYTES", 10*1024*1024); err != nil {
+		return cfg, err
+	}
+	if cfg.AuditLogBackups, err = envInt("C8Y_AUDIT_LOG_BACKUPS", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.OperationReceivedEvents, err = envBool("C8Y_OPERATION_RECEIVED_EVENTS", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.MeasurementInterval, err = envDuration("C8Y_MEASUREMENT_INTERVAL", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.MinInterval, err = envDuration("C8Y_MIN_INTERVAL", time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.JitterFraction, err = envFloat("C8Y_JITTER_FRACTION", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RequiredIntervalFactor, err = envFloat("C8Y_REQUIRED_INTERVAL_FACTOR", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.MeasurementTemplate, err = parseMeasurementTemplate(envString("C8Y_MEASUREMENT_TEMPLATE", cmp.Or(preset.Template, "200")), envString("C8Y_MEASUREMENT_TEMPLATE_FIELDS", "")); err != nil {
+		return cfg, err
+	}
+	if cfg.AggregationWindow, err = envDuration("C8Y_AGGREGATION_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.SampleInterval, err = envDuration("C8Y_SAMPLE_INTERVAL", time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.RollupSpec, err = parseRollupSpec(envList("C8Y_ROLLUP", nil)); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_ROLLUP: %w", err)
+	}
+	if cfg.RollupSchedule, err = parseCronSchedule(envString("C8Y_ROLLUP_SCHEDULE", "@daily")); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_ROLLUP_SCHEDULE: %w", err)
+	}
+	if cfg.ActiveWindow, err = parseActiveWindow(envList("C8Y_ACTIVE_HOURS", nil), envString("C8Y_ACTIVE_TIMEZONE", "Local")); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_ACTIVE_HOURS: %w", err)
+	}
+	if cfg.HeartbeatInterval, err = envDuration("C8Y_HEARTBEAT_INTERVAL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.HeartbeatInterval < 0 {
+		return cfg, fmt.Errorf("C8Y_HEARTBEAT_INTERVAL must not be negative, got %s", cfg.HeartbeatInterval)
+	}
+	cfg.HeartbeatFragment = envString("C8Y_HEARTBEAT_FRAGMENT", "c8y_Availability")
+	cfg.HeartbeatSeries = envString("C8Y_HEARTBEAT_SERIES", "heartbeat")
+	if cfg.TimeSyncInterval, err = envDuration("C8Y_TIME_SYNC_INTERVAL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.TimeSyncInterval < 0 {
+		return cfg, fmt.Errorf("C8Y_TIME_SYNC_INTERVAL must not be negative, got %s", cfg.TimeSyncInterval)
+	}
+	if cfg.TimeSyncMaxError, err = envDuration("C8Y_TIME_SYNC_MAX_ERROR", time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.TimeSyncAlarmAfter, err = envDuration("C8Y_TIME_SYNC_ALARM_AFTER", 10*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.NetworkInfoInterval, err = envDuration("C8Y_NETWORK_INFO_INTERVAL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.NetworkInfoInterval < 0 {
+		return cfg, fmt.Errorf("C8Y_NETWORK_INFO_INTERVAL must not be negative, got %s", cfg.NetworkInfoInterval)
+	}
+	if cfg.NetworkModem, err = envBool("C8Y_NETWORK_MODEM", false); err != nil {
+		return cfg, err
+	}
+	if path := envString("C8Y_SENSOR_MAPPING", ""); path != "" {
+		if cfg.SensorMappings, err = loadSensorMappings(path); err != nil {
+			return cfg, err
+		}
+	}
+	cfg.SensorMappings = preset.sensorMappings(cfg.SensorMappings)
+	if cfg.MeasurementPrecision, err = parseMeasurementPrecision(envList("C8Y_MEASUREMENT_PRECISION", nil)); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_MEASUREMENT_PRECISION: %w", err)
+	}
+	cfg.MeasurementTransport = envString("C8Y_MEASUREMENT_TRANSPORT", transportMQTT)
+	if cfg.MqttMaxPayload, err = envInt("C8Y_MQTT_MAX_PAYLOAD", 16*1024); err != nil {
+		return cfg, err
+	}
+	if cfg.RestChunkSize, err = envInt("C8Y_REST_CHUNK_SIZE", 200); err != nil {
+		return cfg, err
+	}
+	if cfg.PauseBufferSize, err = envInt("C8Y_PAUSE_BUFFER_SIZE", 10000); err != nil {
+		return cfg, err
+	}
+
+	cfg.EventBacklog = envString("C8Y_EVENT_BACKLOG", "")
+	if cfg.EventImportRate, err = envInt("C8Y_EVENT_IMPORT_RATE", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.EventMaxAge, err = envDuration("C8Y_EVENT_MAX_AGE", 0); err != nil {
+		return cfg, err
+	}
+	cfg.VersionFragment = envString("C8Y_VERSION_FRAGMENT", "")
+	if cfg.VersionOnEvents, err = envBool("C8Y_VERSION_ON_EVENTS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.EventDedupWindow, err = envDuration("C8Y_EVENT_DEDUP_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.EventDedupCount, err = envBool("C8Y_EVENT_DEDUP_COUNT", true); err != nil {
+		return cfg, err
+	}
+	cfg.MeasurementBacklog = envString("C8Y_MEASUREMENT_BACKLOG", "")
+	if cfg.ShellEnabled, err = envBool("C8Y_SHELL_ENABLED", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ShellTimeout, err = envDuration("C8Y_SHELL_TIMEOUT", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.ShellProgressInterval, err = envDuration("C8Y_SHELL_PROGRESS_INTERVAL", 2*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ShellMaxOutput, err = envInt("C8Y_SHELL_MAX_OUTPUT", 64*1024); err != nil {
+		return cfg, err
+	}
+	if cfg.RestartEnabled, err = envBool("C8Y_RESTART_ENABLED", false); err != nil {
+		return cfg, err
+	}
+	cfg.RestartCommand = envString("C8Y_RESTART_COMMAND", defaultRestartCommand())
+	cfg.RestartMarkerPath = envString("C8Y_RESTART_MARKER", "restart.pending")
+	cfg.PowerSource = envString("C8Y_POWER_SOURCE", "")
+	if cfg.BatteryInterval, err = envDuration("C8Y_BATTERY_INTERVAL", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.BatteryLowThreshold, err = envFloat("C8Y_BATTERY_LOW_THRESHOLD", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.BatteryHysteresis, err = envFloat("C8Y_BATTERY_HYSTERESIS", 5); err != nil {
+		return cfg, err
+	}
+	cfg.SNMPTarget = envString("C8Y_SNMP_TARGET", "")
+	cfg.SNMPCommunity = envString("C8Y_SNMP_COMMUNITY", "public")
+	cfg.SNMPVersion = envString("C8Y_SNMP_VERSION", "2c")
+	if path := envString("C8Y_SNMP_MAPPING", ""); path != "" {
+		if cfg.SNMPMappings, err = loadSensorMappings(path); err != nil {
+			return cfg, err
+		}
+		// OIDs are matched without the leading dot
+		for oid, m := range cfg.SNMPMappings {
+			if trimmed := strings.TrimPrefix(oid, "."); trimmed != oid {
+				delete(cfg.SNMPMappings, oid)
+				cfg.SNMPMappings[trimmed] = m
+			}
+		}
+	}
+	if cfg.SNMPInterval, err = envDuration("C8Y_SNMP_INTERVAL", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.SNMPTimeout, err = envDuration("C8Y_SNMP_TIMEOUT", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	cfg.SNMPFailoverTarget = envString("C8Y_SNMP_FAILOVER_TARGET", "")
+	if cfg.SNMPFailoverRecovery, err = envInt("C8Y_SNMP_FAILOVER_RECOVERY", 3); err != nil {
+		return cfg, err
+	}
+	cfg.LineProtocolAddr = envString("C8Y_LINE_PROTOCOL_ADDR", "")
+	cfg.LineProtocolMapping = lineProtocolMapping{
+		FragmentTag: envString("C8Y_LINE_PROTOCOL_FRAGMENT_TAG", ""),
+		UnitTag:     envString("C8Y_LINE_PROTOCOL_UNIT_TAG", "unit"),
+	}
+	if cfg.PublishRate, err = envFloat("C8Y_PUBLISH_RATE", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.PublishRecovery, err = envDuration("C8Y_PUBLISH_RECOVERY", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.PublishFailureThreshold, err = envInt("C8Y_PUBLISH_FAILURE_THRESHOLD", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.QoSDowngradeThreshold, err = envInt("C8Y_QOS_DOWNGRADE_THRESHOLD", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.AckTimeout, err = envDuration("C8Y_ACK_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.CreateAttempts, err = envInt("C8Y_CREATE_ATTEMPTS", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.CreateTimeout, err = envDuration("C8Y_CREATE_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ClockCheck, err = envBool("C8Y_CLOCK_CHECK", true); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxClockSkew, err = envDuration("C8Y_MAX_CLOCK_SKEW", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.AttachPosition, err = envBool("C8Y_ATTACH_POSITION", false); err != nil {
+		return cfg, err
+	}
+	if cfg.PositionMaxAge, err = envDuration("C8Y_POSITION_MAX_AGE", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.TimestampLocation, err = time.LoadLocation(envString("C8Y_TIMESTAMP_ZONE", "UTC")); err != nil {
+		return cfg, fmt.Errorf("C8Y_TIMESTAMP_ZONE must be UTC, Local or an IANA time zone like Europe/Berlin: %w", err)
+	}
+	if cfg.JSONStrict, err = envBool("C8Y_JSON_STRICT", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ProvisioningEvent, err = envBool("C8Y_PROVISIONING_EVENT", false); err != nil {
+		return cfg, err
+	}
+	cfg.ProvisioningFlagPath = envString("C8Y_PROVISIONING_FLAG", "provisioned")
+	cfg.PropertyCachePath = envString("C8Y_PROPERTY_CACHE", "properties.json")
+	if cfg.StartupDelay, err = envDuration("C8Y_STARTUP_DELAY", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.StartupStagger, err = envDuration("C8Y_STARTUP_STAGGER", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.StartupDelay < 0 || cfg.StartupStagger < 0 {
+		return cfg, fmt.Errorf("C8Y_STARTUP_DELAY and C8Y_STARTUP_STAGGER must not be negative")
+	}
+	if cfg.StartupVerifyTime, err = envDuration("C8Y_STARTUP_VERIFY_TIME", 3*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.StartupRetries, err = envInt("C8Y_STARTUP_RETRIES", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.StartupVerifyTime < 0 || cfg.StartupRetries < 0 {
+		return cfg, fmt.Errorf("C8Y_STARTUP_VERIFY_TIME and C8Y_STARTUP_RETRIES must not be negative")
+	}
+	cfg.ChildRegistryPath = envString("C8Y_CHILD_REGISTRY", "children.json")
+	cfg.LogfileTypes = envList("C8Y_LOGFILE_TYPES", []string{"dpkg", "container", "logread"})
+	if cfg.LogSources, err = parseLogSources(envList("C8Y_LOG_SOURCES", []string{"dpkg=/var/log/dpkg.log", "logread=cmd:logread"})); err != nil {
+		return cfg, fmt.Errorf("invalid value for C8Y_LOG_SOURCES: %w", err)
+	}
+	if cfg.ProgressInterval, err = envDuration("C8Y_PROGRESS_INTERVAL", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownTimeout, err = envDuration("C8Y_SHUTDOWN_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ClearAlarmsOnShutdown, err = envBool("C8Y_CLEAR_ALARMS_ON_SHUTDOWN", false); err != nil {
+		return cfg, err
+	}
+	cfg.PersistentAlarms = envList("C8Y_PERSISTENT_ALARMS", nil)
+	cfg.RemoteAccessProtocols = envList("C8Y_REMOTE_ACCESS_PROTOCOLS", []string{protocolSSH, protocolVNC, protocolTelnet, protocolPassthrough})
+	cfg.OperationConcurrency = envString("C8Y_OPERATION_CONCURRENCY", concurrencyGroups)
+	if cfg.OperationQueueThreshold, err = envInt("C8Y_OPERATION_QUEUE_THRESHOLD", 0); err != nil {
+		return cfg, err
+	}
+	cfg.OperationQueuePolicy = envString("C8Y_OPERATION_QUEUE_POLICY", queuePrioritize)
+	cfg.OperationPriority = envList("C8Y_OPERATION_PRIORITY", []string{"510", "515", "528"})
+	cfg.OperationDedupPath = envString("C8Y_OPERATION_DEDUP_STATE", "operations.handled.json")
+	if cfg.OperationDedupWindow, err = envDuration("C8Y_OPERATION_DEDUP_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.OperationDedupSize, err = envInt("C8Y_OPERATION_DEDUP_SIZE", 100); err != nil {
+		return cfg, err
+	}
+	cfg.FailureMessages = defaultFailureMessages
+	if path := envString("C8Y_FAILURE_MESSAGES", ""); path != "" {
+		if cfg.FailureMessages, err = loadFailureMessages(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.AuditLogMaxBytes <= 0 {
+		return cfg, fmt.Errorf("C8Y_AUDIT_LOG_MAX_BYTES must be positive, got %d", cfg.AuditLogMaxBytes)
+	}
+	if cfg.AuditLogBackups < 0 {
+		return cfg, fmt.Errorf("C8Y_AUDIT_LOG_BACKUPS must not be negative, got %d", cfg.AuditLogBackups)
+	}
+	if cfg.MeasurementInterval <= 0 {
+		return cfg, fmt.Errorf("C8Y_MEASUREMENT_INTERVAL must be positive, got %s", cfg.MeasurementInterval)
+	}
+	if cfg.MinInterval <= 0 {
+		return cfg, fmt.Errorf("C8Y_MIN_INTERVAL must be positive, got %s", cfg.MinInterval)
+	}
+	if cfg.MeasurementInterval < cfg.MinInterval {
+		logger.Warn("C8Y_MEASUREMENT_INTERVAL is below C8Y_MIN_INTERVAL, using the minimum to protect the tenant from flooding",
+			"configured", cfg.MeasurementInterval, "used", cfg.MinInterval)
+		cfg.MeasurementInterval = cfg.MinInterval
+	}
+	if cfg.JitterFraction < 0 || cfg.JitterFraction > 1 {
+		return cfg, fmt.Errorf("C8Y_JITTER_FRACTION must be between 0 and 1, got %v", cfg.JitterFraction)
+	}
+	if cfg.RequiredIntervalFactor < 1 {
+		return cfg, fmt.Errorf("C8Y_REQUIRED_INTERVAL_FACTOR must be at least 1, got %v", cfg.RequiredIntervalFactor)
+	}
+	switch cfg.MeasurementTransport {
+	case transportMQTT, transportREST, transportAuto:
+	default:
+		return cfg, fmt.Errorf("C8Y_MEASUREMENT_TRANSPORT must be one of mqtt, rest, auto, got %q", cfg.MeasurementTransport)
+	}
+	if cfg.PauseBufferSize <= 0 {
+		return cfg, fmt.Errorf("C8Y_PAUSE_BUFFER_SIZE must be positive, got %d", cfg.PauseBufferSize)
+	}
+	if cfg.MqttMaxPayload <= 0 {
+		return cfg, fmt.Errorf("C8Y_MQTT_MAX_PAYLOAD must be positive, got %d", cfg.MqttMaxPayload)
+	}
+	if cfg.RestChunkSize <= 0 {
+		return cfg, fmt.Errorf("C8Y_REST_CHUNK_SIZE must be positive, got %d", cfg.RestChunkSize)
+	}
+	if cfg.EventImportRate <= 0 {
+		return cfg, fmt.Errorf("C8Y_EVENT_IMPORT_RATE must be positive, got %d", cfg.EventImportRate)
+	}
+	if cfg.EventMaxAge < 0 {
+		return cfg, fmt.Errorf("C8Y_EVENT_MAX_AGE must not be negative, got %s", cfg.EventMaxAge)
+	}
+	if cfg.VersionOnEvents && cfg.VersionFragment == "" {
+		return cfg, fmt.Errorf("C8Y_VERSION_ON_EVENTS needs the fragment name in C8Y_VERSION_FRAGMENT")
+	}
+	if cfg.EventDedupWindow < 0 {
+		return cfg, fmt.Errorf("C8Y_EVENT_DEDUP_WINDOW must not be negative, got %s", cfg.EventDedupWindow)
+	}
+	if cfg.ShellTimeout <= 0 || cfg.ShellProgressInterval <= 0 || cfg.ShellMaxOutput <= 0 {
+		return cfg, fmt.Errorf("C8Y_SHELL_TIMEOUT, C8Y_SHELL_PROGRESS_INTERVAL and C8Y_SHELL_MAX_OUTPUT must be positive")
+	}
+	if cfg.ConnectionWebhook != "" {
+		if u, err := url.Parse(cfg.ConnectionWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("C8Y_CONNECTION_WEBHOOK must be an http(s) URL, got %q", cfg.ConnectionWebhook)
+		}
+	}
+	if cfg.ConnectionWebhookTimeout <= 0 {
+		return cfg, fmt.Errorf("C8Y_CONNECTION_WEBHOOK_TIMEOUT must be positive, got %s", cfg.ConnectionWebhookTimeout)
+	}
+	if cfg.RestartEnabled && strings.TrimSpace(cfg.RestartCommand) == "" {
+		return cfg, fmt.Errorf("C8Y_RESTART_COMMAND must be set when C8Y_RESTART_ENABLED is true")
+	}
+	if cfg.PowerSource != "" {
+		if _, err := newPowerSource(cfg.PowerSource); err != nil {
+			return cfg, fmt.Errorf("invalid value for C8Y_POWER_SOURCE: %w", err)
+		}
+	}
+	if cfg.BatteryInterval <= 0 {
+		return cfg, fmt.Errorf("C8Y_BATTERY_INTERVAL must be positive, got %s", cfg.BatteryInterval)
+	}
+	if cfg.BatteryLowThreshold < 0 || cfg.BatteryLowThreshold > 100 || cfg.BatteryHysteresis < 0 {
+		return cfg, fmt.Errorf("C8Y_BATTERY_LOW_THRESHOLD must be within 0..100 and C8Y_BATTERY_HYSTERESIS must not be negative")
+	}
+	if cfg.SNMPTarget != "" {
+		switch {
+		case !snmpSupported:
+			return cfg, fmt.Errorf("C8Y_SNMP_TARGET is set, but the client was built without SNMP support (-tags snmp)")
+		case len(cfg.SNMPMappings) == 0:
+			return cfg, fmt.Errorf("C8Y_SNMP_MAPPING must list the OIDs to poll when C8Y_SNMP_TARGET is set")
+		case cfg.SNMPVersion != "1" && cfg.SNMPVersion != "2c":
+			return cfg, fmt.Errorf("C8Y_SNMP_VERSION must be 1 or 2c, got %q", cfg.SNMPVersion)
+		case cfg.SNMPInterval <= 0 || cfg.SNMPTimeout <= 0:
+			return cfg, fmt.Errorf("C8Y_SNMP_INTERVAL and C8Y_SNMP_TIMEOUT must be positive")
+		case cfg.SNMPFailoverTarget != "" && cfg.SNMPFailoverRecovery < 1:
+			return cfg, fmt.Errorf("C8Y_SNMP_FAILOVER_RECOVERY must be at least 1, got %d", cfg.SNMPFailoverRecovery)
+		}
+	}
+	if err := validateConcurrencyPolicy(cfg.OperationConcurrency); err != nil {
+		return cfg, err
+	}
+	if cfg.AggregationWindow < 0 || cfg.SampleInterval <= 0 {
+		return cfg, fmt.Errorf("C8Y_AGGREGATION_WINDOW must not be negative and C8Y_SAMPLE_INTERVAL must be positive")
+	}
+	if cfg.AggregationWindow > 0 && cfg.AggregationWindow < cfg.SampleInterval {
+		return cfg, fmt.Errorf("C8Y_AGGREGATION_WINDOW (%s) must not be shorter than C8Y_SAMPLE_INTERVAL (%s)", cfg.AggregationWindow, cfg.SampleInterval)
+	}
+	if cfg.ProgressInterval <= 0 {
+		return cfg, fmt.Errorf("C8Y_PROGRESS_INTERVAL must be positive, got %s", cfg.ProgressInterval)
+	}
+	if cfg.CreateAttempts <= 0 || cfg.CreateTimeout <= 0 {
+		return cfg, fmt.Errorf("C8Y_CREATE_ATTEMPTS and C8Y_CREATE_TIMEOUT must be positive")
+	}
+	if cfg.PublishRate < 0 {
+		return cfg, fmt.Errorf("C8Y_PUBLISH_RATE must not be negative, got %v", cfg.PublishRate)
+	}
+	if cfg.PublishRecovery <= 0 {
+		return cfg, fmt.Errorf("C8Y_PUBLISH_RECOVERY must be positive, got %s", cfg.PublishRecovery)
+	}
+	if cfg.PublishFailureThreshold < 0 {
+		return cfg, fmt.Errorf("C8Y_PUBLISH_FAILURE_THRESHOLD must not be negative, got %d", cfg.PublishFailureThreshold)
+	}
+	if cfg.QoSDowngradeThreshold < 0 || cfg.AckTimeout <= 0 {
+		return cfg, fmt.Errorf("C8Y_QOS_DOWNGRADE_THRESHOLD must not be negative and C8Y_ACK_TIMEOUT must be positive")
+	}
+	if cfg.OperationDedupWindow < 0 || cfg.OperationDedupSize <= 0 {
+		return cfg, fmt.Errorf("C8Y_OPERATION_DEDUP_WINDOW must not be negative and C8Y_OPERATION_DEDUP_SIZE must be positive")
+	}
+	if cfg.OperationQueueThreshold < 0 {
+		return cfg, fmt.Errorf("C8Y_OPERATION_QUEUE_THRESHOLD must not be negative, got %d", cfg.OperationQueueThreshold)
+	}
+	if err := validateQueuePolicy(cfg.OperationQueuePolicy); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// tenant ids are either generated (t12345) or chosen at creation (my-tenant), both only use these characters
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// composeUsername returns "tenant/user", Cumulocity rejects a username without tenant prefix with a plain "not authorized"
+func composeUsername(tenant string, user string) (string, error) {
+	if tenant == "" {
+		return user, nil
+	}
+	if !tenantPattern.MatchString(tenant) {
+		return "", fmt.Errorf("C8Y_TENANT %q is not a valid tenant id", tenant)
+	}
+	if prefix, name, found := strings.Cut(user, "/"); found {
+		if prefix != tenant {
+			return "", fmt.Errorf("USERNAME is prefixed with tenant %q but C8Y_TENANT is %q", prefix, tenant)
+		}
+		if name == "" {
+			return "", fmt.Errorf("USERNAME %q is missing the user part", user)
+		}
+		return user, nil
+	}
+	if user == "" {
+		return "", fmt.Errorf("C8Y_TENANT is set but USERNAME is empty")
+	}
+	return tenant + "/" + user, nil
+}
+
+func envString(key string, def string) string {
+	if v, ok := lookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) (int, error) {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return i, nil
+}
+
+func envInt64(key string, def int64) (int64, error) {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return i, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envFloat(key string, def float64) (float64, error) {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return f, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	v, ok := lookupEnv(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// envList splits a comma separated value, empty entries are dropped
+func envList(key string, def []string) []string {
+	v, ok := lookupEnv(key)
+	if !ok || strings.TrimSpace(v) == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
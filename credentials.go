@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/joho/godotenv"
+	"github.com/zalando/go-keyring"
+)
+
+// supported values for C8Y_CREDENTIALS_BACKEND
+const (
+	credentialsEnv     = "env"
+	credentialsFile    = "file"
+	credentialsKeyring = "keyring"
+)
+
+// Credentials are the username/password the device authenticates with
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialsProvider is the source of the device credentials
+// implement it to fetch credentials from a secret store (Vault, a cloud secrets manager, a TPM, ...)
+// Get is called on startup and, if a refresh interval is configured, periodically to pick up rotated credentials
+type CredentialsProvider interface {
+	Get(ctx context.Context) (Credentials, error)
+}
+
+// envCredentials reads USERNAME/PASSWORD from the environment (or C8Y_CONNECTION)
+type envCredentials struct{}
+
+func (envCredentials) Get(ctx context.Context) (Credentials, error) {
+	return Credentials{Username: envString("USERNAME", ""), Password: envString("PASSWORD", "")}, nil
+}
+
+// fileCredentials reads USERNAME/PASSWORD from a file in .env format
+// the file is read again on every call, so replacing it rotates the credentials
+type fileCredentials struct {
+	path string
+}
+
+func (f fileCredentials) Get(ctx context.Context) (Credentials, error) {
+	values, err := godotenv.Read(f.path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("reading credentials file: %w", err)
+	}
+	if values["USERNAME"] == "" || values["PASSWORD"] == "" {
+		return Credentials{}, fmt.Errorf("credentials file %s must contain USERNAME and PASSWORD", f.path)
+	}
+	return Credentials{Username: values["USERNAME"], Password: values["PASSWORD"]}, nil
+}
+
+// keyringService is the service the credentials are stored under in the OS keyring, the account is the device serial
+const keyringService = "c8y-device-client"
+
+// keyringCredentials reads the credentials from the OS keyring (Secret Service/libsecret, macOS Keychain, Windows Credential Manager)
+// username and password are stored as one secret in .env format, so they can't get out of sync
+// if there is no keyring (e.g. no Secret Service running on a headless device), the credentials file is used instead
+type keyringCredentials struct {
+	serial   string
+	fallback CredentialsProvider
+
+	warnOnce sync.Once
+}
+
+func (k *keyringCredentials) Get(ctx context.Context) (Credentials, error) {
+	secret, err := keyring.Get(keyringService, k.serial)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return Credentials{}, fmt.Errorf("no credentials for %s in the keyring, store them with \"./client store-credentials\"", k.serial)
+	}
+	if err != nil {
+		if k.fallback == nil {
+			return Credentials{}, fmt.Errorf("keyring unavailable: %w", err)
+		}
+		k.warnOnce.Do(func() {
+			logger.Warn("Keyring unavailable, reading credentials from C8Y_CREDENTIALS_FILE instead", "err", err)
+		})
+		return k.fallback.Get(ctx)
+	}
+	values, err := godotenv.Unmarshal(secret)
+	if err != nil || values["USERNAME"] == "" || values["PASSWORD"] == "" {
+		return Credentials{}, fmt.Errorf("credentials in the keyring must contain USERNAME and PASSWORD")
+	}
+	return Credentials{Username: values["USERNAME"], Password: values["PASSWORD"]}, nil
+}
+
+// Set stores the credentials in the keyring
+func (k *keyringCredentials) Set(creds Credentials) error {
+	secret, err := godotenv.Marshal(map[string]string{"USERNAME": creds.Username, "PASSWORD": creds.Password})
+	if err != nil {
+		return err
+	}
+	return keyring.Set(keyringService, k.serial, secret)
+}
+
+// newCredentialsProvider returns the provider selected by C8Y_CREDENTIALS_BACKEND
+func newCredentialsProvider(cfg Config) CredentialsProvider {
+	switch cfg.CredentialsBackend {
+	case credentialsKeyring:
+		k := &keyringCredentials{serial: cfg.DeviceSerial}
+		if cfg.CredentialsFile != "" {
+			k.fallback = fileCredentials{path: cfg.CredentialsFile}
+		}
+		return k
+	case credentialsFile:
+		return fileCredentials{path: cfg.CredentialsFile}
+	}
+	return envCredentials{}
+}
+
+// storeCredentials copies the credentials from the environment (USERNAME/PASSWORD) into the keyring, for "./client store-credentials"
+func storeCredentials(cfg Config) error {
+	creds, _ := envCredentials{}.Get(context.Background())
+	if creds.Username == "" || creds.Password == "" {
+		return fmt.Errorf("USERNAME and PASSWORD must be set")
+	}
+	return (&keyringCredentials{serial: cfg.DeviceSerial}).Set(creds)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// HandledOperations remembers the operations handed to the handlers, so an operation redelivered by the broker
+// (QoS 1 after a reconnect, or after a crash before the message was acknowledged) isn't executed a second time
+// JSON operations are identified by their id, static templates carry none so they are identified by their payload
+// and only checked when the broker flags the message as redelivery, see Redelivered. An operation only counts as handled
+// for a window of time. The set is bounded to the most recent entries and persisted, so the guarantee holds across restarts
+type HandledOperations struct {
+	path   string
+	window time.Duration
+	size   int
+
+	mu      sync.Mutex
+	entries []handledOperation
+}
+
+type handledOperation struct {
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+func NewHandledOperations(path string, window time.Duration, size int) *HandledOperations {
+	h := &HandledOperations{path: path, window: window, size: size}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Failed to read handled operations, starting fresh", "path", path, "err", err)
+		}
+		return h
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		logger.Warn("Ignoring invalid handled operations, starting fresh", "path", path, "err", err)
+		h.entries = nil
+	}
+	return h
+}
+
+// payloadKey identifies an operation by its payload, for static templates without operation id
+func payloadKey(payload []byte) string {
+	sum := sha256.Sum256(bytes.TrimSpace(payload))
+	return hex.EncodeToString(sum[:16])
+}
+
+// operationIDKey identifies a JSON operation by its id, the payload if it has none
+func operationIDKey(id string, payload []byte) string {
+	if id == "" {
+		return payloadKey(payload)
+	}
+	return "id:" + id
+}
+
+// Seen reports whether the operation has been handled within the window. A nil set (deduplication disabled) has seen nothing
+func (h *HandledOperations) Seen(key string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(time.Now().UTC())
+	for _, e := range h.entries {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Redelivered reports whether a static template operation of s/ds has been handled already. A user scheduling the very
+// same operation again sends the same payload, so only messages the broker flags as redelivery (DUP) are compared:
+// skipping a new operation would leave it PENDING, as it can't be answered without touching the first one
+func (h *HandledOperations) Redelivered(msg mqtt.Message) bool {
+	return msg.Duplicate() && h.Seen(payloadKey(msg.Payload()))
+}
+
+// Record marks the operation as handled, called once it has been accepted by the serializer. It is recorded before it
+// runs: an operation interrupted by a crash isn't repeated, which is what destructive operations like restarts and
+// firmware updates need. Operations that were rejected aren't recorded, the platform may deliver them again
+func (h *HandledOperations) Record(key string) {
+	if h == nil {
+		return
+	}
+	now := time.Now().UTC()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	h.entries = append(h.entries, handledOperation{Key: key, Time: now})
+	if len(h.entries) > h.size {
+		h.entries = h.entries[len(h.entries)-h.size:]
+	}
+	h.save()
+}
+
+// expire drops the entries older than the window, entries are in the order they were recorded
+func (h *HandledOperations) expire(now time.Time) {
+	i := 0
+	for i < len(h.entries) && now.Sub(h.entries[i].Time) > h.window {
+		i++
+	}
+	h.entries = h.entries[i:]
+}
+
+// save writes the set to a temporary file first, a crash while writing mustn't leave a truncated file behind
+func (h *HandledOperations) save() {
+	data, err := json.Marshal(h.entries)
+	if err == nil {
+		tmp := h.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, h.path)
+		}
+	}
+	if err != nil {
+		logger.Warn("Failed to persist handled operations", "path", h.path, "err", err)
+	}
+}
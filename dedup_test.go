@@ -0,0 +1,81 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandledOperations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handled.json")
+	h := NewHandledOperations(path, time.Minute, 10)
+
+	key := payloadKey([]byte("510,serial\n"))
+	if h.Seen(key) {
+		t.Fatal("new operation reported as seen")
+	}
+	h.Record(key)
+	if !h.Seen(payloadKey([]byte("510,serial"))) {
+		t.Fatal("recorded operation not seen")
+	}
+	if !NewHandledOperations(path, time.Minute, 10).Seen(key) {
+		t.Fatal("recorded operation not persisted")
+	}
+
+	// JSON operations with the same content but another id are different operations
+	first := []byte(`{"id":"1","c8y_Message":{"text":"hi"}}`)
+	second := []byte(`{"id":"2","c8y_Message":{"text":"hi"}}`)
+	h.Record(operationIDKey(jsonOperationID(first), first))
+	if h.Seen(operationIDKey(jsonOperationID(second), second)) {
+		t.Fatal("operation with another id reported as seen")
+	}
+	if !h.Seen(operationIDKey(jsonOperationID(first), first)) {
+		t.Fatal("operation with the same id not seen")
+	}
+
+	var disabled *HandledOperations
+	disabled.Record(key)
+	if disabled.Seen(key) {
+		t.Fatal("disabled deduplication reported an operation as seen")
+	}
+}
+
+// redeliveredMessage is an operation the broker sends again, with the DUP flag set
+type redeliveredMessage struct {
+	simulatedMessage
+}
+
+func (redeliveredMessage) Duplicate() bool { return true }
+
+func TestHandledOperationsRedelivered(t *testing.T) {
+	h := NewHandledOperations(filepath.Join(t.TempDir(), "handled.json"), time.Minute, 10)
+	restart := simulatedMessage{topic: "s/ds", payload: []byte("510,serial")}
+	h.Record(payloadKey(restart.Payload()))
+	if !h.Redelivered(redeliveredMessage{restart}) {
+		t.Error("redelivery of a handled operation not detected")
+	}
+	// the user scheduled the restart again, the broker delivers it without DUP
+	if h.Redelivered(restart) {
+		t.Error("operation scheduled again taken for a redelivery")
+	}
+	if h.Redelivered(redeliveredMessage{simulatedMessage{topic: "s/ds", payload: []byte("510,other")}}) {
+		t.Error("redelivery of an operation not handled yet skipped")
+	}
+}
+
+func TestHandledOperationsWindow(t *testing.T) {
+	h := NewHandledOperations(filepath.Join(t.TempDir(), "handled.json"), time.Minute, 2)
+	h.Record("a")
+	h.Record("b")
+	h.Record("c")
+	if h.Seen("a") {
+		t.Fatal("oldest entry kept beyond the size")
+	}
+	h.entries[0].Time = time.Now().Add(-2 * time.Minute)
+	if h.Seen("b") {
+		t.Fatal("entry kept beyond the window")
+	}
+	if !h.Seen("c") {
+		t.Fatal("entry within the window dropped")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Device is the connection of this device to Cumulocity
+type Device struct {
+	cfg         Config
+	credentials CredentialsProvider
+	client      mqtt.Client
+	operations  *OperationSerializer
+	// publisher of the measurements, for the snapshot
+	measurements *MeasurementPublisher
+
+	mu      sync.Mutex
+	current Credentials
+	// tenant detected from the platform, used in place of C8Y_TENANT when that isn't set
+	tenant          string
+	managedObjectID string
+	capabilities    []string
+
+	// one reconnect at a time, ready is closed once it is done (nil while none is running)
+	reconnectMu sync.Mutex
+	ready       atomic.Pointer[chan struct{}]
+}
+
+// time in-flight publishes get to complete when disconnecting for a reconnect
+const reconnectQuiesce = 5 * time.Second
+
+// NewDevice fetches the credentials from the provider and prepares the MQTT client, it doesn't connect yet
+func NewDevice(cfg Config, credentials CredentialsProvider) (*Device, error) {
+	d := &Device{cfg: cfg, credentials: credentials}
+	creds, err := d.fetchCredentials()
+	if err != nil {
+		return nil, err
+	}
+	d.current = creds
+	cfg.Username, cfg.Password = creds.Username, creds.Password
+
+	opts, err := buildClientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// paho asks for the credentials on every (re)connect, so rotated credentials are used without rebuilding the client
+	opts.SetCredentialsProvider(func() (string, string) {
+		creds := d.Credentials()
+		return creds.Username, creds.Password
+	})
+	d.client = mqtt.NewClient(opts)
+	return d, nil
+}
+
+// Client is the underlying paho client
+func (d *Device) Client() mqtt.Client {
+	return d.client
+}
+
+// Name is the name of the device twin
+func (d *Device) Name() string {
+	return d.cfg.DeviceName
+}
+
+// Serial is the serial of the device, its external id
+func (d *Device) Serial() string {
+	return d.cfg.DeviceSerial
+}
+
+// PublishSmartRest publishes SmartREST lines on s/us, see publishSmartRestMessage
+func (d *Device) PublishSmartRest(message string) error {
+	return publishSmartRestMessage(d.client, message)
+}
+
+// PublishJSON publishes a document via JSON over MQTT (e.g. on inventory/managedObjects/update/<serial>), see
+// publishJsonViaMqttMessage
+func (d *Device) PublishJSON(topic string, json string) error {
+	return publishJsonViaMqttMessage(d.client, topic, json)
+}
+
+// Credentials returns the credentials currently used for the connection
+func (d *Device) Credentials() Credentials {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// OperationQueueDepth returns the number of operations waiting to be executed and currently executing
+func (d *Device) OperationQueueDepth() QueueDepth {
+	return d.operations.Depth()
+}
+
+// UseTenant prefixes the username with the tenant detected from the platform, for this and all refreshed credentials
+// REST and remote access need the prefix, MQTT accepts it as well
+func (d *Device) UseTenant(tenant string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	username, err := composeUsername(tenant, d.current.Username)
+	if err != nil {
+		return err
+	}
+	d.tenant = tenant
+	d.current.Username = username
+	return nil
+}
+
+// ManagedObjectID is the platform id of the device twin, as needed for source.id of JSON payloads
+// it is empty until Create (or LookupManagedObjectID, if Create couldn't confirm the device) found it
+func (d *Device) ManagedObjectID() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.managedObjectID
+}
+
+// SetCapabilities records the capabilities declared to the platform (114), for the snapshot
+func (d *Device) SetCapabilities(capabilities []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.capabilities = capabilities
+}
+
+func (d *Device) setManagedObjectID(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.managedObjectID = id
+}
+
+// LookupManagedObjectID resolves the managed object id via the identity API, retrying with growing delays until it
+// succeeds or ctx is done
+func (d *Device) LookupManagedObjectID(ctx context.Context, rest *RestClient) {
+	for delay := 5 * time.Second; ; delay = min(2*delay, 5*time.Minute) {
+		id, err := rest.DeviceID(ctx)
+		if err == nil {
+			d.setManagedObjectID(id)
+			logger.Info("Resolved managed object id", "id", id)
+			return
+		}
+		logger.Warn("Failed to look up the managed object id, retrying", "in", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (d *Device) Connect() error {
+	if token := d.client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// Reconnect closes the MQTT connection cleanly and connects again, e.g. after the device switched networks
+// in-flight publishes get a few seconds to complete, QoS 1 messages that don't are resent after reconnecting if
+// C8Y_STORE_DIR persists them. The subscriptions and the connect handling run again as on every connect.
+// Loops calling WaitReady pause until the connection is back
+func (d *Device) Reconnect(reason string) error {
+	d.reconnectMu.Lock()
+	defer d.reconnectMu.Unlock()
+	ready := make(chan struct{})
+	d.ready.Store(&ready)
+	defer func() {
+		d.ready.Store(nil)
+		close(ready)
+	}()
+
+	logger.Info("Reconnecting", "reason", reason)
+	d.client.Disconnect(uint(reconnectQuiesce.Milliseconds()))
+	if err := d.Connect(); err != nil {
+		return fmt.Errorf("reconnecting: %w", err)
+	}
+	logger.Info("Reconnected", "reason", reason)
+	return nil
+}
+
+// WaitReady blocks while a reconnect is running, until it is done or ctx is done
+func (d *Device) WaitReady(ctx context.Context) {
+	ready := d.ready.Load()
+	if ready == nil {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-*ready:
+	}
+}
+
+func (d *Device) fetchCredentials() (Credentials, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	creds, err := d.credentials.Get(ctx)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("fetching credentials: %w", err)
+	}
+	d.mu.Lock()
+	tenant := cmp.Or(d.cfg.Tenant, d.tenant)
+	d.mu.Unlock()
+	if creds.Username, err = composeUsername(tenant, creds.Username); err != nil {
+		return Credentials{}, err
+	}
+	return creds, nil
+}
+
+// RefreshCredentials polls the credentials provider and reconnects with the new credentials once they changed
+func (d *Device) RefreshCredentials(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		creds, err := d.fetchCredentials()
+		if err != nil {
+			logger.Warn("Failed to refresh credentials, keeping the current ones", "err", err)
+			continue
+		}
+		if creds == d.Credentials() {
+			continue
+		}
+		d.mu.Lock()
+		d.current = creds
+		d.mu.Unlock()
+
+		if err := d.Reconnect("credentials changed"); err != nil {
+			logger.Error("Failed to reconnect with new credentials", "err", err)
+		}
+	}
+}
+
+// Create publishes 100 and waits until the device can be found via its external id, the id found is the ManagedObjectID
+// the 100 is published again if the device doesn't show up, e.g. because the message got lost on a connection blip right after connect
+// if the existence can't be checked (REST not reachable or not authorized) creation is assumed after a short wait
+func (d *Device) Create(rest *RestClient, name string, deviceType string) error {
+	for attempt := 1; attempt <= d.cfg.CreateAttempts; attempt++ {
+		// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#100
+		d.PublishSmartRest(buildSmartRest("100", name, deviceType))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(attempt)*d.cfg.CreateTimeout)
+		id, err := awaitManagedObject(ctx, rest)
+		cancel()
+		switch {
+		case err == nil:
+			logger.Info("Device exists", "id", id)
+			d.setManagedObjectID(id)
+			return nil
+		case !errors.Is(err, errDeviceNotFound):
+			logger.Warn("Can't check whether the device has been created, continuing", "err", err)
+			time.Sleep(2 * time.Second)
+			return nil
+		}
+		logger.Warn("Device hasn't been created yet, publishing 100 again", "attempt", attempt)
+	}
+	return fmt.Errorf("device %s doesn't exist after %d attempts", d.cfg.DeviceSerial, d.cfg.CreateAttempts)
+}
+
+var errDeviceNotFound = errors.New("device not found")
+
+// awaitManagedObject polls the identity API until the device has an id, errDeviceNotFound is returned once ctx is done
+func awaitManagedObject(ctx context.Context, rest *RestClient) (string, error) {
+	for {
+		id, err := rest.DeviceID(ctx)
+		if err != nil && ctx.Err() != nil {
+			return "", errDeviceNotFound
+		}
+		var statusErr *httpStatusError
+		if err == nil || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+			return id, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", errDeviceNotFound
+		case <-time.After(time.Second):
+		}
+	}
+}
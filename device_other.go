@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// ReconnectOnSignal does nothing, there is no SIGUSR1 outside unix. The reconnect command still works, see device_unix.go
+func (d *Device) ReconnectOnSignal(ctx context.Context) {}
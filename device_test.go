@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestDevicePublish(t *testing.T) {
+	client := &recordingClient{}
+	d := &Device{cfg: Config{DeviceName: "My Device", DeviceSerial: "DeviceSerial"}, client: client}
+	if d.Name() != "My Device" || d.Serial() != "DeviceSerial" {
+		t.Errorf("name %q, serial %q don't match the configuration", d.Name(), d.Serial())
+	}
+	if err := d.PublishSmartRest("110,DeviceSerial,myHardwareModel,1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	topic := "inventory/managedObjects/update/" + d.Serial()
+	if err := d.PublishJSON(topic, `{"yourCustomFragment":{"a":"abc"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PublishJSON(topic, `{"yourCustomFragment":`); err == nil {
+		t.Error("invalid JSON published")
+	}
+	if published := client.messages("s/us"); len(published) != 1 || published[0] != "110,DeviceSerial,myHardwareModel,1.2.3" {
+		t.Errorf("published %q on s/us", published)
+	}
+	if published := client.messages(topic); len(published) != 1 {
+		t.Errorf("published %q on %s, want the valid document", published, topic)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReconnectOnSignal reconnects on every SIGUSR1 until ctx is done
+func (d *Device) ReconnectOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+		if err := d.Reconnect("SIGUSR1"); err != nil {
+			logger.Error("Failed to reconnect", "err", err)
+		}
+	}
+}
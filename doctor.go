@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"time"
+)
+
+// runDoctor checks step by step whether the device can reach and use the platform, for "./client doctor"
+// each step builds on the previous one, so the first failure ends the check. Returns the exit code
+func runDoctor(cfg Config) int {
+	// the report is the output, log messages of the client would only clutter it
+	setLogLevel(slog.LevelError)
+	cfg.AutoReconnect = false
+
+	broker, err := url.Parse(cfg.Brokers[0])
+	if err != nil {
+		fmt.Printf("FAIL  broker address: %v\n", err)
+		return 1
+	}
+	address := net.JoinHostPort(broker.Hostname(), brokerPort(broker))
+	secure := broker.Scheme == "ssl" || broker.Scheme == "tls" || broker.Scheme == "mqtts" || broker.Scheme == "wss"
+
+	var conn net.Conn
+	var device *Device
+	steps := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{"credentials", func() (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			creds, err := newCredentialsProvider(cfg).Get(ctx)
+			if err != nil {
+				return "", err
+			}
+			if cfg.Username, err = composeUsername(cfg.Tenant, creds.Username); err != nil {
+				return "", err
+			}
+			cfg.Password = creds.Password
+			authMode, err := resolveAuthMode(cfg)
+			return "auth mode " + authMode, err
+		}},
+		{"resolve " + broker.Hostname(), func() (string, error) {
+			addrs, err := net.LookupHost(broker.Hostname())
+			return fmt.Sprint(addrs), err
+		}},
+		{"clock", func() (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+			defer cancel()
+			skew, err := clockSkew(ctx, cfg.BaseURL)
+			if err != nil {
+				// the REST endpoint may be blocked while MQTT works, that's no reason to stop here
+				return "skipped, can't reach " + cfg.BaseURL + ": " + err.Error(), nil
+			}
+			if skew.Abs() > cfg.MaxClockSkew {
+				return "", fmt.Errorf("system clock is off by %s compared to the platform", skew.Round(time.Second))
+			}
+			return fmt.Sprintf("skew %s", skew.Round(time.Millisecond)), nil
+		}},
+		{"tcp connect " + address, func() (string, error) {
+			conn, err = net.DialTimeout("tcp", address, cfg.ConnectTimeout)
+			if err != nil {
+				return "", err
+			}
+			return conn.RemoteAddr().String(), nil
+		}},
+		{"tls handshake", func() (string, error) {
+			defer conn.Close()
+			if !secure {
+				return "skipped, " + broker.Scheme + " is unencrypted", nil
+			}
+			authMode, _ := resolveAuthMode(cfg)
+			tlsConfig, err := buildTLSConfig(cfg, authMode)
+			if err != nil {
+				return "", err
+			}
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			tlsConfig.ServerName = broker.Hostname()
+			tlsConn := tls.Client(conn, tlsConfig)
+			tlsConn.SetDeadline(time.Now().Add(cfg.ConnectTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				return "", err
+			}
+			state := tlsConn.ConnectionState()
+			return fmt.Sprintf("%s, server certificate %s", tls.VersionName(state.Version), state.PeerCertificates[0].Subject), nil
+		}},
+		{"mqtt connect", func() (string, error) {
+			if device, err = NewDevice(cfg, newCredentialsProvider(cfg)); err != nil {
+				return "", err
+			}
+			return "client id " + cfg.ClientID, device.Connect()
+		}},
+		{"subscribe s/ds", func() (string, error) {
+			token := device.Client().Subscribe("s/ds", 1, logReceivedMessage)
+			if !token.WaitTimeout(cfg.ConnectTimeout) {
+				return "", fmt.Errorf("no SUBACK within %s", cfg.ConnectTimeout)
+			}
+			return "", token.Error()
+		}},
+		// a token request on s/uat is answered on s/dat, which makes it a publish/subscribe round trip without creating any data
+		{"publish s/uat, echo on s/dat", func() (string, error) {
+			info, err := queryTenant(device.Client(), 10*time.Second, nil)
+			return "tenant " + info.Tenant, err
+		}},
+	}
+
+	failed := false
+	for _, step := range steps {
+		if failed {
+			fmt.Printf("SKIP  %s\n", step.name)
+			continue
+		}
+		started := time.Now()
+		detail, err := step.run()
+		took := time.Since(started).Round(time.Millisecond)
+		if err != nil {
+			fmt.Printf("FAIL  %s (%s): %v\n", step.name, took, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("PASS  %s (%s) %s\n", step.name, took, detail)
+	}
+	if device != nil {
+		device.Client().Disconnect(250)
+	}
+
+	if failed {
+		fmt.Println("Connectivity check failed")
+		return 1
+	}
+	fmt.Println("Connectivity check passed")
+	return 0
+}
+
+// brokerPort returns the port of the broker address, or the default port of its scheme
+func brokerPort(broker *url.URL) string {
+	if port := broker.Port(); port != "" {
+		return port
+	}
+	switch broker.Scheme {
+	case "ssl", "tls", "mqtts":
+		return "8883"
+	case "ws":
+		return "80"
+	case "wss":
+		return "443"
+	}
+	return "1883"
+}
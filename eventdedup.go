@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EventSuppressor holds back events repeating the previous event of their type (same text) within a window, so a
+// stuck condition reporting every cycle doesn't flood the platform. An event with a different text goes through
+// right away. The platform deduplicates alarms of the same type itself, incrementing their count, events it doesn't
+type EventSuppressor struct {
+	window time.Duration
+	// attach the number of suppressed events to the next event of the type that goes through
+	count bool
+
+	mu   sync.Mutex
+	last map[string]*eventRun
+}
+
+// eventRun is the last event of a type that went through and the identical ones suppressed since
+type eventRun struct {
+	text       string
+	sent       time.Time
+	suppressed int
+}
+
+func NewEventSuppressor(window time.Duration, count bool) *EventSuppressor {
+	return &EventSuppressor{window: window, count: count, last: map[string]*eventRun{}}
+}
+
+// Allow reports whether the event is published, and with counting enabled how many identical events of its type were
+// suppressed before it. A nil suppressor (deduplication disabled) allows every event
+func (s *EventSuppressor) Allow(eventType string, text string) (ok bool, suppressed int) {
+	if s == nil {
+		return true, 0
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run := s.last[eventType]
+	if run != nil && run.text == text && now.Sub(run.sent) < s.window {
+		run.suppressed++
+		return false, 0
+	}
+	if run != nil && run.suppressed > 0 {
+		logger.Info("Suppressed repeated events", "type", eventType, "text", run.text, "count", run.suppressed)
+		if s.count {
+			suppressed = run.suppressed
+		}
+	}
+	s.last[eventType] = &eventRun{text: text, sent: now}
+	return true, suppressed
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tidwall/sjson"
+)
+
+// Event is a Cumulocity event created via the JSON-over-MQTT API
+// Fragments are set on the event as they are, values can be anything that encodes to JSON
+type Event struct {
+	Type      string
+	Text      string
+	Time      time.Time
+	Fragments map[string]any
+	// optional, attached as c8y_ExternalId fragment for correlation with external systems
+	ExternalID *ExternalID
+}
+
+// toJSON renders the event, a zero Time is replaced with the current time
+func (e Event) toJSON() (string, error) {
+	if e.Type == "" || e.Text == "" {
+		return "", fmt.Errorf("event needs type and text")
+	}
+	t := e.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	json := "{}"
+	json, _ = sjson.Set(json, "time", formatTimestamp(t))
+	json, _ = sjson.Set(json, "text", e.Text)
+	json, _ = sjson.Set(json, "type", e.Type)
+	for name, value := range e.Fragments {
+		var err error
+		if json, err = sjson.Set(json, sjsonKey(name), value); err != nil {
+			return "", fmt.Errorf("setting fragment %s: %w", name, err)
+		}
+	}
+	if e.ExternalID != nil {
+		if err := e.ExternalID.validate(); err != nil {
+			return "", err
+		}
+		json, _ = sjson.Set(json, "c8y_ExternalId", e.ExternalID.fragment())
+	}
+	return json, nil
+}
+
+// publishEvent creates the event, with C8Y_ATTACH_POSITION current events get the position of the device
+// events with an older time (e.g. imported from the backlog) don't, the position may have changed since.
+// Current events repeating the previous one of their type are suppressed with C8Y_EVENT_DEDUP_WINDOW
+func publishEvent(client mqtt.Client, e Event) error {
+	current := e.Time.IsZero() || time.Since(e.Time) < time.Minute
+	if current && e.Type != "" && e.Text != "" {
+		ok, suppressed := eventSuppressor.Allow(e.Type, e.Text)
+		if !ok {
+			logger.Debug("Suppressing repeated event", "type", e.Type)
+			return nil
+		}
+		if suppressed > 0 {
+			e.Fragments = maps.Clone(e.Fragments)
+			if e.Fragments == nil {
+				e.Fragments = map[string]any{}
+			}
+			e.Fragments["c8y_SuppressedEvents"] = map[string]any{"count": suppressed}
+		}
+	}
+	if name, version, ok := agent.eventFragment(); ok {
+		if _, set := e.Fragments[name]; !set {
+			e.Fragments = maps.Clone(e.Fragments)
+			if e.Fragments == nil {
+				e.Fragments = map[string]any{}
+			}
+			e.Fragments[name] = version
+		}
+	}
+	if pos, ok := trackedPosition.Current(); ok && current {
+		if _, set := e.Fragments["c8y_Position"]; !set {
+			e.Fragments = maps.Clone(e.Fragments)
+			if e.Fragments == nil {
+				e.Fragments = map[string]any{}
+			}
+			e.Fragments["c8y_Position"] = pos.fragment()
+		}
+	}
+	json, err := e.toJSON()
+	if err != nil {
+		return err
+	}
+	return publishJsonViaMqttMessage(client, "event/events/create", json)
+}
+
+// importEvents publishes historical events from a JSONL file with their original timestamps
+// each line is an event document, e.g. {"type":"c8y_Boot","text":"Device booted","time":"2024-03-01T10:00:00.000Z"}
+// events are published in file order with at most ratePerSec events per second, so the backlog doesn't hit the tenant at once
+// events older than maxAge are skipped (0 disables the check), the platform rejects events beyond its retention anyway
+// rejections by the platform are reported asynchronously on s/e, see handleErrorMessage
+func importEvents(ctx context.Context, client mqtt.Client, path string, ratePerSec int, maxAge time.Duration) (imported int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ticker := time.NewTicker(time.Second / time.Duration(ratePerSec))
+	defer ticker.Stop()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e, err := parseEventLine(scanner.Bytes())
+		if err != nil {
+			logger.Warn("Skipping invalid event in backlog", "path", path, "line", line, "err", err)
+			continue
+		}
+		if maxAge > 0 && time.Since(e.Time) > maxAge {
+			logger.Warn("Skipping event older than the max age", "path", path, "line", line, "time", e.Time, "maxAge", maxAge)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return imported, ctx.Err()
+		case <-ticker.C:
+		}
+		if err := publishEvent(client, e); err != nil {
+			logger.Warn("Skipping invalid event in backlog", "path", path, "line", line, "err", err)
+			continue
+		}
+		imported++
+	}
+	return imported, scanner.Err()
+}
+
+// parseEventLine decodes an event document, the time is mandatory as it is the whole point of importing a backlog
+func parseEventLine(line []byte) (Event, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(line, &doc); err != nil {
+		return Event{}, err
+	}
+	e := Event{Fragments: map[string]any{}}
+	var ok bool
+	if e.Type, ok = doc["type"].(string); !ok {
+		return Event{}, fmt.Errorf("missing type")
+	}
+	if e.Text, ok = doc["text"].(string); !ok {
+		return Event{}, fmt.Errorf("missing text")
+	}
+	timeText, ok := doc["time"].(string)
+	if !ok {
+		return Event{}, fmt.Errorf("missing time")
+	}
+	t, err := time.Parse(time.RFC3339Nano, timeText)
+	if err != nil {
+		return Event{}, fmt.Errorf("invalid time: %w", err)
+	}
+	e.Time = t
+	for name, value := range doc {
+		switch name {
+		case "type", "text", "time", "source", "id":
+		default:
+			e.Fragments[name] = value
+		}
+	}
+	return e, nil
+}
+
+// importEventBacklog imports the backlog file once, it is renamed afterwards so a restart doesn't import it again
+func importEventBacklog(ctx context.Context, client mqtt.Client, cfg Config) {
+	if _, err := os.Stat(cfg.EventBacklog); os.IsNotExist(err) {
+		return
+	}
+	imported, err := importEvents(ctx, client, cfg.EventBacklog, cfg.EventImportRate, cfg.EventMaxAge)
+	if err != nil {
+		logger.Error("Failed to import event backlog", "path", cfg.EventBacklog, "imported", imported, "err", err)
+		return
+	}
+	logger.Info("Imported event backlog", "path", cfg.EventBacklog, "imported", imported)
+	if err := os.Rename(cfg.EventBacklog, cfg.EventBacklog+".imported"); err != nil {
+		logger.Error("Failed to rename imported event backlog", "path", cfg.EventBacklog, "err", err)
+	}
+}
+
+// handleErrorMessage logs errors the platform reports on s/e, e.g. for rejected events
+// sample message: 50,event/events/create,"Time is too far in the past"
+func handleErrorMessage(client mqtt.Client, msg mqtt.Message) {
+	logger.Warn("Platform rejected a message", "topic", msg.Topic(), "msg", string(msg.Payload()))
+	rejections.Observe(msg.Payload())
+	if isThrottlingError(string(msg.Payload())) {
+		publishLimiter.Throttled("s/e")
+	}
+}
+
+// sjsonKey escapes characters sjson would interpret as path syntax, so fragment names are used as they are
+func sjsonKey(name string) string {
+	var escaped []byte
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '.', '*', '?', '|', '#', '@', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, name[i])
+	}
+	return string(escaped)
+}
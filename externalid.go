@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"unicode"
+)
+
+// ExternalID identifies an event or alarm in an external system (ticketing, ERP, ...), so both sides can be joined on it
+// the identity API only covers managed objects, so it is attached as c8y_ExternalId fragment: {"type": ..., "externalId": ...}
+// and can be searched for with the fragment query of the event/alarm API
+type ExternalID struct {
+	// the system the id comes from, e.g. "servicenow_incident"
+	Type  string
+	Value string
+}
+
+// externalIDType is what the platform accepts as external id type in the identity API, used for the fragment alike
+var externalIDType = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,64}$`)
+
+const maxExternalIDLength = 256
+
+func (id ExternalID) validate() error {
+	if !externalIDType.MatchString(id.Type) {
+		return fmt.Errorf("external id type %q must be 1-64 letters, digits, '_', '.' or '-'", id.Type)
+	}
+	if id.Value == "" || len(id.Value) > maxExternalIDLength {
+		return fmt.Errorf("external id must have 1-%d bytes, got %d", maxExternalIDLength, len(id.Value))
+	}
+	for _, r := range id.Value {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("external id %q contains non-printable characters", id.Value)
+		}
+	}
+	return nil
+}
+
+func (id ExternalID) fragment() map[string]any {
+	return map[string]any{"type": id.Type, "externalId": id.Value}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// roles of the sources of a FailoverSource
+const (
+	sourcePrimary   = "primary"
+	sourceSecondary = "secondary"
+)
+
+// FailoverSource reads a primary source and fails over to a secondary one (e.g. a redundant sensor) when it fails
+// while on the secondary, the primary is checked on every read and taken back once it succeeded recoverAfter times
+// in a row, so a flapping primary doesn't make the readings jump between sensors. Switches are reported as
+// c8y_SourceFailover event and in the c8y_ActiveSource_<name> fragment, if both sources fail Read returns the errors
+// of both and the SourcePoller raises its sensor fault alarm
+type FailoverSource struct {
+	name         string
+	primary      MeasurementSource
+	secondary    MeasurementSource
+	recoverAfter int
+	client       mqtt.Client
+	serial       string
+
+	mu        sync.Mutex
+	active    string
+	recovered int
+	reported  bool
+}
+
+func NewFailoverSource(name string, primary MeasurementSource, secondary MeasurementSource, recoverAfter int, client mqtt.Client, serial string) *FailoverSource {
+	return &FailoverSource{
+		name:         name,
+		primary:      primary,
+		secondary:    secondary,
+		recoverAfter: recoverAfter,
+		client:       client,
+		serial:       serial,
+		active:       sourcePrimary,
+	}
+}
+
+func (f *FailoverSource) Name() string {
+	return f.name
+}
+
+// Active is the role of the source readings are taken from
+func (f *FailoverSource) Active() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+func (f *FailoverSource) Read(ctx context.Context) ([]SensorReading, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.reported {
+		f.reported = f.report(nil) == nil
+	}
+	if f.active == sourcePrimary {
+		readings, err := f.primary.Read(ctx)
+		if err == nil {
+			return readings, nil
+		}
+		readings, secondaryErr := f.secondary.Read(ctx)
+		if secondaryErr != nil {
+			return nil, f.bothFailed(err, secondaryErr)
+		}
+		f.switchTo(sourceSecondary, err)
+		return readings, nil
+	}
+
+	readings, err := f.secondary.Read(ctx)
+	// the read of the primary is its health check
+	primaryReadings, primaryErr := f.primary.Read(ctx)
+	if primaryErr != nil {
+		if f.recovered > 0 {
+			logger.Info("Primary source failed again, staying on the secondary", "source", f.name, "err", primaryErr)
+		}
+		f.recovered = 0
+		if err != nil {
+			return nil, f.bothFailed(primaryErr, err)
+		}
+		return readings, nil
+	}
+	f.recovered++
+	// the secondary failing as well leaves no choice
+	if err != nil || f.recovered >= f.recoverAfter {
+		f.switchTo(sourcePrimary, err)
+		return primaryReadings, nil
+	}
+	logger.Debug("Primary source recovering", "source", f.name, "successes", f.recovered, "needed", f.recoverAfter)
+	return readings, nil
+}
+
+func (f *FailoverSource) bothFailed(primaryErr error, secondaryErr error) error {
+	return errors.Join(fmt.Errorf("%s source: %w", sourcePrimary, primaryErr), fmt.Errorf("%s source: %w", sourceSecondary, secondaryErr))
+}
+
+// switchTo makes the source of role the active one, reason is the error of the source given up (nil on recovery)
+// called with mu held
+func (f *FailoverSource) switchTo(role string, reason error) {
+	from := f.active
+	f.active, f.recovered = role, 0
+	text := fmt.Sprintf("%s switched from the %s to the %s source", f.name, from, role)
+	if reason != nil {
+		text += ": " + reason.Error()
+	}
+	logger.Warn("Measurement source failover", "source", f.name, "from", from, "to", role, "reason", reason)
+	err := publishEvent(f.client, Event{
+		Type:      "c8y_SourceFailover",
+		Text:      text,
+		Fragments: map[string]any{"c8y_SourceFailover": map[string]any{"source": f.name, "from": from, "to": role}},
+	})
+	if err != nil {
+		logger.Warn("Failed to report source failover", "source", f.name, "err", err)
+	}
+	f.reported = f.report(reason) == nil
+}
+
+// report updates the c8y_ActiveSource_<name> fragment of the device twin, called with mu held
+func (f *FailoverSource) report(reason error) error {
+	state := map[string]any{"active": f.active, "since": formatTimestamp(time.Now())}
+	if reason != nil {
+		state["reason"] = reason.Error()
+	}
+	doc, err := json.Marshal(map[string]any{"c8y_ActiveSource_" + f.name: state})
+	if err != nil {
+		return err
+	}
+	return publishJsonViaMqttMessage(f.client, "inventory/managedObjects/update/"+f.serial, string(doc))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// failureCode identifies why an operation failed. It prefixes the reason of the 502 message, so the failures of a
+// fleet can be searched and alerted on regardless of the (possibly translated) message following it
+type failureCode string
+
+const (
+	failInvalidOperation failureCode = "C8Y-OP-INVALID"
+	failRejected         failureCode = "C8Y-OP-REJECTED"
+	failNotReady         failureCode = "C8Y-DEVICE-STARTING"
+	failRestart          failureCode = "C8Y-RESTART-FAILED"
+	failCommand          failureCode = "C8Y-CMD-FAILED"
+	failFirmwareDownload failureCode = "C8Y-FW-DOWNLOAD-FAILED"
+	failRelay            failureCode = "C8Y-RELAY-FAILED"
+	failLogRetrieval     failureCode = "C8Y-LOG-RETRIEVAL-FAILED"
+	failSoftwareUpdate   failureCode = "C8Y-SW-UPDATE-FAILED"
+	failRemoteAccess     failureCode = "C8Y-REMOTE-ACCESS-FAILED"
+	failMessage          failureCode = "C8Y-MESSAGE-FAILED"
+	failRepublish        failureCode = "C8Y-REPUBLISH-FAILED"
+	failHandlerCrashed   failureCode = "C8Y-HANDLER-CRASHED"
+)
+
+// defaultFailureMessages are the messages of the failure codes, {name} is replaced with the parameter of that name
+var defaultFailureMessages = map[failureCode]string{
+	failInvalidOperation: "Invalid operation: {err}",
+	failRejected:         "Operation not accepted: {err}",
+	failNotReady:         "Device is still starting",
+	failRestart:          "Restart failed: {err}",
+	failCommand:          "Command failed: {err}\n{output}",
+	failFirmwareDownload: "Downloading firmware {name} {version} failed: {err}",
+	failRelay:            "Switching relays failed: {err}",
+	failLogRetrieval:     "Retrieving log file {logfile} failed: {err}",
+	failSoftwareUpdate:   "Updating software failed: {err}",
+	failRemoteAccess:     "Connecting to {host}:{port} failed: {err}",
+	failMessage:          "Showing the message failed: {err}",
+	failRepublish:        "Re-publishing the device properties failed: {err}",
+	failHandlerCrashed:   "The device failed to handle the operation: {err}",
+}
+
+// failureMessages are the messages in use, the defaults with the translations of C8Y_FAILURE_MESSAGES applied
+var failureMessages = defaultFailureMessages
+
+// loadFailureMessages reads translations of the failure messages, keyed by code. Codes without entry keep the default
+//
+//	C8Y-FW-DOWNLOAD-FAILED: "Download der Firmware {name} {version} fehlgeschlagen: {err}"
+func loadFailureMessages(path string) (map[failureCode]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var translations map[failureCode]string
+	if err := yaml.Unmarshal(data, &translations); err != nil {
+		return nil, fmt.Errorf("invalid failure messages %s: %w", path, err)
+	}
+	messages := maps.Clone(defaultFailureMessages)
+	for code, message := range translations {
+		if _, ok := defaultFailureMessages[code]; !ok {
+			known := slices.Sorted(maps.Keys(defaultFailureMessages))
+			return nil, fmt.Errorf("unknown failure code %q in %s, expected one of %v", code, path, known)
+		}
+		messages[code] = message
+	}
+	return messages, nil
+}
+
+// failure renders the reason of a failed operation, "<code>: <message>" with the parameters given as name/value pairs
+//
+//	failure(failFirmwareDownload, "name", "myFirmware", "version", "1.0", "err", err)
+func failure(code failureCode, params ...any) string {
+	message, ok := failureMessages[code]
+	if !ok {
+		message = defaultFailureMessages[code]
+	}
+	replacements := make([]string, 0, len(params))
+	for i := 0; i+1 < len(params); i += 2 {
+		replacements = append(replacements, "{"+fmt.Sprint(params[i])+"}", fmt.Sprint(params[i+1]))
+	}
+	message = strings.NewReplacer(replacements...).Replace(message)
+	return string(code) + ": " + strings.TrimRight(message, "\n")
+}
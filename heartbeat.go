@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Heartbeat publishes a liveness measurement (value 1) at a fixed interval, for monitoring that watches a dedicated
+// signal instead of the required interval. It is independent of the data measurements: it keeps going while telemetry
+// is paused, outside the active hours or while the data sources are idle. It has a lifecycle of its own instead of
+// running under the supervisor, so it is the last thing to stop on shutdown
+type Heartbeat struct {
+	client   mqtt.Client
+	fragment string
+	series   string
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewHeartbeat(client mqtt.Client, fragment string, series string, interval time.Duration) *Heartbeat {
+	return &Heartbeat{client: client, fragment: fragment, series: series, interval: interval}
+}
+
+// Start publishes the first heartbeat right away and then every interval until Stop
+func (h *Heartbeat) Start() {
+	h.stop, h.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			h.beat()
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the heartbeat and waits until a publish in progress is done, a nil or unstarted heartbeat does nothing
+func (h *Heartbeat) Stop() {
+	if h == nil || h.stop == nil {
+		return
+	}
+	close(h.stop)
+	<-h.done
+}
+
+// beat skips the heartbeat while disconnected, a late one would claim liveness for a time the device wasn't reachable
+func (h *Heartbeat) beat() {
+	if !h.client.IsConnected() {
+		return
+	}
+	// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#200
+	publishSmartRestMessage(h.client, buildSmartRest("200", h.fragment, h.series, "1"))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// time the platform gets to report rejected lines on s/e after the last chunk of a history upload
+const historySettleTime = 5 * time.Second
+
+// rejections counts the errors the platform reports on s/e by the template or topic they refer to
+var rejections = &rejectionCounter{counts: map[string]int{}}
+
+type rejectionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// Observe counts an s/e message, e.g. 41,200,"Invalid measurement" refers to template 200
+func (c *rejectionCounter) Observe(payload []byte) {
+	records, err := parseSmartRest(payload)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, record := range records {
+		if len(record) > 1 {
+			c.counts[record[1]]++
+		}
+	}
+}
+
+func (c *rejectionCounter) Count(ref string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[ref]
+}
+
+// HistoryResult is the outcome of a history upload
+type HistoryResult struct {
+	// measurements sent, including the rejected ones
+	Sent int
+	// measurements the platform rejected or that failed to send
+	Rejected int
+	// lines of the file that aren't valid measurements
+	Skipped int
+}
+
+// UploadHistory sends the measurements of a JSONL file with their original timestamps, e.g. buffered during an outage
+// each line is a measurement document, e.g. {"time":"2024-03-01T10:00:00.000Z","c8y_Temperature":{"T":{"value":21.5,"unit":"C"}}}
+// Instead of one message per measurement they go as multi-line SmartREST 200/201 payloads up to the MQTT payload limit,
+// or via the REST bulk endpoint in chunks of C8Y_REST_CHUNK_SIZE with C8Y_MEASUREMENT_TRANSPORT=rest.
+// SmartREST lines the platform rejects are only reported on s/e, they are counted for a few seconds after the upload.
+// That count includes rejections of other measurements published meanwhile, it is an upper bound
+func (p *MeasurementPublisher) UploadHistory(ctx context.Context, path string) (HistoryResult, error) {
+	var result HistoryResult
+	f, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+
+	p.mu.RLock()
+	transport, maxMqttPayload, restChunkSize := p.transport, p.maxMqttPayload, p.restChunkSize
+	p.mu.RUnlock()
+	useRest := transport == transportREST
+	rejectedBefore := rejections.Count(measurementTemplate200.ID) + rejections.Count(measurementTemplate201.ID)
+
+	var chunk []Measurement
+	var lines []string
+	size := 0
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		var err error
+		if useRest {
+			err = p.uploadHistoryREST(ctx, chunk)
+		} else {
+			err = publishMqttMessage(p.client, measurementTemplate200.Topic, strings.Join(lines, "\n"))
+		}
+		result.Sent += len(chunk)
+		if err != nil {
+			logger.Warn("Failed to upload historical measurements", "count", len(chunk), "err", err)
+			result.Rejected += len(chunk)
+		}
+		chunk, lines, size = chunk[:0], lines[:0], 0
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		parsed, err := parseMeasurementLine(scanner.Bytes())
+		if err != nil {
+			logger.Warn("Skipping invalid measurement in history", "path", path, "line", lineNo, "err", err)
+			result.Skipped++
+			continue
+		}
+		for _, m := range parsed {
+			// 200 can't carry the type
+			template := measurementTemplate200
+			if m.Type != "" {
+				template = measurementTemplate201
+			}
+			line, err := template.render(m)
+			if err != nil {
+				logger.Warn("Skipping invalid measurement in history", "path", path, "line", lineNo, "err", err)
+				result.Skipped++
+				continue
+			}
+			if (useRest && len(chunk) >= restChunkSize) || (!useRest && size+len(line)+1 > maxMqttPayload) {
+				flush()
+			}
+			chunk = append(chunk, m)
+			lines = append(lines, line)
+			size += len(line) + 1
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+	if !useRest && result.Sent > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(historySettleTime):
+		}
+		result.Rejected += rejections.Count(measurementTemplate200.ID) + rejections.Count(measurementTemplate201.ID) - rejectedBefore
+	}
+	return result, nil
+}
+
+func (p *MeasurementPublisher) uploadHistoryREST(ctx context.Context, measurements []Measurement) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	deviceID, err := p.rest.DeviceID(ctx)
+	if err != nil {
+		return err
+	}
+	return p.rest.CreateMeasurements(ctx, deviceID, measurements, len(measurements))
+}
+
+// parseMeasurementLine decodes a measurement document into one Measurement per series
+// the time is mandatory, a history without it would end up at the time of the upload
+func parseMeasurementLine(line []byte) ([]Measurement, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(line, &doc); err != nil {
+		return nil, err
+	}
+	var timeText, measurementType string
+	if err := json.Unmarshal(doc["time"], &timeText); err != nil || timeText == "" {
+		return nil, fmt.Errorf("missing time")
+	}
+	t, err := time.Parse(time.RFC3339Nano, timeText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time: %w", err)
+	}
+	if raw, ok := doc["type"]; ok {
+		if err := json.Unmarshal(raw, &measurementType); err != nil {
+			return nil, fmt.Errorf("invalid type: %w", err)
+		}
+	}
+	var measurements []Measurement
+	for fragment, raw := range doc {
+		switch fragment {
+		case "time", "type", "source", "id", "self":
+			continue
+		}
+		var series map[string]MeasurementValue
+		if err := json.Unmarshal(raw, &series); err != nil {
+			return nil, fmt.Errorf("fragment %s must map series to {value, unit}: %w", fragment, err)
+		}
+		for name, v := range series {
+			measurements = append(measurements, Measurement{Fragment: fragment, Series: name, Value: v.Value, Unit: v.Unit, Time: t, Type: measurementType})
+		}
+	}
+	if len(measurements) == 0 {
+		return nil, fmt.Errorf("measurement has no series")
+	}
+	return measurements, nil
+}
+
+// importMeasurementBacklog uploads the backlog file once, it is renamed afterwards so a restart doesn't upload it again
+func importMeasurementBacklog(ctx context.Context, measurements *MeasurementPublisher, path string) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return
+	}
+	result, err := measurements.UploadHistory(ctx, path)
+	if err != nil {
+		logger.Error("Failed to upload measurement backlog", "path", path, "sent", result.Sent, "err", err)
+		return
+	}
+	logger.Info("Uploaded measurement backlog", "path", path, "sent", result.Sent,
+		"accepted", result.Sent-result.Rejected, "rejected", result.Rejected, "skipped", result.Skipped)
+	if err := os.Rename(path, path+".imported"); err != nil {
+		logger.Error("Failed to rename uploaded measurement backlog", "path", path, "err", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tidwall/sjson"
+)
+
+// FragmentUpdate computes the new value of an inventory fragment from its current value (JSON, "null" if not set)
+type FragmentUpdate func(current string) (string, error)
+
+// MergePatch merges patch into the fragment as JSON merge patch (RFC 7386): objects are merged key by key,
+// null removes a key, everything else (including arrays) replaces the current value
+func MergePatch(patch string) FragmentUpdate {
+	return func(current string) (string, error) {
+		var target, p any
+		if err := json.Unmarshal([]byte(current), &target); err != nil {
+			return "", fmt.Errorf("invalid current value: %w", err)
+		}
+		if err := json.Unmarshal([]byte(patch), &p); err != nil {
+			return "", fmt.Errorf("invalid patch: %w", err)
+		}
+		merged, err := json.Marshal(mergePatch(target, p))
+		return string(merged), err
+	}
+}
+
+func mergePatch(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// SetPath sets a single value inside the fragment, path uses sjson syntax (e.g. "config.interval")
+func SetPath(path string, value any) FragmentUpdate {
+	return func(current string) (string, error) {
+		if current == "null" {
+			current = "{}"
+		}
+		return sjson.Set(current, path, value)
+	}
+}
+
+// AppendTo appends value to the array at path inside the fragment, the array is created if missing
+func AppendTo(path string, value any) FragmentUpdate {
+	return SetPath(path+".-1", value)
+}
+
+// ManagedObjectFragment returns the fragment of the managed object as JSON, "null" if it isn't set
+func (r *RestClient) ManagedObjectFragment(ctx context.Context, id string, fragment string) (string, error) {
+	var mo map[string]json.RawMessage
+	if err := r.do(ctx, http.MethodGet, "/inventory/managedObjects/"+url.PathEscape(id), "", nil, &mo); err != nil {
+		return "", fmt.Errorf("reading managed object %s: %w", id, err)
+	}
+	value, ok := mo[fragment]
+	if !ok {
+		return "null", nil
+	}
+	return string(value), nil
+}
+
+// number of read-modify-write rounds UpdateFragment tries before giving up
+const fragmentUpdateAttempts = 3
+
+// UpdateFragment changes a fragment of the device twin without clobbering keys of the fragment it doesn't touch
+// the inventory API replaces fragments as a whole, so the fragment is read via REST, updated and published again
+// there is no locking: a concurrent writer between read and write loses (last writer wins). To notice that, the
+// fragment is read back after the update and the update is applied again on the new value if it didn't stick
+func UpdateFragment(ctx context.Context, client mqtt.Client, rest *RestClient, serial string, fragment string, update FragmentUpdate) error {
+	id, err := rest.DeviceID(ctx)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; attempt <= fragmentUpdateAttempts; attempt++ {
+		current, err := rest.ManagedObjectFragment(ctx, id, fragment)
+		if err != nil {
+			return err
+		}
+		updated, err := update(current)
+		if err != nil {
+			return fmt.Errorf("updating fragment %s: %w", fragment, err)
+		}
+		doc, err := sjson.SetRaw("{}", sjsonKey(fragment), updated)
+		if err != nil {
+			return err
+		}
+		if err := publishJsonViaMqttMessage(client, "inventory/managedObjects/update/"+serial, doc); err != nil {
+			return err
+		}
+
+		// MQTT messages are processed asynchronously, give the platform a moment before checking the result
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+		stored, err := rest.ManagedObjectFragment(ctx, id, fragment)
+		if err != nil {
+			return err
+		}
+		if jsonEqual(stored, updated) {
+			return nil
+		}
+		logger.Warn("Fragment was changed concurrently, applying the update again", "fragment", fragment, "attempt", attempt)
+	}
+	return fmt.Errorf("fragment %s kept changing concurrently, gave up after %d attempts", fragment, fragmentUpdateAttempts)
+}
+
+// jsonEqual compares two JSON documents ignoring formatting and key order
+func jsonEqual(a string, b string) bool {
+	var va, vb any
+	if json.Unmarshal([]byte(a), &va) != nil || json.Unmarshal([]byte(b), &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
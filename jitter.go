@@ -0,0 +1,47 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Jitter spreads periodic publishing of a fleet over time
+// Without it, devices that were powered on together (e.g. after a power outage) publish in lockstep forever
+// The random source is seeded from the serial, so a device keeps its phase across restarts while its neighbours use a different one
+type Jitter struct {
+	fraction float64
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewJitter returns a jitter varying intervals by up to fraction of their length, 0 disables jitter
+func NewJitter(serial string, fraction float64) *Jitter {
+	h := fnv.New64a()
+	h.Write([]byte(serial))
+	seed := h.Sum64()
+	return &Jitter{fraction: fraction, rnd: rand.New(rand.NewPCG(seed, seed>>1))}
+}
+
+// Phase is the delay before the first cycle of a loop with the given interval, somewhere in [0, interval*fraction)
+func (j *Jitter) Phase(interval time.Duration) time.Duration {
+	if j.fraction == 0 {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return time.Duration(j.rnd.Float64() * j.fraction * float64(interval))
+}
+
+// Apply returns the interval randomly stretched or shortened by up to fraction of its length
+func (j *Jitter) Apply(interval time.Duration) time.Duration {
+	if j.fraction == 0 {
+		return interval
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	offset := (j.rnd.Float64()*2 - 1) * j.fraction * float64(interval)
+	return interval + time.Duration(offset)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// strict validation of JSON-over-MQTT payloads, see C8Y_JSON_STRICT
+var strictJSON bool
+
+// requiredJSONFields lists the fields the platform requires for the documents created via JSON-over-MQTT, by topic prefix
+// see: https://cumulocity.com/docs/device-integration/mqtt/#json-via-mqtt
+var requiredJSONFields = map[string][]string{
+	"event/events/create":             {"type", "text", "time"},
+	"alarm/alarms/create":             {"type", "text", "severity"},
+	"measurement/measurements/create": {"type"},
+}
+
+// validateJSONPayload rejects payloads the platform would reject as well, which otherwise only shows up on s/e
+// the payload must always be a JSON object, with strict validation the required fields of known documents must be set
+func validateJSONPayload(topic string, payload string, strict bool) error {
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+		return fmt.Errorf("payload for %s is no valid JSON object: %w", topic, err)
+	}
+	if !strict {
+		return nil
+	}
+	for prefix, fields := range requiredJSONFields {
+		if topic != prefix && !strings.HasPrefix(topic, prefix+"/") {
+			continue
+		}
+		for _, field := range fields {
+			if v, ok := doc[field]; !ok || v == nil || v == "" {
+				return fmt.Errorf("payload for %s is missing %q", topic, field)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lineProtocolMapping decides which measurement a line protocol field becomes
+// by default the measurement name is the fragment and the field key the series, e.g.
+// "cpu,host=a usage_idle=97.5" becomes fragment cpu, series usage_idle
+type lineProtocolMapping struct {
+	// tag whose value is used as fragment instead of the measurement name, empty uses the measurement name
+	FragmentTag string
+	// tag carrying the unit of the fields, empty sends them without unit
+	UnitTag string
+}
+
+// lineProtocolIngest receives InfluxDB line protocol on a local UDP address and publishes the numeric fields as
+// measurements, until ctx is done. Every packet is published as one batch, malformed lines are logged and skipped
+func lineProtocolIngest(ctx context.Context, addr string, measurements *MeasurementPublisher, mapping lineProtocolMapping) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for line protocol: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	logger.Info("Receiving line protocol", "addr", conn.LocalAddr())
+
+	// the max size of a UDP datagram
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			logger.Warn("Failed to receive line protocol", "err", err)
+			continue
+		}
+		var batch []Measurement
+		for i, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parsed, err := parseLineProtocol(line, mapping)
+			if err != nil {
+				logger.Warn("Skipping malformed line protocol", "from", from, "line", i+1, "err", err)
+				continue
+			}
+			batch = append(batch, parsed...)
+		}
+		measurements.Publish(batch)
+	}
+}
+
+// parseLineProtocol parses "measurement[,tag=value...] field=value[,field=value...] [timestamp]"
+// the timestamp is in nanoseconds, string fields are skipped as they aren't measurements
+func parseLineProtocol(line string, mapping lineProtocolMapping) ([]Measurement, error) {
+	parts := splitUnescaped(line, ' ')
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("expected measurement, fields and optional timestamp, got %d parts", len(parts))
+	}
+	series := splitUnescaped(parts[0], ',')
+	fragment := unescapeLineProtocol(series[0])
+	if fragment == "" {
+		return nil, fmt.Errorf("missing measurement name")
+	}
+	unit := ""
+	for _, tag := range series[1:] {
+		key, value, ok := cutUnescaped(tag, '=')
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		switch unescapeLineProtocol(key) {
+		case mapping.FragmentTag:
+			fragment = unescapeLineProtocol(value)
+		case mapping.UnitTag:
+			unit = unescapeLineProtocol(value)
+		}
+	}
+	var t time.Time
+	if len(parts) == 3 {
+		ns, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", parts[2])
+		}
+		t = time.Unix(0, ns)
+	}
+
+	var measurements []Measurement
+	for _, field := range splitUnescaped(parts[1], ',') {
+		key, raw, ok := cutUnescaped(field, '=')
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		value, numeric, err := lineProtocolValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", key, err)
+		}
+		if !numeric {
+			continue
+		}
+		measurements = append(measurements, Measurement{Fragment: fragment, Series: unescapeLineProtocol(key), Value: value, Unit: unit, Time: t})
+	}
+	if len(measurements) == 0 {
+		return nil, fmt.Errorf("no numeric field")
+	}
+	return measurements, nil
+}
+
+// lineProtocolValue parses a field value: floats, integers (1i), unsigned integers (1u), booleans (as 1/0) and strings
+// numeric is false for strings
+func lineProtocolValue(raw string) (value float64, numeric bool, err error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return 0, false, fmt.Errorf("unterminated string %s", raw)
+		}
+		return 0, false, nil
+	case strings.HasSuffix(raw, "i"):
+		i, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid integer %q", raw)
+		}
+		return float64(i), true, nil
+	case strings.HasSuffix(raw, "u"):
+		u, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		return float64(u), true, nil
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid number %q", raw)
+	}
+	return f, true, nil
+}
+
+// splitUnescaped splits s at sep, except where sep is escaped with a backslash or within a quoted string
+func splitUnescaped(s string, sep byte) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// cutUnescaped cuts s around the first sep that isn't escaped
+func cutUnescaped(s string, sep byte) (before string, after string, found bool) {
+	parts := splitUnescaped(s, sep)
+	if len(parts) == 1 {
+		return s, "", false
+	}
+	return parts[0], s[len(parts[0])+1:], true
+}
+
+// unescapeLineProtocol removes the backslashes escaping commas, spaces and equal signs in names, tags and field keys
+func unescapeLineProtocol(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=").Replace(s)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tidwall/sjson"
+)
+
+// kind of GPS fix, a 2D fix has no usable altitude
+const (
+	FixNone = 0
+	Fix2D   = 2
+	Fix3D   = 3
+)
+
+// Position is a location as reported by a GPS receiver or configured for stationary devices
+type Position struct {
+	Lat float64
+	Lng float64
+	// only used for 3D fixes
+	Alt float64
+	Fix int
+	// radius of the uncertainty circle in meters, 0 if unknown
+	Accuracy float64
+}
+
+// LocationSource provides the current position of the device
+type LocationSource interface {
+	Position() (Position, error)
+}
+
+// staticLocation is the position of a device that doesn't move, this is what the demo device uses
+type staticLocation Position
+
+func (s staticLocation) Position() (Position, error) {
+	return Position(s), nil
+}
+
+func (p Position) validate() error {
+	if p.Fix == FixNone {
+		return fmt.Errorf("no fix")
+	}
+	if p.Lat < -90 || p.Lat > 90 {
+		return fmt.Errorf("latitude %f out of range [-90,90]", p.Lat)
+	}
+	if p.Lng < -180 || p.Lng > 180 {
+		return fmt.Errorf("longitude %f out of range [-180,180]", p.Lng)
+	}
+	if p.Accuracy < 0 {
+		return fmt.Errorf("negative accuracy %f", p.Accuracy)
+	}
+	return nil
+}
+
+// publishPosition updates the position of the device twin
+// without accuracy the 112 template is enough, with accuracy the whole c8y_Position fragment is sent via JSON
+// so the UI can draw the uncertainty circle around the position
+func publishPosition(client mqtt.Client, deviceSerial string, source LocationSource) error {
+	pos, err := source.Position()
+	if err != nil {
+		logger.Warn("Failed to read position", "err", err)
+		return nil
+	}
+	if err := pos.validate(); err != nil {
+		logger.Debug("Skipping invalid position", "position", pos, "err", err)
+		return nil
+	}
+
+	if pos.Accuracy == 0 {
+		// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#112
+		fields := []string{formatCoordinate(pos.Lat), formatCoordinate(pos.Lng)}
+		if pos.Fix == Fix3D {
+			fields = append(fields, formatCoordinate(pos.Alt))
+		}
+		return publishSmartRestMessage(client, buildSmartRest("112", fields...))
+	}
+
+	json := "{}"
+	json, _ = sjson.Set(json, "c8y_Position.lat", pos.Lat)
+	json, _ = sjson.Set(json, "c8y_Position.lng", pos.Lng)
+	if pos.Fix == Fix3D {
+		json, _ = sjson.Set(json, "c8y_Position.alt", pos.Alt)
+	}
+	json, _ = sjson.Set(json, "c8y_Position.accuracy", pos.Accuracy)
+	return publishJsonViaMqttMessage(client, "inventory/managedObjects/update/"+deviceSerial, json)
+}
+
+// PositionTracker remembers the last valid position of the source, so readings can be tagged with where they were taken
+// if the source fails (e.g. GPS lost its fix in a tunnel), the last position is used until it is older than maxAge
+type PositionTracker struct {
+	source LocationSource
+	maxAge time.Duration
+
+	mu   sync.Mutex
+	last Position
+	at   time.Time
+}
+
+func NewPositionTracker(source LocationSource, maxAge time.Duration) *PositionTracker {
+	return &PositionTracker{source: source, maxAge: maxAge}
+}
+
+// Current returns the current position, false if there is none or it is stale. A nil tracker has no position
+func (t *PositionTracker) Current() (Position, bool) {
+	if t == nil {
+		return Position{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if pos, err := t.source.Position(); err == nil && pos.validate() == nil {
+		t.last, t.at = pos, time.Now()
+	}
+	if t.at.IsZero() || time.Since(t.at) > t.maxAge {
+		return Position{}, false
+	}
+	return t.last, true
+}
+
+// fragment renders the position as c8y_Position fragment
+func (p Position) fragment() map[string]any {
+	f := map[string]any{"lat": p.Lat, "lng": p.Lng}
+	if p.Fix == Fix3D {
+		f["alt"] = p.Alt
+	}
+	if p.Accuracy > 0 {
+		f["accuracy"] = p.Accuracy
+	}
+	return f
+}
+
+func formatCoordinate(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// LogSource is where the content of a log file type (118) comes from, either a file or the output of a command
+type LogSource struct {
+	Path    string
+	Command []string
+}
+
+func (s LogSource) String() string {
+	if s.Path != "" {
+		return s.Path
+	}
+	return "cmd:" + strings.Join(s.Command, " ")
+}
+
+// read returns the content of the file or the output of the command
+func (s LogSource) read(ctx context.Context) ([]byte, error) {
+	if s.Path != "" {
+		return os.ReadFile(s.Path)
+	}
+	output, err := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w", s, err)
+	}
+	return output, nil
+}
+
+// check returns an error if the file can't be read or the command can't be found
+func (s LogSource) check() error {
+	if s.Path != "" {
+		f, err := os.Open(s.Path)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	_, err := exec.LookPath(s.Command[0])
+	return err
+}
+
+// parseLogSources parses "type=/path/to/file" and "type=cmd:command args" entries of C8Y_LOG_SOURCES
+func parseLogSources(specs []string) (map[string]LogSource, error) {
+	sources := map[string]LogSource{}
+	for _, spec := range specs {
+		logType, source, found := strings.Cut(spec, "=")
+		logType, source = strings.TrimSpace(logType), strings.TrimSpace(source)
+		if !found || logType == "" || source == "" {
+			return nil, fmt.Errorf("%q must be type=path or type=cmd:command", spec)
+		}
+		if command, ok := strings.CutPrefix(source, "cmd:"); ok {
+			fields := strings.Fields(command)
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("%q has an empty command", spec)
+			}
+			sources[logType] = LogSource{Command: fields}
+		} else {
+			sources[logType] = LogSource{Path: source}
+		}
+	}
+	return sources, nil
+}
+
+// checkLogSources warns about declared log file types that can't be retrieved, they fail when requested
+func checkLogSources(types []string, sources map[string]LogSource) {
+	for _, logType := range types {
+		source, ok := sources[logType]
+		if !ok {
+			logger.Warn("No source configured for log file type, add it to C8Y_LOG_SOURCES", "type", logType)
+			continue
+		}
+		if err := source.check(); err != nil {
+			logger.Warn("Source of log file type isn't available", "type", logType, "source", source, "err", err)
+		}
+	}
+}
+
+// LogRetriever answers log file requests (522) with the content of the configured sources, uploaded as event binary
+type LogRetriever struct {
+	sources map[string]LogSource
+	rest    *RestClient
+}
+
+func NewLogRetriever(sources map[string]LogSource, rest *RestClient) *LogRetriever {
+	return &LogRetriever{sources: sources, rest: rest}
+}
+
+// Retrieve filters the log for the request and uploads it, the returned URL is the result of the operation
+func (l *LogRetriever) Retrieve(ctx context.Context, req logfileRequest) (string, error) {
+	source, ok := l.sources[req.LogFile]
+	if !ok {
+		return "", fmt.Errorf("unknown log file type %q", req.LogFile)
+	}
+	content, err := source.read(ctx)
+	if err != nil {
+		return "", err
+	}
+	filtered, err := filterLogLines(content, req)
+	if err != nil {
+		return "", err
+	}
+	// simulated operations have no REST client, the log file isn't uploaded then
+	if l.rest == nil {
+		return fmt.Sprintf("%d bytes, not uploaded", len(filtered)), nil
+	}
+	deviceID, err := l.rest.DeviceID(ctx)
+	if err != nil {
+		return "", err
+	}
+	return l.rest.UploadEventBinary(ctx, deviceID, "c8y_Logfile", "Log file "+req.LogFile, req.LogFile+".log", filtered)
+}
+
+// layouts of the timestamps in log file requests and at the start of log lines, without an offset they are local time
+var logTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05-0700", time.DateTime}
+
+// filterLogLines keeps the last maxLines lines containing the search text and, if the line starts with a
+// timestamp, lying within the requested date range. Lines without a recognizable timestamp aren't filtered by date
+func filterLogLines(content []byte, req logfileRequest) ([]byte, error) {
+	start, _ := parseLogTime(req.StartDate)
+	end, _ := parseLogTime(req.EndDate)
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if req.SearchText != "" && !strings.Contains(line, req.SearchText) {
+			continue
+		}
+		if at, ok := lineTime(line); ok && (!start.IsZero() && at.Before(start) || !end.IsZero() && at.After(end)) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	// a line over the buffer size stops the scan, uploading the lines before it would look like the whole log
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading log file %s: %w", req.LogFile, err)
+	}
+	if req.MaxLines > 0 && len(lines) > req.MaxLines {
+		lines = lines[len(lines)-req.MaxLines:]
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+func parseLogTime(value string) (time.Time, bool) {
+	for _, layout := range logTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// lineTime parses the timestamp at the start of a log line, either an ISO 8601 first field
+// or "2024-03-01 10:00:00" as written by dpkg
+func lineTime(line string) (time.Time, bool) {
+	if field, _, _ := strings.Cut(line, " "); field != "" {
+		if t, ok := parseLogTime(field); ok {
+			return t, true
+		}
+	}
+	if len(line) >= len(time.DateTime) {
+		if t, err := time.ParseInLocation(time.DateTime, line[:len(time.DateTime)], time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
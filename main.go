@@ -1,152 +1,823 @@
 package main
 
 import (
-	"encoding/csv"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/joho/godotenv"
-	"github.com/tidwall/sjson"
 )
 
-var logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-	Level:     slog.LevelInfo,
-	AddSource: true,
-}))
+// log level can be changed at runtime (see C8Y_LOG_LEVEL and SIGHUP reload)
+var logLevel = new(slog.LevelVar)
+
+// source file and line of log lines can be turned off (C8Y_LOG_SOURCE), see setLogSource
+var logger = newLogger(true)
+
+func newLogger(addSource bool) *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level:     logLevel,
+		AddSource: addSource,
+	}))
+}
+
+// audit trail of received operations, stays nil (and discards records) when no audit log path is configured
+var auditLog *AuditLogger
+
+// executes shell operations (511)
+var shellRunner *ShellRunner
+
+// executes restart operations (510)
+var restarter *Restarter
+
+// answers log file requests (522), nil until the REST client is set up
+var logRetriever *LogRetriever
+
+// reports the first successful start of the device, nil if disabled or already reported
+var provisioning *Provisioning
+
+// tells local software about connection state changes, nil if no webhook is configured
+var connectionWebhook *ConnectionWebhook
+
+// runs the background tasks, they are stopped on shutdown
+var supervisor = NewSupervisor()
+
+// where the device is, a real device would read it from its GPS receiver
+var deviceLocation LocationSource = staticLocation{Lat: 50.323423, Lng: 6.423423, Fix: Fix2D}
+
+// position attached to measurements and events, nil unless C8Y_ATTACH_POSITION is set
+var trackedPosition *PositionTracker
+
+// reports how long the device was offline once it is connected again
+var outages *OutageTracker
+
+// holds back reconnects while the tenant exceeds its quota
+var quotaGuard *QuotaGuard
+
+// notices periodic loops that can't keep up with their interval
+var cycles = NewCycleMonitor(10 * time.Minute)
+
+// tunnels remote access sessions (530) to local endpoints
+var remoteAccess *RemoteAccess
+
+// switches the relays of relay operations (518, 519), replace it with a controller for your hardware
+var relays RelayController = &simulatedRelays{}
+
+// hours measurements and periodic events are published in (C8Y_ACTIVE_HOURS), nil if always
+var activeWindow *ActiveWindow
+
+// checks whether the system clock is synchronized (C8Y_TIME_SYNC_INTERVAL), nil trusts the clock
+var clockMonitor *ClockMonitor
+
+// reads the network configuration published as c8y_Network, nil uses OSNetworkInfo. Replace it with a source for
+// your connection manager
+var networkInfo NetworkInfoSource
+
+// publishes the network configuration on change (C8Y_NETWORK_INFO_INTERVAL), nil if disabled
+var networkMonitor *NetworkMonitor
+
+// re-publishes capabilities and device properties (c8y_RepublishProperties, SIGUSR2), nil until they are published
+var republisher *Republisher
+
+// shows the text of message operations (c8y_Message), replace it with a sink for your display
+var messages MessageSink = logMessageSink{}
+
+// "--profile dev" applies the settings of the profile "dev" from the profiles file, see Profile
+var (
+	profileName  = flag.String("profile", "", "name of the profile (environment) to use from the profiles file")
+	profilesFile = flag.String("profiles-file", "profiles.yaml", "file with the profiles selectable via --profile")
+)
+
+// "--force-properties" publishes all device properties, also those unchanged since the last run
+var forceProperties = flag.Bool("force-properties", false, "re-publish all device properties, even if unchanged since the last run")
+
+// "--device-preset energy-meter" applies the defaults of a common type of device, see DevicePreset
+var devicePresetName = flag.String("device-preset", "", "defaults for a common type of device: energy-meter, temperature-sensor or tracker")
+
+// looks up when received operations were created, nil until the REST client is set up
+var operationTimes *OperationTimes
+
+// software installed on the device, changed by software update operations (528)
+var installedSoftware = &SoftwareInventory{list: SoftwareList{
+	{Name: "software1", Version: "1.0.1", URL: "url1"},
+	{Name: "software2", Version: "1.0.2", URL: "url2"},
+	{Name: "software3", Version: "1.0.3"},
+}}
+
+// alarms raised by this process, cleared on shutdown if C8Y_CLEAR_ALARMS_ON_SHUTDOWN is set
+var raisedAlarms = NewAlarmTracker()
+
+// reports the progress of firmware/software downloads, see reportProgress
+var progress *ProgressReporter
+
+// limits the rate of all MQTT publishes and backs off while the platform is throttling, nil if C8Y_PUBLISH_RATE is 0
+var publishLimiter *AdaptiveLimiter
+
+// holds back repeated events, nil publishes every event
+var eventSuppressor *EventSuppressor
+
+// sends telemetry with QoS 0 while acks time out, nil keeps QoS 1 and waits for acks indefinitely
+var qosPolicy *QoSPolicy
+
+// registers child devices (gateway use case) with their full metadata
+var childDevices *ChildRegistry
 
 var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
 	logger.Info("Connected to MQTT Broker!")
+	connectionWebhook.Notify(stateConnected, nil)
 }
 
 var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
 	logger.Error("Connection lost", slog.Any("error", err))
+	// the broker disconnects devices exceeding the limits of the tenant, the cause isn't visible to the client
+	publishLimiter.Throttled("connection lost")
+	connectionWebhook.Notify(stateDisconnected, err)
+	outages.Lost(err)
 }
 
 func main() {
+	flag.Parse()
 	godotenv.Load()
+	if *profileName != "" {
+		if err := applyProfile(*profilesFile, *profileName); err != nil {
+			logger.Error("Invalid profile", "err", err)
+			os.Exit(1)
+		}
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	failureMessages = cfg.FailureMessages
+	setLogSource(cfg.LogSource)
+	// "./client doctor" checks connectivity step by step instead of running the device
+	// "./client pipe" publishes lines read from stdin
+	// "./client store-credentials" stores USERNAME/PASSWORD in the OS keyring
+	// "./client simulate-op" hands an operation to the operation handlers, see runSimulateOperation
+	// "./client state" prints the state of the running client, see Device.Snapshot
+	switch flag.Arg(0) {
+	case "state":
+		os.Exit(runState(cfg))
+	case "doctor":
+		os.Exit(runDoctor(cfg))
+	case "pipe":
+		os.Exit(runPipe(cfg))
+	case "simulate-op":
+		os.Exit(runSimulateOperation(cfg, flag.Args()[1:]))
+	case "store-credentials":
+		if err := storeCredentials(cfg); err != nil {
+			logger.Error("Failed to store credentials in the keyring", "err", err)
+			os.Exit(1)
+		}
+		logger.Info("Stored credentials in the keyring", "serial", cfg.DeviceSerial)
+		os.Exit(0)
+	}
+	if cfg.AuditLogPath != "" {
+		if auditLog, err = NewAuditLogger(cfg.AuditLogPath, cfg.AuditLogMaxBytes, cfg.AuditLogBackups); err != nil {
+			logger.Error("Failed to open audit log", "err", err)
+			os.Exit(1)
+		}
+		defer auditLog.Close()
+	}
+	setLogLevel(cfg.LogLevel)
+	strictJSON = cfg.JSONStrict
+	timestampLocation = cfg.TimestampLocation
+	if cfg.PublishRate > 0 {
+		publishLimiter = NewAdaptiveLimiter(cfg.PublishRate, cfg.PublishRecovery)
+	}
+	agent.tagVersion(cfg.VersionFragment, cfg.VersionOnEvents)
+	if cfg.EventDedupWindow > 0 {
+		eventSuppressor = NewEventSuppressor(cfg.EventDedupWindow, cfg.EventDedupCount)
+	}
+	if cfg.QoSDowngradeThreshold > 0 {
+		qosPolicy = NewQoSPolicy(cfg.QoSDowngradeThreshold, cfg.AckTimeout)
+	}
+	quotaGuard = NewQuotaGuard(cfg.QuotaBackoff)
+	connectionWebhook = NewConnectionWebhook(cfg.ConnectionWebhook, cfg.ConnectionWebhookTimeout)
+	outages = NewOutageTracker(cfg.OutageStatePath, cfg.OutageAlarms)
+	if cfg.AttachPosition {
+		trackedPosition = NewPositionTracker(deviceLocation, cfg.PositionMaxAge)
+	}
 
-	const brokerURI = "mqtts://mqtt.eu-latest.cumulocity.com:8883"
-	const deviceName = "showcase-device-01"
-	const deviceSerial = "kobu-sn-7123"
+	deviceName := cfg.DeviceName
+	deviceSerial := cfg.DeviceSerial
+
+	// Ok now let's take care of listening to Cloud Operations, this is done by subscribing to "s/ds" topic
+	// operations are handed over to the serializer, which runs them in background so e.g. a log file request
+	// doesn't have to wait for a running firmware update, while a restart does
+	// errors for messages the platform couldn't process (e.g. invalid or rejected events) are published on "s/e"
+	// the subscriptions are made once the client is connected (and again after each reconnect)
+	// with C8Y_OPERATION_DEDUP_WINDOW operations redelivered by the broker (after a reconnect or a crash) are only executed once, see HandledOperations
+	serializer := NewOperationSerializer(cfg)
+	var handledOperations *HandledOperations
+	if cfg.OperationDedupWindow > 0 {
+		handledOperations = NewHandledOperations(cfg.OperationDedupPath, cfg.OperationDedupWindow, cfg.OperationDedupSize)
+	}
+	cfg.Subscriptions = append([]Subscription{
+		{Topic: "s/ds", QoS: 1, Handler: func(client mqtt.Client, msg mqtt.Message) {
+			templateId := operationTemplateID(msg.Payload())
+			key := payloadKey(msg.Payload())
+			if handledOperations.Redelivered(msg) {
+				slog.Warn("Skipping operation that has already been handled", "templateId", templateId, "duplicate", msg.Duplicate())
+				return
+			}
+			if cfg.OperationReceivedEvents {
+				reportOperationReceived(client, templateId, msg.Payload())
+			}
+			if err := serializer.Submit(templateId, func() { handleReceivedMessage(client, msg) }); err != nil {
+				rejectOperation(client, templateId, err)
+				return
+			}
+			handledOperations.Record(key)
+		}},
+		{Topic: "s/e", QoS: 1, Handler: handleErrorMessage},
+		// operations without static template (c8y_Message, c8y_RepublishProperties) only arrive as JSON, they are translated to a record and
+		// handled like the operations of s/ds. Everything else on this topic arrives on s/ds as well and is ignored
+		{Topic: operationNotificationsTopic, QoS: 1, Handler: func(client mqtt.Client, msg mqtt.Message) {
+			record, ok, err := jsonOperationRecord(msg.Payload(), deviceSerial)
+			if err != nil {
+				slog.Warn("Failed to parse JSON operation", "msg", string(msg.Payload()), "err", err)
+				return
+			}
+			if !ok {
+				return
+			}
+			templateId := record[0]
+			key := operationIDKey(jsonOperationID(msg.Payload()), msg.Payload())
+			if handledOperations.Seen(key) {
+				slog.Warn("Skipping operation that has already been handled", "templateId", templateId, "duplicate", msg.Duplicate())
+				return
+			}
+			translated := simulatedMessage{topic: msg.Topic(), payload: []byte(buildSmartRest(templateId, record[1:]...))}
+			if cfg.OperationReceivedEvents {
+				reportOperationReceived(client, templateId, translated.Payload())
+			}
+			if err := serializer.Submit(templateId, func() { handleReceivedMessage(client, translated) }); err != nil {
+				rejectOperation(client, templateId, err)
+				return
+			}
+			handledOperations.Record(key)
+		}},
+	}, cfg.Subscriptions...)
+
+	// DNS problems and a wrong clock make connecting fail with hard to read errors, so they are checked first
+	if err := preflight(cfg); err != nil {
+		logger.Error("Pre-flight check failed", "err", err)
+		os.Exit(1)
+	}
 
 	// init mqtt client and connect to Cumulocity
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(brokerURI)
-	opts.SetClientID(deviceSerial)
-	opts.SetUsername(os.Getenv("USERNAME"))
-	opts.SetPassword(os.Getenv("PASSWORD"))
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = connectLostHandler
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		slog.Error("Failed to connect", "err", token.Error())
+	device, err := NewDevice(cfg, newCredentialsProvider(cfg))
+	if err != nil {
+		logger.Error("Invalid connection settings", "err", err)
+		os.Exit(1)
+	}
+	device.operations = serializer
+	client := device.Client()
+	shellRunner = NewShellRunner(client, cfg)
+	restarter = NewRestarter(client, cfg)
+	// a device specific command operations can address by name, see RegisterCommand
+	RegisterCommand("self-test", func(args string) (string, error) {
+		depth := device.OperationQueueDepth()
+		return fmt.Sprintf("connected: %t, operations pending: %d, in flight: %d", client.IsConnected(), depth.Pending, depth.InFlight), nil
+	})
+	progress = NewProgressReporter(client, cfg.ProgressInterval)
+	if cfg.StartupDelay > 0 {
+		logger.Info("Delaying startup", "delay", cfg.StartupDelay)
+		time.Sleep(cfg.StartupDelay)
+	}
+	if err := device.Connect(); err != nil {
+		slog.Error("Failed to connect", "err", err)
+		os.Exit(1)
+	}
+	// "kill -USR1 <pid>" or the "reconnect" command re-establish the connection, e.g. after a network change
+	supervisor.Go("reconnect signal", device.ReconnectOnSignal)
+	RegisterCommand("reconnect", func(args string) (string, error) {
+		if err := device.Reconnect("reconnect command"); err != nil {
+			return "", err
+		}
+		return "reconnected", nil
+	})
+	if cfg.CredentialsRefresh > 0 {
+		supervisor.Go("credentials refresh", func(ctx context.Context) { device.RefreshCredentials(ctx, cfg.CredentialsRefresh) })
+	}
+
+	// without C8Y_TENANT the tenant is asked from the platform, REST (unlike MQTT on the tenant domain) needs it in the username
+	if cfg.Tenant == "" {
+		// s/dat may be subscribed by the user as well, for the tokens
+		var tokenHandler mqtt.MessageHandler
+		if i := slices.IndexFunc(cfg.Subscriptions, func(s Subscription) bool { return s.Topic == "s/dat" }); i >= 0 {
+			tokenHandler = limitInboundSize(cfg.Subscriptions[i].Handler, cfg.InboundMaxSize)
+		}
+		if info, err := queryTenant(client, 10*time.Second, tokenHandler); err != nil {
+			logger.Warn("Failed to query tenant, set C8Y_TENANT if REST requests aren't authorized", "err", err)
+		} else {
+			logger.Info("Detected tenant", "tenant", info.Tenant, "domain", info.Domain)
+			if err := device.UseTenant(info.Tenant); err != nil {
+				logger.Warn("Username doesn't match the detected tenant", "err", err)
+			}
+			if _, explicit := lookupEnv("C8Y_BASEURL"); !explicit && info.Domain != "" {
+				cfg.BaseURL = "https://" + info.Domain
+			}
+		}
+	}
+	// REST and remote access ask the device for the credentials, as they may come from a file or keyring and be rotated
+	rest := NewRestClient(cfg.BaseURL, device.Credentials, deviceSerial)
+	remoteAccess = NewRemoteAccess(cfg.BaseURL, device.Credentials, cfg.RemoteAccessProtocols)
+
+	// Init device in Cloud - the 100 message will create the Device if not existing yet
+	// everything after relies on the device twin, so startup only continues once its existence is confirmed
+	if err := device.Create(rest, deviceName, cfg.DeviceType); err != nil {
+		logger.Error("Failed to create device", "err", err)
 		os.Exit(1)
 	}
+	provisioning = NewProvisioning(client, cfg)
+	provisioning.DeviceCreated()
+	// JSON payloads that need source.id take it from device.ManagedObjectID(), it is looked up in background if Create couldn't
+	if device.ManagedObjectID() == "" {
+		supervisor.Go("managed object id lookup", func(ctx context.Context) { device.LookupManagedObjectID(ctx, rest) })
+	}
 
-	// Init device in Cloud - this message will create the Device if not existing yet
-	publishSmartRestMessage(client, "100,"+deviceName+",yourDeviceType")
-	time.Sleep(2 * time.Second)
+	// a restart operation we rebooted for is done now that we're back
+	restarter.ResumePending()
 
 	// Now tell the platform about the capabilities of your Device (required keywords for each capability are in "fragment library")
-	publishSmartRestMessage(client, "114,c8y_Firmware,c8y_Restart,c8y_SoftwareList,c8y_SoftwareUpdate,c8y_LogfileRequest,c8y_RemoteAccessConnect,c8y_DeviceProfile")
+	// this and the device properties only go out once the device exists (Create above), spaced by C8Y_STARTUP_STAGGER
+	// restarts are only offered if the restart command can actually be executed
+	capabilities := []string{"c8y_Firmware", "c8y_Restart", "c8y_SoftwareList", "c8y_SoftwareUpdate", "c8y_LogfileRequest", "c8y_RemoteAccessConnect", "c8y_DeviceProfile", "c8y_Relay", "c8y_RelayArray", "c8y_Message", "c8y_RepublishProperties"}
+	if err := restarter.Check(); err != nil {
+		logger.Warn("Not supporting restart operations", "err", err)
+		capabilities = slices.DeleteFunc(capabilities, func(c string) bool { return c == "c8y_Restart" })
+	}
+	// the capabilities and properties are verified: the ones failing or rejected on s/e are retried, see startupVerifier
+	properties, err := NewPropertyCache(cfg.PropertyCachePath, deviceSerial, *forceProperties)
+	if err != nil {
+		logger.Error("Failed to load property cache", "err", err)
+		os.Exit(1)
+	}
+	pacer := newStartupPacer(cfg.StartupStagger)
+	startup := newStartupVerifier(properties, cfg.StartupVerifyTime, cfg.StartupRetries)
+	device.SetCapabilities(capabilities)
+	startup.Add("capabilities", "114", func() error {
+		pacer.wait()
+		return device.PublishSmartRest(buildSmartRest("114", capabilities...))
+	})
 
 	// Now set some device properties to give Users info about the Devce...
-	setDeviceProperties(client, deviceName, deviceSerial)
+	requiredInterval := NewRequiredInterval(client, deviceSerial)
+	if failed := setDeviceProperties(device, cfg, requiredInterval, properties, pacer, startup); !slices.Contains(failed, "capabilities") {
+		provisioning.CapabilitiesDeclared()
+	}
+	// the same burst again on demand, with a property cache that considers every property changed
+	republisher = NewRepublisher(func() ([]string, error) {
+		forced, err := NewPropertyCache(cfg.PropertyCachePath, deviceSerial, true)
+		if err != nil {
+			return nil, err
+		}
+		verifier := newStartupVerifier(forced, cfg.StartupVerifyTime, cfg.StartupRetries)
+		verifier.Add("capabilities", "114", func() error {
+			return device.PublishSmartRest(buildSmartRest("114", capabilities...))
+		})
+		return setDeviceProperties(device, cfg, requiredInterval, forced, newStartupPacer(cfg.StartupStagger), verifier), nil
+	})
+	supervisor.Go("republish signal", republisher.RepublishOnSignal)
+	// "on" takes the device out of availability monitoring for planned downtime, "off" monitors it again
+	RegisterCommand("maintenance", func(args string) (string, error) {
+		var on bool
+		switch args {
+		case "on":
+			on = true
+		case "off":
+		default:
+			return "", fmt.Errorf("expected on or off, got %q", args)
+		}
+		if err := requiredInterval.SetMaintenanceMode(on); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("maintenance mode: %t", on), nil
+	})
 
 	// Send measurements, events, alarms periodically in an endless loop
-	// the "go " prefix is specific to Go, it runs this code in background
-	go generateMeasurementsEventsAlarms(client, 5)
+	// the loop runs in background via the supervisor, which stops it (and all other background tasks) on shutdown
+	if childDevices, err = NewChildRegistry(client, rest, cfg.ChildRegistryPath); err != nil {
+		logger.Error("Failed to load child registry", "err", err)
+		os.Exit(1)
+	}
+	activeWindow = cfg.ActiveWindow
+	// a liveness signal for monitoring, independent of whether there is data to send
+	var heartbeat *Heartbeat
+	if cfg.HeartbeatInterval > 0 {
+		heartbeat = NewHeartbeat(client, cfg.HeartbeatFragment, cfg.HeartbeatSeries, cfg.HeartbeatInterval)
+		heartbeat.Start()
+	}
+	if cfg.TimeSyncInterval > 0 {
+		clockMonitor = NewClockMonitor(client, deviceSerial, cfg.TimeSyncMaxError, cfg.TimeSyncAlarmAfter)
+		supervisor.Go("clock sync", func(ctx context.Context) { clockMonitor.Run(ctx, cfg.TimeSyncInterval) })
+	}
+	if cfg.NetworkInfoInterval > 0 {
+		source, err := networkInfo, error(nil)
+		if source == nil {
+			source, err = NewOSNetworkInfo(cfg.Brokers[0], cfg.NetworkModem)
+		}
+		if err != nil {
+			logger.Warn("Not publishing the network configuration", "err", err)
+		} else {
+			networkMonitor = NewNetworkMonitor(client, deviceSerial, source)
+			supervisor.Go("network info", func(ctx context.Context) { networkMonitor.Run(ctx, cfg.NetworkInfoInterval) })
+		}
+	}
+	supervisor.Go("active window", func(ctx context.Context) { activeWindow.Run(ctx, client, deviceSerial, requiredInterval) })
+	measurements := NewMeasurementPublisher(client, rest, childDevices, cfg)
+	cycles.Attach(measurements)
+	device.measurements = measurements
+	// support bundles and "./client state" get the in-memory state of the client from a local endpoint
+	if cfg.StateAddr != "" {
+		supervisor.Go("state endpoint", func(ctx context.Context) {
+			if err := serveState(ctx, cfg.StateAddr, device); err != nil {
+				logger.Error("State endpoint stopped", "err", err)
+			}
+		})
+	}
+	// "pause [buffer]" stops sending measurements without disconnecting (e.g. to save bandwidth), "resume" sends again
+	RegisterCommand("telemetry", telemetryCommand(client, deviceSerial, measurements, requiredInterval))
+	operationTimes = NewOperationTimes(rest, measurements)
+	checkLogSources(cfg.LogfileTypes, cfg.LogSources)
+	logRetriever = NewLogRetriever(cfg.LogSources, rest)
+	supervisor.Go("measurements", func(ctx context.Context) {
+		generateMeasurementsEventsAlarms(ctx, client, measurements, device, NewJitter(deviceSerial, cfg.JitterFraction))
+	})
 
-	// Ok now let's take care of listening to Cloud Operations, this is done by subscribing to "s/ds" topic
-	token := client.Subscribe("s/ds", byte(1), handleReceivedMessage)
-	if token.Wait() && token.Error() != nil {
-		fmt.Printf("Error subscribing to topic %s: %v\n", "s/ds", token.Error())
-		return
+	// fast signals are sampled every second, but only min/max/avg per aggregation window are published
+	if cfg.AggregationWindow > 0 {
+		aggregator := NewAggregator(measurements, cfg.AggregationWindow)
+		supervisor.Go("aggregator", aggregator.Run)
+		supervisor.Go("vibration sampling", func(ctx context.Context) { sampleVibration(ctx, aggregator, cfg.SampleInterval) })
+	}
+
+	// once-per-period summaries (e.g. daily max temperature) of the published measurements
+	if len(cfg.RollupSpec) > 0 {
+		rollup := NewRollup(measurements, cfg.RollupSchedule, cfg.RollupSpec)
+		measurements.SetRollup(rollup)
+		supervisor.Go("rollup", rollup.Run)
+	}
+
+	// battery powered devices report their charge level and raise an alarm when running low
+	if cfg.PowerSource != "" {
+		source, _ := newPowerSource(cfg.PowerSource) // validated by loadConfig
+		battery := NewBatteryMonitor(client, measurements, source, cfg)
+		supervisor.Go("battery monitor", func(ctx context.Context) { battery.Run(ctx, cfg.BatteryInterval) })
+	}
+
+	// network equipment speaking SNMP is polled and its values are published as measurements of this device
+	if cfg.SNMPTarget != "" {
+		source, err := newSNMPSource(cfg)
+		if err != nil {
+			logger.Error("Invalid SNMP settings", "err", err)
+			os.Exit(1)
+		}
+		timeout := cfg.SNMPTimeout
+		// a redundant agent takes over while the target fails, a poll may then have to ask both
+		if cfg.SNMPFailoverTarget != "" {
+			failoverCfg := cfg
+			failoverCfg.SNMPTarget = cfg.SNMPFailoverTarget
+			secondary, err := newSNMPSource(failoverCfg)
+			if err != nil {
+				logger.Error("Invalid SNMP settings", "err", err)
+				os.Exit(1)
+			}
+			source = NewFailoverSource(source.Name(), source, secondary, cfg.SNMPFailoverRecovery, client, deviceSerial)
+			timeout *= 2
+		}
+		poller := NewSourcePoller(client, measurements, source, cfg.SNMPMappings, timeout)
+		supervisor.Go("snmp", func(ctx context.Context) { poller.Run(ctx, cfg.SNMPInterval) })
+	}
+
+	// metric emitters speaking InfluxDB line protocol (telegraf, statsd bridges, ...) feed measurements via a local UDP port
+	if cfg.LineProtocolAddr != "" {
+		supervisor.Go("line protocol ingest", func(ctx context.Context) {
+			if err := lineProtocolIngest(ctx, cfg.LineProtocolAddr, measurements, cfg.LineProtocolMapping); err != nil {
+				logger.Error("Line protocol ingest stopped", "err", err)
+			}
+		})
+	}
+
+	// "kill -HUP <pid>" re-reads the configuration, changes to intervals and log level are applied without reconnecting
+	supervisor.Go("config reload", func(ctx context.Context) {
+		watchConfigReload(ctx, cfg, func(cfg Config) {
+			setLogLevel(cfg.LogLevel)
+			measurements.Apply(cfg)
+			requiredInterval.Publish(cfg)
+		})
+	})
+
+	// push events the device logged while it had no connection, with their original timestamps
+	if cfg.EventBacklog != "" {
+		supervisor.Go("event backlog", func(ctx context.Context) { importEventBacklog(ctx, client, cfg) })
+	}
+	// the same for measurements, sent in large chunks as an outage may have buffered a lot of them
+	if cfg.MeasurementBacklog != "" {
+		supervisor.Go("measurement backlog", func(ctx context.Context) { importMeasurementBacklog(ctx, measurements, cfg.MeasurementBacklog) })
 	}
-	slog.Info("Subscribed to Operations topic (s/ds)")
 
-	// this is specific to Go, used to keep main routine alive
-	select {}
+	// keep running until the process is asked to stop (Ctrl+C, "kill <pid>", systemctl stop, ...)
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	<-shutdown
+	logger.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if err := supervisor.Shutdown(ctx); err != nil {
+		logger.Warn("Not all background tasks stopped in time", "err", err)
+	}
+	cancel()
+	// on a planned stop the alarms of this device would linger misleadingly, unless they are meant to persist
+	if cfg.ClearAlarmsOnShutdown {
+		raisedAlarms.ClearAll(client, cfg.PersistentAlarms)
+	}
+	// the device is alive until it disconnects, so the heartbeat goes last
+	heartbeat.Stop()
+	client.Disconnect(1000)
+}
+
+// sampleVibration simulates a sensor sampled much faster than measurements are published
+func sampleVibration(ctx context.Context, aggregator *Aggregator, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			done := cycles.Start("vibration sampling", interval)
+			value := 2 + math.Sin(float64(t.UnixMilli())/10000)
+			aggregator.Add(Measurement{Fragment: "c8y_Vibration", Series: "rms", Value: value, Unit: "mm/s"})
+			done()
+		}
+	}
+}
+
+// setLogSource replaces the logger by one with or without the caller of each line, which takes a stack walk per line
+// call it before any background task runs, the logger isn't meant to be replaced while in use
+func setLogSource(addSource bool) {
+	logger = newLogger(addSource)
 }
 
-func setDeviceProperties(client mqtt.Client, deviceName string, deviceSerial string) {
+// setLogLevel applies the level to our logger as well as to the default logger used via slog.Info(...)
+func setLogLevel(level slog.Level) {
+	logLevel.Set(level)
+	slog.SetLogLoggerLevel(level)
+}
+
+// setDeviceProperties publishes the device properties along with the updates already added to startup, and returns
+// the names of those that couldn't be set
+func setDeviceProperties(device *Device, cfg Config, requiredInterval *RequiredInterval, properties *PropertyCache, pacer *startupPacer, startup *startupVerifier) []string {
+	deviceName, deviceSerial := device.Name(), device.Serial()
+	client := device.Client()
+
+	// properties that didn't change since the last run aren't published again, see C8Y_PROPERTY_CACHE and --force-properties
+	publishProperty := func(key string, message string) {
+		template, _, _ := strings.Cut(message, ",")
+		startup.Add(key, template, func() error {
+			if !properties.Changed(key, message) {
+				logger.Debug("Device property unchanged, not publishing", "property", key)
+				return nil
+			}
+			pacer.wait()
+			return device.PublishSmartRest(message)
+		})
+	}
+
 	// template links: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#inventory-templates
 
 	// let platform know which firmware is installed (name, version, url)
-	publishSmartRestMessage(client, "115,firmwareName,firmwareVersion,firmwareUrl")
+	publishProperty("firmware", "115,firmwareName,firmwareVersion,firmwareUrl")
 	// let platform know which software is installed (triplets of software name/version/url)
-	publishSmartRestMessage(client, "116,software1,1.0.1,url1,software2,1.0.2,url2,software3,1.0.3")
+	if software, err := installedSoftware.List().SmartRest(); err != nil {
+		logger.Error("Invalid software list", "err", err)
+	} else {
+		publishProperty("software", software)
+	}
 	// let platform know about hardware/OS in use (serial, model, version)
-	publishSmartRestMessage(client, "110,"+deviceName+",myHardwareModel,1.2.3")
-	// let platform know current latitude/longitude/altitude of the device
-	publishSmartRestMessage(client, "112,50.323423,6.423423")
+	publishProperty("hardware", "110,"+deviceName+",myHardwareModel,1.2.3")
+	// let platform know current latitude/longitude (and altitude if the GPS has a 3D fix) of the device
+	startup.Add("position", "112", func() error {
+		if !properties.Changed("position", fmt.Sprintf("%+v", deviceLocation)) {
+			return nil
+		}
+		pacer.wait()
+		return publishPosition(client, deviceSerial, deviceLocation)
+	})
 	// let platform know which logfile type can be retrieved from remote
-	publishSmartRestMessage(client, "118,dpkg,container,logread")
-	// let platform know about currently installed agent (name, version, url, maintainer)
-	publishSmartRestMessage(client, "122,your-device-agent,0.1,https://cumulocity.com,\"Korbinian Butz\"")
-	// let platform know about the interval the device is expected to send data
-	publishSmartRestMessage(client, "117,60")
+	publishProperty("logfileTypes", buildSmartRest("118", cfg.LogfileTypes...))
+	// let platform know about currently installed agent (name, version, url, maintainer), the version is taken from the build
+	startup.Add("agent", "122", func() error {
+		pacer.wait()
+		return agent.attach(client, deviceSerial, properties)
+	})
+	// let platform know about the interval the device is expected to send data, derived from the measurement schedule
+	startup.Add("requiredInterval", "117", func() error {
+		pacer.wait()
+		return requiredInterval.Publish(cfg)
+	})
 
 	// FYI in this example we've sent multiple, individual MQTT messages to the cloud
 	// One could also concatenate these message, separate them via "\n" and send in one message to Cloud
 
 	// Lastly, set a Property that is specific to customer and not covered by the static template and fragment library
 	// You can update the object with any valid JSON, it will persist it onto the object and can be used by UIs and Applications right away
-	publishJsonViaMqttMessage(client, "inventory/managedObjects/update/"+deviceSerial, `{"yourCustomFragment":{"a":"abc", "b":123, "c":[1,2,3]}}`)
+	customFragment := `{"yourCustomFragment":{"a":"abc", "b":123, "c":[1,2,3]}}`
+	startup.Add("customFragment", "", func() error {
+		if !properties.Changed("customFragment", customFragment) {
+			return nil
+		}
+		pacer.wait()
+		return device.PublishJSON("inventory/managedObjects/update/"+deviceSerial, customFragment)
+	})
+
+	failed := startup.Run()
+	if err := properties.Save(); err != nil {
+		logger.Warn("Failed to save property cache, all properties will be published on next start", "err", err)
+	}
+	return failed
 }
 
-func generateMeasurementsEventsAlarms(client mqtt.Client, sleepTimeSecs int) {
+func generateMeasurementsEventsAlarms(ctx context.Context, client mqtt.Client, measurements *MeasurementPublisher, device *Device, jitter *Jitter) {
+	// start at a device specific offset, so devices booted at the same time don't publish at the same time
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(jitter.Phase(measurements.Interval())):
+	}
 	for {
-		// build a string that will submit measurements/events/alarms to cloud in one message
+		// nothing to send to while the connection is re-established on demand, see Device.Reconnect
+		device.WaitReady(ctx)
+		// outside the active hours the cycle is skipped, the device stays connected and handles operations
+		if !activeWindow.Active(time.Now()) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(measurements.NextDelay(jitter)):
+			}
+			continue
+		}
+		done := cycles.Start("measurements", measurements.Interval())
+		// simple measurements go through the measurement publisher, which sends them as SmartREST 200 lines via MQTT
+		// (or via the REST bulk API in case C8Y_MEASUREMENT_TRANSPORT says so)
+		measurements.Publish([]Measurement{
+			{Fragment: "temperature", Series: "T", Value: 15},
+			{Fragment: "pressure", Series: "p", Value: 15},
+			{Fragment: "yourMeasurementCategory", Series: "yourMeasurementName", Value: 16},
+		})
+
+		// raw values of real sensors are translated via the sensor mapping (C8Y_SENSOR_MAPPING), e.g. a 10 bit ADC reading
+		measurements.PublishReadings([]SensorReading{{Key: "adc0", Value: 512}})
+
+		// operations piling up (e.g. after the device was offline) show up in the operation queue depth
+		depth := device.OperationQueueDepth()
+		measurements.Publish([]Measurement{
+			{Fragment: "c8y_OperationQueue", Series: "pending", Value: float64(depth.Pending)},
+			{Fragment: "c8y_OperationQueue", Series: "inFlight", Value: float64(depth.InFlight)},
+		})
+
+		// build a batch that will submit measurements/events/alarms to cloud in one message
 		// used templates:
-		// - measurements (200): https://cumulocity.com/docs/smartrest/mqtt-static-templates/#200
 		// - measurements (201): https://cumulocity.com/docs/smartrest/mqtt-static-templates/#201
 		// - events (400): https://cumulocity.com/docs/smartrest/mqtt-static-templates/#400
 		// - alarms (301): https://cumulocity.com/docs/smartrest/mqtt-static-templates/#301
-		msg := `
-200,temperature,T,15
-200,pressure,p,15
-200,yourMeasurementCategory,yourMeasurementName,16
-201,yourMeaType,,c8y_SinglePhaseEnergyMeasurement,A1,1234,kWh,c8y_SinglePhaseEnergyMeasurement,A2,2345,kWh
-400,yourEventType,"Your Event description"
-301,yourAlarmType,"here is your alarm text"
-`
-		// submit this 6-line CSV to the Cloud, platform will create 5 measurements + 1 event + 1 alarm on your Device Twin
-		publishSmartRestMessage(client, msg)
+		var batch Batch
+		batch.Measurements("yourMeaType", time.Time{},
+			Measurement{Fragment: "c8y_SinglePhaseEnergyMeasurement", Series: "A1", Value: 1234, Unit: "kWh"},
+			Measurement{Fragment: "c8y_SinglePhaseEnergyMeasurement", Series: "A2", Value: 2345, Unit: "kWh"})
+		batch.Event("yourEventType", "Your Event description")
+		batch.Alarm("CRITICAL", "yourAlarmType", "here is your alarm text")
+		// submit this 3-line CSV to the Cloud, platform will create 2 measurements + 1 event + 1 alarm on your Device Twin
+		// rows that are invalid would be dropped (and logged), the valid ones are still sent
+		batch.Publish(client)
 
 		// similar to Device Properties, let's now create additional Event with custom fragments via the "json-via-mqtt" API
-		json := "{}"
-		json, _ = sjson.Set(json, "time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
-		json, _ = sjson.Set(json, "text", "Your new Event")
-		json, _ = sjson.Set(json, "type", "myCustomEventType")
-		// could be anything, an int/float/string/array/sub-json/etc.
-		// will be persisted in DB and shown in UI (find and expand the Event in "Events" Tab)
-		json, _ = sjson.Set(json, "yourCustomFragment", 123)
-		publishJsonViaMqttMessage(client, "event/events/create", json)
+		err := publishEvent(client, Event{
+			Type: "myCustomEventType",
+			Text: "Your new Event",
+			Time: time.Now(),
+			// could be anything, an int/float/string/array/sub-json/etc.
+			// will be persisted in DB and shown in UI (find and expand the Event in "Events" Tab)
+			Fragments: map[string]any{"yourCustomFragment": 123},
+		})
+		if err != nil {
+			logger.Error("Failed to publish event", "err", err)
+		}
+
+		// measurements with several fragments go the same way, all series end up in one measurement
+		err = measurements.PublishMeasurementJSON(Measurement{
+			Type:     "c8y_PowerQuality",
+			Fragment: "c8y_Frequency",
+			Series:   "f",
+			Value:    50.01,
+			Unit:     "Hz",
+			Fragments: map[string]any{
+				"c8y_Voltage": map[string]MeasurementValue{"L1": {Value: 230.1, Unit: "V"}, "L2": {Value: 229.8, Unit: "V"}},
+				"c8y_Current": map[string]MeasurementValue{"L1": {Value: 4.2, Unit: "A"}, "L2": {Value: 3.9, Unit: "A"}},
+			},
+		})
+		if err != nil {
+			logger.Error("Failed to publish measurement", "err", err)
+		}
 
-		time.Sleep(time.Duration(sleepTimeSecs) * time.Second)
+		// alarms with context fragments go the same way, plain ones (like in the batch above) are sent as SmartREST
+		err = RaiseAlarm(client, Alarm{
+			Type:      "yourDetailedAlarmType",
+			Text:      "Your alarm with details",
+			Severity:  "MINOR",
+			Fragments: map[string]any{"yourAlarmDetails": map[string]any{"component": "pump1", "pressure": 7.2}},
+			// the id of the ticket in your ticketing system, lets it find the alarm via the c8y_ExternalId fragment
+			ExternalID: &ExternalID{Type: "yourTicketSystem", Value: "TICKET-4711"},
+		})
+		if err != nil {
+			logger.Error("Failed to raise alarm", "err", err)
+		}
+		done()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(measurements.NextDelay(jitter)):
+		}
 	}
 }
 
-func publishSmartRestMessage(client mqtt.Client, message string) {
-	publishMqttMessage(client, "s/us", message)
+func publishSmartRestMessage(client mqtt.Client, message string) error {
+	err := publishMqttMessage(client, "s/us", message)
+	raisedAlarms.Observe(message)
+	return err
 }
 
-func publishJsonViaMqttMessage(client mqtt.Client, topic string, jsonMessage string) {
-	publishMqttMessage(client, topic, jsonMessage)
+// publishJsonViaMqttMessage publishes the document unless it is invalid, see validateJSONPayload
+// the error is logged already, callers only need to handle it if they report it further
+func publishJsonViaMqttMessage(client mqtt.Client, topic string, jsonMessage string) error {
+	if err := validateJSONPayload(topic, jsonMessage, strictJSON); err != nil {
+		slog.Warn("Not publishing invalid JSON payload", "topic", topic, "msg", jsonMessage, "err", err)
+		return err
+	}
+	return publishMqttMessage(client, topic, jsonMessage)
 }
 
-func publishMqttMessage(client mqtt.Client, topic string, message string) {
-	qos := byte(1)
+// publishTelemetryJSON publishes a telemetry document like publishJsonViaMqttMessage, with the QoS of publishTelemetryMessage
+func publishTelemetryJSON(client mqtt.Client, topic string, jsonMessage string) error {
+	if err := validateJSONPayload(topic, jsonMessage, strictJSON); err != nil {
+		slog.Warn("Not publishing invalid JSON payload", "topic", topic, "msg", jsonMessage, "err", err)
+		return err
+	}
+	return publishTelemetryMessage(client, topic, jsonMessage)
+}
+
+// publishTelemetryMessage publishes measurements, with QoS 0 while acks time out if C8Y_QOS_DOWNGRADE_THRESHOLD is set
+func publishTelemetryMessage(client mqtt.Client, topic string, message string) error {
+	return publishWithQoS(client, topic, message, qosPolicy.TelemetryQoS())
+}
+
+// publishMqttMessage publishes with QoS 1 and waits for the acknowledgement, a failed publish is logged and returned
+func publishMqttMessage(client mqtt.Client, topic string, message string) error {
+	return publishWithQoS(client, topic, message, 1)
+}
+
+func publishWithQoS(client mqtt.Client, topic string, message string, qos byte) error {
 	retained := false
 	pubTopic := topic
+	publishLimiter.Wait()
 	token := client.Publish(pubTopic, qos, retained, message)
-	token.Wait()
+	err := qosPolicy.wait(token, qos)
+	publishStats.Record(pubTopic, err)
+	notifyPublished(pubTopic, message, err)
+	if err != nil {
+		slog.Warn("Failed to publish message", "topic", pubTopic, "msg", message, "err", err)
+		return err
+	}
 	slog.Info("Published Message", "topic", pubTopic, "msg", message, "qos", qos, "retained", retained)
+	return nil
+}
+
+// rejectOperation marks an operation that won't be executed as failed, the static templates address operations by fragment only
+func rejectOperation(client mqtt.Client, templateId string, err error) {
+	slog.Warn("Rejecting operation", "templateId", templateId, "err", err)
+	auditLog.Write(AuditRecord{Time: time.Now().UTC(), TemplateID: templateId, Status: "REJECTED"})
+	fragment, ok := operationFragments[templateId]
+	if !ok {
+		return
+	}
+	publishSmartRestMessage(client, "501,"+fragment)
+	publishSmartRestMessage(client, buildSmartRest("502", fragment, failure(failRejected, "err", err)))
 }
 
 // Every operation scheduled by Users will result in a CSV that is sent to the Device via MQTT
@@ -154,33 +825,120 @@ func publishMqttMessage(client mqtt.Client, topic string, message string) {
 // Full list of operations can be found here: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#operation-templates
 func handleReceivedMessage(client mqtt.Client, msg mqtt.Message) {
 	topic := msg.Topic()
+	// an empty message (e.g. a retained message being cleared) is no operation, binary data would only confuse the parser
+	if len(bytes.TrimSpace(msg.Payload())) == 0 {
+		slog.Info("Ignoring empty MQTT message", "topic", topic)
+		return
+	}
+	if !utf8.Valid(msg.Payload()) {
+		slog.Warn("Ignoring MQTT message that isn't UTF-8 text", "topic", topic, "bytes", len(msg.Payload()))
+		return
+	}
 	message := string(msg.Payload())
 	slog.Info("Received MQTT message", "topic", topic, "msg", message)
 	slog.Info("Detecting type of Operation now...")
 
-	reader := csv.NewReader(strings.NewReader(message))
-	records, _ := reader.ReadAll()
+	records, err := parseSmartRest(msg.Payload())
+	if err != nil || len(records) == 0 {
+		slog.Warn("Failed to parse operation", "msg", message, "err", err)
+		return
+	}
 	record := records[0]
 	templateId := record[0]
+
+	// write the received operation and its outcome to the audit log once the handler is done
+	started := time.Now()
+	created := operationTimes.PickedUp(templateId, started)
+	status := "SUCCESSFUL"
+	defer func() {
+		rec := AuditRecord{
+			Time:       started.UTC(),
+			TemplateID: templateId,
+			Fields:     record[1:],
+			Payload:    message,
+			DurationMs: time.Since(started).Milliseconds(),
+			Status:     status,
+		}
+		if !created.IsZero() {
+			rec.CreatedAt = created.UTC()
+			rec.PickupLatencyMs = started.Sub(created).Milliseconds()
+		}
+		auditLog.Write(rec)
+	}()
+	// a 502 only moves an EXECUTING operation, so the handlers set it to executing via setExecuting and
+	// the recover below knows whether that still has to be done
+	executing := false
+	setExecuting := func(fragment string) {
+		publishSmartRestMessage(client, "501,"+fragment)
+		executing = true
+	}
+	// a handler panicking on an operation it doesn't expect fails the operation instead of taking down the agent (or
+	// leaving the operation PENDING or EXECUTING), the audit record above runs after this and records the failure
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		status = "FAILED"
+		slog.Error("Operation handler panicked", "templateId", templateId, "panic", r, "stack", string(debug.Stack()))
+		if fragment, ok := operationFragments[templateId]; ok {
+			if !executing {
+				publishSmartRestMessage(client, "501,"+fragment)
+			}
+			publishSmartRestMessage(client, buildSmartRest("502", fragment, failure(failHandlerCrashed, "err", r)))
+		}
+	}()
+
+	// handlers index into the record, so skip operations that are missing fields
+	if err := checkOperationFields(record); err != nil {
+		status = "INVALID"
+		slog.Warn("Skipping malformed operation", "templateId", templateId, "payload", record, "err", err)
+		return
+	}
+
 	switch templateId {
 
 	// link: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#510
 	// sample message: 510,DeviceSerial
 	case "510":
 		slog.Info("A User scheduled a RESTART operation", "templateId", templateId, "serialNo", record[1])
-		publishSmartRestMessage(client, "501,c8y_Restart") // set Operation to executing (shows platform Users the restart has been picked up and is done right now)
-		time.Sleep(3 * time.Second)                        // simulate restart...
-		publishSmartRestMessage(client, "503,c8y_Restart") // set Operation to successful (shows platform Users the restart has been done successfully)
-		// if the operation had failed, you would send this message to platform
-		// publishSmartRestMessage(client, "502,c8y_Restart,\"Restart failed because of XYZ\"")
+		setExecuting("c8y_Restart") // set Operation to executing (shows platform Users the restart has been picked up and is done right now)
+		// the operation is set to successful (503) once the device is back, or right away if the restart is simulated
+		if err := restarter.Restart(); err != nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_Restart", failure(failRestart, "err", err)))
+		}
 
 	// link: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#511
 	// sample message: 511,DeviceSerial,execute this
+	// with a command type the arguments go to the registered command instead of the shell: 511,DeviceSerial,--full,self-test
 	case "511":
 		slog.Info("A User scheduled a SHELL operation", "templateId", templateId, "serialNo", record[1], "command", record[2])
-		publishSmartRestMessage(client, "501,c8y_Command")
-		time.Sleep(3 * time.Second) // simulating shell execution
-		publishSmartRestMessage(client, "503,c8y_Command")
+		setExecuting("c8y_Command")
+		if len(record) > 3 && record[3] != "" {
+			output, err := runNamedCommand(record[3], record[2])
+			if err != nil {
+				status = "FAILED"
+				publishSmartRestMessage(client, buildSmartRest("502", "c8y_Command", failure(failCommand, "err", err, "output", output)))
+				return
+			}
+			publishSmartRestMessage(client, buildSmartRest("503", "c8y_Command", output))
+			return
+		}
+		output, err := shellRunner.Run(record[2])
+		if err == errAlreadyRunning {
+			// redelivery of an operation we're still working on, the running one will report the result
+			status = "DUPLICATE"
+			slog.Info("Ignoring SHELL operation, the command is already running", "command", record[2])
+			return
+		}
+		if err != nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_Command", failure(failCommand, "err", err, "output", output)))
+			return
+		}
+		// the output is the result of the operation, shown in the "Shell" tab of the device
+		publishSmartRestMessage(client, buildSmartRest("503", "c8y_Command", output))
 
 	// link: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#515
 	// sample message: 515,DeviceSerial,myFirmware,1.0,http://www.my.url
@@ -190,54 +948,155 @@ func handleReceivedMessage(client mqtt.Client, msg mqtt.Message) {
 		fwUrl := record[4]
 		slog.Info("A User scheduled a FIRMWARE UPDATE operation", "templateId", templateId, "serialNo", record[1],
 			"firmwareName", fwName, "firmwareVersion", fwVersion, "firmwareDownloadUrl", fwUrl)
-		publishSmartRestMessage(client, "501,c8y_Firmware")
-		time.Sleep(3 * time.Second) // simulating host firmware update
+		setExecuting("c8y_Firmware")
+		if err := checkDownloadURL(fwUrl); err != nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_Firmware", failure(failFirmwareDownload, "name", fwName, "version", fwVersion, "err", err)))
+			return
+		}
+		simulateDownload("c8y_Firmware", 8<<20, 3*time.Second) // simulating firmware download and host firmware update
 		// tell platform about currently installed firmware
 		publishSmartRestMessage(client, fmt.Sprintf("115,%s,%s,%s", fwName, fwVersion, fwUrl))
 		// succeed Operation
 		publishSmartRestMessage(client, "503,c8y_Firmware")
 
+	// link: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#518
+	// sample message: 518,DeviceSerial,OPEN
+	// link: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#519
+	// sample message: 519,DeviceSerial,OPEN,CLOSED,CLOSED,OPEN
+	case "518", "519":
+		fragment := operationFragments[templateId]
+		states, err := parseRelayStates(record)
+		if err != nil {
+			status = "FAILED"
+			slog.Warn("Invalid RELAY operation", "templateId", templateId, "payload", record, "err", err)
+			setExecuting(fragment)
+			publishSmartRestMessage(client, buildSmartRest("502", fragment, failure(failInvalidOperation, "err", err)))
+			return
+		}
+		slog.Info("A User scheduled a RELAY operation", "templateId", templateId, "serialNo", record[1], "states", states)
+		setExecuting(fragment)
+		// relays that switched are reported even if others failed, the device twin shows what the hardware is in
+		result, err := switchRelays(relays, states)
+		reportRelayStates(client, record[1], fragment, result)
+		if err != nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", fragment, failure(failRelay, "err", err)))
+			return
+		}
+		publishSmartRestMessage(client, "503,"+fragment)
+
 	// link: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#522
 	// sample message: 522,DeviceSerial,logfileA,2013-06-22T17:03:14.000+02:00,2013-06-22T18:03:14.000+02:00,ERROR,1000
 	case "522":
-		slog.Info("A User scheduled a LOG FILE RETRIEVAL operation", "templateId", templateId, "serialNo", record[1],
-			"logfileName", record[2], "startDate", record[3], "endDate", record[4], "searchText", record[5], "maxLines", record[5])
-		publishSmartRestMessage(client, "501,c8y_LogfileRequest")
-		time.Sleep(3 * time.Second) // extract local log file and upload to platform via HTTP
-		publishSmartRestMessage(client, "503,c8y_LogfileRequest")
+		req, err := parseLogfileRequest(record)
+		if err != nil {
+			status = "FAILED"
+			slog.Warn("Invalid LOG FILE RETRIEVAL operation", "templateId", templateId, "payload", record, "err", err)
+			setExecuting("c8y_LogfileRequest")
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_LogfileRequest", failure(failInvalidOperation, "err", err)))
+			return
+		}
+		slog.Info("A User scheduled a LOG FILE RETRIEVAL operation", "templateId", templateId, "serialNo", req.Serial,
+			"logfileName", req.LogFile, "startDate", req.StartDate, "endDate", req.EndDate, "searchText", req.SearchText, "maxLines", req.MaxLines)
+		setExecuting("c8y_LogfileRequest")
+		if logRetriever == nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_LogfileRequest", failure(failNotReady)))
+			return
+		}
+		// extract the local log file and upload it to the platform via HTTP, its URL is the result of the operation
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		url, err := logRetriever.Retrieve(ctx, req)
+		if err != nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_LogfileRequest", failure(failLogRetrieval, "logfile", req.LogFile, "err", err)))
+			return
+		}
+		publishSmartRestMessage(client, buildSmartRest("503", "c8y_LogfileRequest", url))
 
 	// link: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#528
 	// sample message: 528,DeviceSerial,softwareA,1.0,url1,install,softwareB,2.0,url2,install
 	case "528":
-		countSoftwarePackages := (len(record) - 2) / 4
-		receivedSoftwarePackages := []map[string]string{}
-		for i := range countSoftwarePackages {
-			sw := map[string]string{
-				"name":    record[2+(i*4)],
-				"version": record[2+(i*4)+1],
-				"url":     record[2+(i*4)+2],
-				"action":  record[2+(i*4)+3],
-			}
-			receivedSoftwarePackages = append(receivedSoftwarePackages, sw)
+		updates, err := parseSoftwareUpdates(record)
+		if err != nil {
+			status = "FAILED"
+			slog.Warn("Invalid SOFTWARE UPDATE operation", "templateId", templateId, "payload", record, "err", err)
+			setExecuting("c8y_SoftwareUpdate")
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_SoftwareUpdate", failure(failInvalidOperation, "err", err)))
+			return
 		}
 		slog.Info("A User scheduled a SOFTWARE UPDATE operation", "templateId", templateId, "serialNo", record[1],
-			"softwarePackages", receivedSoftwarePackages)
-		publishSmartRestMessage(client, "501,c8y_SoftwareUpdate")
-		time.Sleep(3 * time.Second) // simulating software updates
+			"softwarePackages", updates)
+		setExecuting("c8y_SoftwareUpdate")
+		simulateDownload("c8y_SoftwareUpdate", 2<<20, 3*time.Second) // simulating software downloads and updates
 		// submit all currently installed software packages to Cloud, see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#116
-		publishSmartRestMessage(client, "116,software1,version1,url1,software2,,url2,software3,version3")
+		line, err := installedSoftware.Update(updates).SmartRest()
+		if err != nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_SoftwareUpdate", failure(failSoftwareUpdate, "err", err)))
+			return
+		}
+		publishSmartRestMessage(client, line)
 		publishSmartRestMessage(client, "503,c8y_SoftwareUpdate") // set Operation to successful
 
 	// link: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#530
 	// sample message: 530,DeviceSerial,10.0.0.67,22,eb5e9d13-1caa-486b-bdda-130ca0d87df8
 	case "530":
-		slog.Info("A User requested REMOTE SSH ACCESS to a Device", "templateId", templateId, "serialNo", record[1],
-			"ip", record[2], "port", record[3], "connectionKey", record[4])
-		publishSmartRestMessage(client, "501,c8y_RemoteAccessConnect")
-		time.Sleep(3 * time.Second) // connect to stated IP and Port, and route its traffic through a websocket to platform
+		req, err := parseRemoteAccessRequest(record)
+		if err != nil {
+			status = "FAILED"
+			slog.Warn("Invalid REMOTE ACCESS operation", "templateId", templateId, "payload", record, "err", err)
+			setExecuting("c8y_RemoteAccessConnect")
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_RemoteAccessConnect", failure(failInvalidOperation, "err", err)))
+			return
+		}
+		slog.Info("A User requested REMOTE ACCESS to a Device", "templateId", templateId, "serialNo", req.Serial,
+			"ip", req.Host, "port", req.Port, "connectionKey", req.ConnectionKey, "protocol", req.Protocol)
+		setExecuting("c8y_RemoteAccessConnect")
+		// connect to stated IP and Port, and route its traffic through a websocket to platform
+		if err := remoteAccess.Connect(req); err != nil {
+			status = "FAILED"
+			slog.Warn("Remote access failed", "protocol", req.Protocol, "err", err)
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_RemoteAccessConnect", failure(failRemoteAccess, "host", req.Host, "port", req.Port, "err", err)))
+			return
+		}
 		publishSmartRestMessage(client, "503,c8y_RemoteAccessConnect")
 
+	// no static template, translated from the JSON operation: c8y_Message,DeviceSerial,"Hello,
+	// second line"
+	case "c8y_Message":
+		text := record[2]
+		if strings.TrimSpace(text) == "" {
+			status = "FAILED"
+			slog.Warn("Invalid MESSAGE operation", "templateId", templateId, "payload", record)
+			setExecuting("c8y_Message")
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_Message", failure(failInvalidOperation, "err", "empty message")))
+			return
+		}
+		slog.Info("A User sent a MESSAGE to the Device", "templateId", templateId, "serialNo", record[1], "text", text)
+		setExecuting("c8y_Message")
+		if err := messages.ShowMessage(text); err != nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_Message", failure(failMessage, "err", err)))
+			return
+		}
+		publishSmartRestMessage(client, "503,c8y_Message")
+
+	// no static template, translated from the JSON operation: c8y_RepublishProperties,DeviceSerial
+	case "c8y_RepublishProperties":
+		slog.Info("A User requested to re-publish the device properties", "templateId", templateId, "serialNo", record[1])
+		setExecuting("c8y_RepublishProperties")
+		if err := republisher.Republish("operation"); err != nil {
+			status = "FAILED"
+			publishSmartRestMessage(client, buildSmartRest("502", "c8y_RepublishProperties", failure(failRepublish, "err", err)))
+			return
+		}
+		publishSmartRestMessage(client, "503,c8y_RepublishProperties")
+
 	default:
+		status = "UNSUPPORTED"
 		slog.Info("A User requested an Operation that is not supported by the Device", "templateId", templateId, "payload", record)
 	}
 }
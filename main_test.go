@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// recordingClient records the messages published by the code under test, publishing always succeeds
+type recordingClient struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	published []publishedMessage
+}
+
+type publishedMessage struct {
+	topic   string
+	payload string
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var text string
+	switch p := payload.(type) {
+	case string:
+		text = p
+	case []byte:
+		text = string(p)
+	}
+	c.published = append(c.published, publishedMessage{topic: topic, payload: text})
+	return &mqtt.DummyToken{}
+}
+
+// messages returns the payloads published on the topic, in order
+func (c *recordingClient) messages(topic string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var payloads []string
+	for _, m := range c.published {
+		if m.topic == topic {
+			payloads = append(payloads, m.payload)
+		}
+	}
+	return payloads
+}
+
+// handleOperation feeds the payload to handleReceivedMessage as if it arrived on s/ds
+// it returns the client the handler published with and the audit status of the operation, empty if none was recorded
+func handleOperation(t *testing.T, payload []byte) (*recordingClient, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLogger(path, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog = audit
+	t.Cleanup(func() {
+		auditLog = nil
+		audit.Close()
+	})
+
+	client := &recordingClient{}
+	handleReceivedMessage(client, simulatedMessage{topic: "s/ds", payload: payload})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		return client, ""
+	}
+	var record AuditRecord
+	if err := json.Unmarshal(lines[len(lines)-1], &record); err != nil {
+		t.Fatal(err)
+	}
+	return client, record.Status
+}
+
+func TestHandleReceivedMessageAuditsUnsupported(t *testing.T) {
+	client, status := handleOperation(t, []byte("999,DeviceSerial,a,b"))
+	if status != "UNSUPPORTED" {
+		t.Errorf("status = %q, want UNSUPPORTED", status)
+	}
+	if published := client.messages("s/us"); len(published) > 0 {
+		t.Errorf("published %q for an unsupported operation", published)
+	}
+}
+
+func TestHandleReceivedMessageMalformedPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		// audit status, empty if the message isn't handled as operation at all
+		status string
+	}{
+		{"nil", nil, ""},
+		{"empty", []byte{}, ""},
+		{"blank lines", []byte(" \r\n\n\t"), ""},
+		{"invalid utf-8", []byte{0xff, 0xfe, 0xfd}, ""},
+		{"binary with zero bytes", []byte{0x00, 0x80, 0x00, 0xc3}, ""},
+		{"zero bytes only", []byte{0x00, 0x00}, "UNSUPPORTED"},
+		{"unterminated quote", []byte(`510,"DeviceSerial`), ""},
+		{"separators only", []byte(",,,"), "UNSUPPORTED"},
+		{"missing fields", []byte("522,DeviceSerial"), "INVALID"},
+		{"template only", []byte("510"), "INVALID"},
+		{"unknown template", []byte("999,DeviceSerial,\x01\x02"), "UNSUPPORTED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, status := handleOperation(t, tt.payload)
+			if status != tt.status {
+				t.Errorf("status = %q, want %q", status, tt.status)
+			}
+			if published := client.messages("s/us"); len(published) > 0 {
+				t.Errorf("published %q for a message that isn't a valid operation", published)
+			}
+		})
+	}
+}
+
+func TestHandleReceivedMessageAuditsFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"firmware from unsupported URL", "515,DeviceSerial,myFirmware,1.0,ftp://example.com/fw.bin"},
+		{"unknown relay state", "518,DeviceSerial,AJAR"},
+		{"incomplete software update", "528,DeviceSerial,softwareA,1.0"},
+		{"remote access to invalid port", "530,DeviceSerial,10.0.0.67,ssh,key"},
+		{"remote access not ready", "530,DeviceSerial,10.0.0.67,22,key"},
+		{"empty message", `c8y_Message,DeviceSerial," "`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, status := handleOperation(t, []byte(tt.payload))
+			// an operation set to FAILED on the platform must not be audited as SUCCESSFUL
+			if status != "FAILED" {
+				t.Errorf("status = %q, want FAILED", status)
+			}
+			// a 502 is ignored by the platform unless the operation was set to executing before
+			published := client.messages("s/us")
+			if len(published) < 2 || !strings.HasPrefix(published[0], "501,") || !strings.HasPrefix(published[len(published)-1], "502,") {
+				t.Errorf("published %q, want the operation set to executing first and failed last", published)
+			}
+		})
+	}
+}
+
+// panickingClient panics on the first publish, like a handler crashing before it set the operation to executing
+type panickingClient struct {
+	recordingClient
+	panicked bool
+}
+
+func (c *panickingClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	if !c.panicked {
+		c.panicked = true
+		panic("publish failed")
+	}
+	return c.recordingClient.Publish(topic, qos, retained, payload)
+}
+
+func TestHandleReceivedMessageRecoversBeforeExecuting(t *testing.T) {
+	recentOperations = &operationRing{}
+	client := &panickingClient{}
+	handleReceivedMessage(client, simulatedMessage{topic: "s/ds", payload: []byte("510,DeviceSerial")})
+	want := []string{"501,c8y_Restart", "502,c8y_Restart,C8Y-HANDLER-CRASHED: "}
+	published := client.messages("s/us")
+	if len(published) != 2 || published[0] != want[0] || !strings.HasPrefix(published[1], want[1]) {
+		t.Errorf("published %q, want %q", published, want)
+	}
+	if records := recentOperations.List(); len(records) != 1 || records[0].Status != "FAILED" {
+		t.Errorf("audit records %+v, want one FAILED", records)
+	}
+}
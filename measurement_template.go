@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// placeholders usable in the field layout of a measurement template
+const (
+	fieldType     = "type"
+	fieldTime     = "time"
+	fieldFragment = "fragment"
+	fieldSeries   = "series"
+	fieldValue    = "value"
+	fieldUnit     = "unit"
+)
+
+// measurementTemplate describes how a Measurement is rendered to a SmartREST line
+// besides the static templates 200 and 201, tenants may define their own templates in a SmartREST 2.0 template collection (xid)
+type measurementTemplate struct {
+	// s/us for static templates, s/uc/<xid> for custom ones
+	Topic string
+	ID    string
+	// order of the fields after the template id
+	Fields []string
+	// fields that may be empty, trailing empty optional fields are left out
+	Optional map[string]bool
+}
+
+// static template 200: 200,fragment,series,value,unit,time
+// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#200
+var measurementTemplate200 = measurementTemplate{
+	Topic:    "s/us",
+	ID:       "200",
+	Fields:   []string{fieldFragment, fieldSeries, fieldValue, fieldUnit, fieldTime},
+	Optional: map[string]bool{fieldUnit: true, fieldTime: true},
+}
+
+// static template 201: 201,type,time,fragment,series,value,unit
+// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#201
+var measurementTemplate201 = measurementTemplate{
+	Topic:    "s/us",
+	ID:       "201",
+	Fields:   []string{fieldType, fieldTime, fieldFragment, fieldSeries, fieldValue, fieldUnit},
+	Optional: map[string]bool{fieldTime: true, fieldUnit: true},
+}
+
+// parseMeasurementTemplate returns the template for "200", "201" or "<xid>:<templateId>"
+// custom templates need the field layout, e.g. "value,unit,time" for a template with fixed fragment and series
+func parseMeasurementTemplate(spec string, fields string) (measurementTemplate, error) {
+	switch spec {
+	case "200":
+		return measurementTemplate200, nil
+	case "201":
+		return measurementTemplate201, nil
+	}
+
+	xid, id, found := strings.Cut(spec, ":")
+	if !found || xid == "" || id == "" || strings.ContainsAny(xid, "/+#") {
+		return measurementTemplate{}, fmt.Errorf("measurement template must be 200, 201 or <xid>:<templateId>, got %q", spec)
+	}
+	if fields == "" {
+		return measurementTemplate{}, fmt.Errorf("custom measurement template %q needs a field layout", spec)
+	}
+	t := measurementTemplate{Topic: "s/uc/" + xid, ID: id, Optional: map[string]bool{fieldTime: true, fieldUnit: true}}
+	hasValue := false
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		switch field {
+		case fieldType, fieldTime, fieldFragment, fieldSeries, fieldUnit:
+		case fieldValue:
+			hasValue = true
+		default:
+			return measurementTemplate{}, fmt.Errorf("unknown field %q in measurement template layout", field)
+		}
+		t.Fields = append(t.Fields, field)
+	}
+	if !hasValue {
+		return measurementTemplate{}, fmt.Errorf("measurement template layout %q has no value field", fields)
+	}
+	return t, nil
+}
+
+// carriesType reports whether the measurement keeps its type with this template, without a type field the platform
+// takes the fragment as type. A rollup summary sent with template 200 would look like a live value otherwise
+func (t measurementTemplate) carriesType(m Measurement) bool {
+	return m.Type == "" || m.Type == m.Fragment || slices.Contains(t.Fields, fieldType)
+}
+
+// render returns the SmartREST line for the measurement
+// it fails if the measurement lacks data for a required field of the layout, or has data the layout can't carry
+func (t measurementTemplate) render(m Measurement) (string, error) {
+	values := make([]string, len(t.Fields))
+	used := map[string]bool{}
+	for i, field := range t.Fields {
+		var v string
+		switch field {
+		case fieldType:
+			v = m.Type
+			if v == "" {
+				v = m.Fragment
+			}
+		case fieldTime:
+			if !m.Time.IsZero() {
+				v = formatTimestamp(m.Time)
+			}
+		case fieldFragment:
+			v = m.Fragment
+		case fieldSeries:
+			v = m.Series
+		case fieldValue:
+			v = strconv.FormatFloat(m.Value, 'f', -1, 64)
+		case fieldUnit:
+			v = m.Unit
+		}
+		if v == "" && !t.Optional[field] {
+			return "", fmt.Errorf("template %s requires %s", t.ID, field)
+		}
+		values[i] = v
+		used[field] = true
+	}
+	// a custom template with fixed fragment/series/unit can't transport a different one
+	if !used[fieldUnit] && m.Unit != "" {
+		return "", fmt.Errorf("template %s has no unit field, but measurement has unit %q", t.ID, m.Unit)
+	}
+	if !used[fieldTime] && !m.Time.IsZero() {
+		return "", fmt.Errorf("template %s has no time field, but measurement has a time", t.ID)
+	}
+
+	for len(values) > 0 && values[len(values)-1] == "" && t.Optional[t.Fields[len(values)-1]] {
+		values = values[:len(values)-1]
+	}
+	return buildSmartRest(t.ID, values...), nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Measurement is a single measured value, e.g. fragment "c8y_Temperature", series "T", value 21.5, unit "C"
+type Measurement struct {
+	Fragment string
+	Series   string
+	Value    float64
+	Unit     string
+	// zero value means "now", the platform then uses the time of arrival
+	Time time.Time
+	// measurement type, defaults to the fragment name
+	Type string
+	// data quality of a suspect reading (good, bad, uncertain), empty if not assessed
+	// SmartREST can't carry it, measurements with a quality are published as JSON with a c8y_Quality fragment
+	Quality string
+	// where the reading was taken, set by the publisher if C8Y_ATTACH_POSITION is enabled. Also needs JSON
+	Position *Position
+	// further fragments, e.g. more series {"c8y_Voltage": map[string]MeasurementValue{"L1": {Value: 230, Unit: "V"}}}
+	// or context of the reading. Only JSON carries them, see PublishMeasurementJSON
+	Fragments map[string]any
+}
+
+// MeasurementValue is the series object of a measurement fragment
+type MeasurementValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+// properties of the measurement document that fragments can't replace
+var measurementProperties = []string{"id", "self", "source", "time", "type"}
+
+// validate checks what the platform requires of a measurement: a type and at least one series with a finite value
+// Fragment and Series may be left empty if the series are given in Fragments
+func (m Measurement) validate() error {
+	if (m.Fragment == "") != (m.Series == "") {
+		return errors.New("fragment and series must be given together")
+	}
+	if m.Fragment == "" && len(m.Fragments) == 0 {
+		return errors.New("measurement has no series")
+	}
+	if m.Fragment == "" && m.Type == "" {
+		return errors.New("measurement without fragment needs a type")
+	}
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return fmt.Errorf("value of %s.%s must be a finite number, got %v", m.Fragment, m.Series, m.Value)
+	}
+	for name := range m.Fragments {
+		if name == "" || slices.Contains(measurementProperties, name) || name == m.Fragment {
+			return fmt.Errorf("invalid fragment name %q", name)
+		}
+	}
+	return validateQuality(m.Quality)
+}
+
+// values of Measurement.Quality
+const (
+	qualityGood      = "good"
+	qualityBad       = "bad"
+	qualityUncertain = "uncertain"
+)
+
+func validateQuality(quality string) error {
+	switch quality {
+	case "", qualityGood, qualityBad, qualityUncertain:
+		return nil
+	}
+	return fmt.Errorf("quality must be good, bad or uncertain, got %q", quality)
+}
+
+// toJSON renders the measurement in the Cumulocity measurement JSON schema, as used by the REST API
+// without deviceID the source is left out, JSON over MQTT uses the device of the connection then
+func (m Measurement) toJSON(deviceID string) map[string]any {
+	t := m.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	measurementType := m.Type
+	if measurementType == "" {
+		measurementType = m.Fragment
+	}
+	doc := map[string]any{
+		"time": formatTimestamp(t),
+		"type": measurementType,
+	}
+	for name, value := range m.Fragments {
+		doc[name] = value
+	}
+	if m.Fragment != "" {
+		doc[m.Fragment] = map[string]any{m.Series: MeasurementValue{Value: m.Value, Unit: m.Unit}}
+	}
+	if deviceID != "" {
+		doc["source"] = map[string]string{"id": deviceID}
+	}
+	if m.Quality != "" {
+		doc["c8y_Quality"] = map[string]any{"status": m.Quality}
+	}
+	if m.Position != nil {
+		doc["c8y_Position"] = m.Position.fragment()
+	}
+	return doc
+}
+
+// supported values for C8Y_MEASUREMENT_TRANSPORT
+const (
+	transportMQTT = "mqtt"
+	transportREST = "rest"
+	// MQTT for regular payloads, REST for batches exceeding the MQTT payload limit
+	transportAuto = "auto"
+)
+
+// MeasurementPublisher sends measurements via SmartREST over MQTT or, as fallback, via the REST bulk endpoint
+type MeasurementPublisher struct {
+	client   mqtt.Client
+	rest     *RestClient
+	children *ChildRegistry
+
+	mu             sync.RWMutex
+	interval       time.Duration
+	minInterval    time.Duration
+	template       measurementTemplate
+	transport      string
+	maxMqttPayload int
+	restChunkSize  int
+	sensors        map[string]SensorMapping
+	precision      measurementPrecision
+	// max measurements buffered while paused
+	pauseBufferSize int
+	// nil unless telemetry is paused, see Pause
+	paused *telemetryPause
+
+	failures *PublishFailures
+	rollup   *Rollup
+}
+
+func NewMeasurementPublisher(client mqtt.Client, rest *RestClient, children *ChildRegistry, cfg Config) *MeasurementPublisher {
+	p := &MeasurementPublisher{client: client, rest: rest, children: children}
+	if cfg.PublishFailureThreshold > 0 {
+		p.failures = NewPublishFailures(client, cfg.PublishFailureThreshold)
+	}
+	p.Apply(cfg)
+	return p
+}
+
+// Apply takes over the measurement related settings, it is safe to call while measurements are published
+func (p *MeasurementPublisher) Apply(cfg Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval = cfg.MeasurementInterval
+	p.minInterval = cfg.MinInterval
+	p.template = cfg.MeasurementTemplate
+	p.transport = cfg.MeasurementTransport
+	p.maxMqttPayload = cfg.MqttMaxPayload
+	p.restChunkSize = cfg.RestChunkSize
+	p.sensors = cfg.SensorMappings
+	p.precision = cfg.MeasurementPrecision
+	p.pauseBufferSize = cfg.PauseBufferSize
+}
+
+// SetRollup feeds the measurements published for this device into the rollup, set it before publishing
+func (p *MeasurementPublisher) SetRollup(r *Rollup) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rollup = r
+}
+
+// Interval is the time between two measurement cycles
+func (p *MeasurementPublisher) Interval() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.interval
+}
+
+// NextDelay is the time until the next measurement cycle, the interval varied by the jitter but never below the minimum interval
+func (p *MeasurementPublisher) NextDelay(jitter *Jitter) time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return max(jitter.Apply(p.interval), p.minInterval)
+}
+
+func (p *MeasurementPublisher) Publish(measurements []Measurement) {
+	p.publish(measurements, "", "")
+}
+
+// PublishReadings translates raw sensor values via the sensor mapping (C8Y_SENSOR_MAPPING) and publishes them
+// readings without a mapping or with a value that can't be converted are dropped
+func (p *MeasurementPublisher) PublishReadings(readings []SensorReading) {
+	p.mu.RLock()
+	sensors := p.sensors
+	p.mu.RUnlock()
+	p.Publish(applySensorMappings(sensors, readings))
+}
+
+// PublishForChild sends the measurements on behalf of a child device of this gateway
+// SmartREST lines are published on the topic of the template with the child's external id appended (s/us/<childId>),
+// the child must have been registered before (see ChildRegistry.Register) so it exists and is linked to this device
+func (p *MeasurementPublisher) PublishForChild(childID string, measurements []Measurement) error {
+	sourceID, ok := p.children.ManagedObjectID(childID)
+	if !ok {
+		return fmt.Errorf("child device %q is not registered", childID)
+	}
+	p.publish(measurements, childID, sourceID)
+	return nil
+}
+
+// publish sends the measurements of this device (empty childID) or of the given child
+func (p *MeasurementPublisher) publish(measurements []Measurement, childID string, sourceID string) {
+	// measurements of other loops (sensors, SNMP, ...) outside the active hours are dropped as well, except rollup
+	// summaries: they cover the whole period and are due at its end, which may well be outside the active hours
+	if !activeWindow.Active(time.Now()) {
+		measurements = slices.DeleteFunc(slices.Clone(measurements), func(m Measurement) bool { return m.Type != rollupType })
+	}
+	if len(measurements) == 0 || p.hold(measurements, childID, sourceID) {
+		return
+	}
+	p.mu.RLock()
+	template, transport, maxMqttPayload, restChunkSize, precision, rollup := p.template, p.transport, p.maxMqttPayload, p.restChunkSize, p.precision, p.rollup
+	p.mu.RUnlock()
+
+	position, tracked := trackedPosition.Current()
+	lines := make([]string, 0, len(measurements))
+	valid := measurements[:0:0]
+	// measurements with details SmartREST can't carry
+	var detailed []Measurement
+	for _, m := range measurements {
+		if err := validateQuality(m.Quality); err != nil {
+			logger.Warn("Dropping measurement", "fragment", m.Fragment, "series", m.Series, "err", err)
+			continue
+		}
+		m.Value = precision.round(m)
+		if childID == "" {
+			rollup.Add(m)
+		}
+		if tracked && m.Position == nil {
+			m.Position = &position
+		}
+		if m.Quality != "" || m.Position != nil || len(m.Fragments) > 0 || !template.carriesType(m) {
+			detailed = append(detailed, m)
+			continue
+		}
+		line, err := template.render(m)
+		if err != nil {
+			logger.Warn("Dropping measurement not matching the measurement template", "fragment", m.Fragment, "series", m.Series, "err", err)
+			continue
+		}
+		lines = append(lines, line)
+		valid = append(valid, m)
+	}
+	payload := strings.Join(lines, "\n")
+
+	useRest := transport == transportREST || (transport == transportAuto && len(payload) > maxMqttPayload)
+	if !useRest {
+		if len(lines) > 0 {
+			topic := template.Topic
+			if childID != "" {
+				topic += "/" + childID
+			}
+			p.published(publishTelemetryMessage(p.client, topic, payload))
+		}
+		p.publishJSON(detailed, sourceID)
+		return
+	}
+	// the REST bulk endpoint takes JSON anyway, so the details are kept there as well
+	measurements = append(valid, detailed...)
+	if len(measurements) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if sourceID == "" {
+		var err error
+		if sourceID, err = p.rest.DeviceID(ctx); err != nil {
+			logger.Error("Failed to upload measurements via REST", "count", len(measurements), "err", err)
+			p.published(err)
+			return
+		}
+	}
+	err := p.rest.CreateMeasurements(ctx, sourceID, measurements, restChunkSize)
+	if err != nil {
+		logger.Error("Failed to upload measurements via REST", "count", len(measurements), "err", err)
+	}
+	p.published(err)
+}
+
+// PublishMeasurementJSON sends a single measurement via JSON over MQTT, for measurements SmartREST can't express
+// like several fragments in one measurement. Unlike Publish it reports an invalid measurement or a failed publish
+func (p *MeasurementPublisher) PublishMeasurementJSON(m Measurement) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now().UTC()
+	}
+	if !activeWindow.Active(time.Now()) || p.hold([]Measurement{m}, "", "") {
+		return nil
+	}
+	p.mu.RLock()
+	precision, rollup := p.precision, p.rollup
+	p.mu.RUnlock()
+	if m.Fragment != "" {
+		m.Value = precision.round(m)
+		rollup.Add(m)
+	}
+	if position, tracked := trackedPosition.Current(); tracked && m.Position == nil {
+		m.Position = &position
+	}
+	doc, err := json.Marshal(m.toJSON(""))
+	if err != nil {
+		return err
+	}
+	err = publishTelemetryJSON(p.client, "measurement/measurements/create", string(doc))
+	p.published(err)
+	return err
+}
+
+// published records the outcome of sending measurements
+func (p *MeasurementPublisher) published(err error) {
+	if err != nil {
+		p.failures.Failed(err)
+		return
+	}
+	p.failures.Succeeded()
+	provisioning.MeasurementPublished()
+}
+
+// publishJSON sends the measurements one by one via JSON over MQTT, for what SmartREST can't express
+// sourceID is the managed object id of a child device, empty for this device
+func (p *MeasurementPublisher) publishJSON(measurements []Measurement, sourceID string) {
+	for _, m := range measurements {
+		doc, err := json.Marshal(m.toJSON(sourceID))
+		if err != nil {
+			logger.Warn("Dropping measurement", "fragment", m.Fragment, "series", m.Series, "err", err)
+			continue
+		}
+		p.published(publishTelemetryJSON(p.client, "measurement/measurements/create", string(doc)))
+	}
+}
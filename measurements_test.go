@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newChildTestPublisher returns a publisher sending via MQTT, with child-1 registered as managed object 4711
+func newChildTestPublisher(t *testing.T) (*MeasurementPublisher, *recordingClient) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "children.json")
+	if err := os.WriteFile(path, []byte(`{"child-1": "4711"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := &recordingClient{}
+	children, err := NewChildRegistry(client, nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := parseMeasurementTemplate("200", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{MeasurementTemplate: template, MeasurementTransport: transportMQTT, MqttMaxPayload: 16 * 1024, RestChunkSize: 200}
+	return NewMeasurementPublisher(client, nil, children, cfg), client
+}
+
+func TestPublishForChild(t *testing.T) {
+	p, client := newChildTestPublisher(t)
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	err := p.PublishForChild("child-1", []Measurement{
+		{Fragment: "c8y_Temperature", Series: "T", Value: 21.5, Unit: "C", Time: at},
+		{Fragment: "c8y_Humidity", Series: "H", Value: 40, Unit: "%"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#200 and "Child devices" in the MQTT documentation,
+	// the child's external id is appended to the topic
+	published := client.messages("s/us/child-1")
+	want := "200,c8y_Temperature,T,21.5,C,2024-05-01T12:30:00.000Z\n200,c8y_Humidity,H,40,%"
+	if len(published) != 1 || published[0] != want {
+		t.Fatalf("published %q on s/us/child-1, want %q", published, want)
+	}
+	if own := client.messages("s/us"); len(own) > 0 {
+		t.Errorf("child measurements published for the device itself: %q", own)
+	}
+}
+
+func TestPublishForChildDetailedMeasurement(t *testing.T) {
+	p, client := newChildTestPublisher(t)
+	// SmartREST can't carry the quality, the measurement goes out as JSON with the child as source
+	err := p.PublishForChild("child-1", []Measurement{{Fragment: "c8y_Temperature", Series: "T", Value: 21.5, Unit: "C", Quality: "uncertain"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := client.messages("measurement/measurements/create")
+	if len(published) != 1 {
+		t.Fatalf("published %q, want one JSON measurement", published)
+	}
+	var doc struct {
+		Source struct {
+			ID string `json:"id"`
+		} `json:"source"`
+	}
+	if err := json.Unmarshal([]byte(published[0]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Source.ID != "4711" {
+		t.Errorf("source.id = %q, want the managed object id of the child 4711", doc.Source.ID)
+	}
+}
+
+func TestPublishForChildNotRegistered(t *testing.T) {
+	p, client := newChildTestPublisher(t)
+	err := p.PublishForChild("child-2", []Measurement{{Fragment: "c8y_Temperature", Series: "T", Value: 21.5, Unit: "C"}})
+	if err == nil || err.Error() != `child device "child-2" is not registered` {
+		t.Fatalf("err = %v, want the child to be reported as not registered", err)
+	}
+	if len(client.published) > 0 {
+		t.Errorf("published %v for a child that isn't registered", client.published)
+	}
+}
+
+// setInactiveWindow sets an active window not containing the current time for the test
+func setInactiveWindow(t *testing.T) {
+	t.Helper()
+	tomorrow := strings.ToLower(time.Now().UTC().AddDate(0, 0, 1).Weekday().String()[:3])
+	window, err := parseActiveWindow([]string{tomorrow + " 00:00-23:59"}, "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeWindow = window
+	t.Cleanup(func() { activeWindow = nil })
+}
+
+func TestPublishOutsideActiveWindow(t *testing.T) {
+	setInactiveWindow(t)
+	p, client := newChildTestPublisher(t)
+	p.Publish([]Measurement{{Fragment: "c8y_Temperature", Series: "T", Value: 21.5, Unit: "C"}})
+	if err := p.PublishMeasurementJSON(Measurement{Fragment: "c8y_Temperature", Series: "T", Value: 21.5, Unit: "C"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.published) > 0 {
+		t.Errorf("published %v outside the active hours", client.published)
+	}
+}
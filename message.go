@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// the platform has no static template for c8y_Message (and custom operations), they are only delivered as JSON on this topic
+const operationNotificationsTopic = "devicecontrol/notifications"
+
+// MessageSink shows the text of c8y_Message operations to the people at the device, implement it for your display
+// the text may span several lines and contain any unicode characters, line breaks are normalized to "\n"
+type MessageSink interface {
+	ShowMessage(text string) error
+}
+
+// logMessageSink writes the messages to the log, for devices without display
+type logMessageSink struct{}
+
+func (logMessageSink) ShowMessage(text string) error {
+	logger.Info("Message from the platform", "text", text)
+	return nil
+}
+
+// jsonOperation is the part of an operation on devicecontrol/notifications the client reads
+// all operations of the device (and its children) are delivered there, also those arriving on s/ds as well
+type jsonOperation struct {
+	ID             string `json:"id"`
+	ExternalSource *struct {
+		ExternalID string `json:"externalId"`
+	} `json:"externalSource"`
+	Message *struct {
+		Text *string `json:"text"`
+	} `json:"c8y_Message"`
+	// custom operation without parameters, see republishProperties
+	RepublishProperties *json.RawMessage `json:"c8y_RepublishProperties"`
+}
+
+// jsonOperationID returns the id of a JSON operation, empty if it has none or isn't valid JSON
+func jsonOperationID(payload []byte) string {
+	var op jsonOperation
+	if err := json.Unmarshal(payload, &op); err != nil {
+		return ""
+	}
+	return op.ID
+}
+
+// jsonOperationRecord translates a c8y_Message operation into the record c8y_Message,serial,text and a
+// c8y_RepublishProperties operation into c8y_RepublishProperties,serial, handled like static templates.
+// ok is false for other operations and the operations of child devices, which are none of the handlers' business
+func jsonOperationRecord(payload []byte, serial string) (record []string, ok bool, err error) {
+	var op jsonOperation
+	if err := json.Unmarshal(payload, &op); err != nil {
+		return nil, false, fmt.Errorf("invalid JSON operation: %w", err)
+	}
+	if op.ExternalSource != nil && op.ExternalSource.ExternalID != "" && op.ExternalSource.ExternalID != serial {
+		return nil, false, nil
+	}
+	if op.RepublishProperties != nil {
+		return []string{"c8y_RepublishProperties", serial}, true, nil
+	}
+	if op.Message == nil {
+		return nil, false, nil
+	}
+	// a message without text is passed on as well, the handler fails it like any other invalid operation
+	text := ""
+	if op.Message.Text != nil {
+		text = strings.ReplaceAll(*op.Message.Text, "\r\n", "\n")
+	}
+	return []string{"c8y_Message", serial, text}, true, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// supported values for C8Y_AUTH_MODE
+const (
+	authBasic = "basic"
+	authCert  = "cert"
+	// client certificate for the TLS handshake plus username/password, only needed for special broker setups
+	authBoth = "both"
+)
+
+// buildClientOptions turns the configuration into paho client options
+// all combinations that would only fail later during connect (or silently use the wrong auth) are rejected here
+func buildClientOptions(cfg Config) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("no broker configured")
+	}
+	for _, broker := range cfg.Brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker address %q: %w", broker, err)
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+		default:
+			return nil, fmt.Errorf("unsupported scheme %q in broker address %q", u.Scheme, broker)
+		}
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("broker address %q has no host", broker)
+		}
+		opts.AddBroker(broker)
+	}
+
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("client id must not be empty")
+	}
+	opts.SetClientID(cfg.ClientID)
+
+	authMode, err := resolveAuthMode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if authMode == authBasic || authMode == authBoth {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+	tlsConfig, err := buildTLSConfig(cfg, authMode)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if cfg.KeepAlive <= 0 || cfg.ConnectTimeout <= 0 {
+		return nil, fmt.Errorf("keepalive and connect timeout must be positive")
+	}
+	opts.SetKeepAlive(cfg.KeepAlive)
+	opts.SetConnectTimeout(cfg.ConnectTimeout)
+	opts.SetAutoReconnect(cfg.AutoReconnect)
+	opts.SetMaxReconnectInterval(cfg.MaxReconnectInterval)
+
+	// Cumulocity publishes the last will when the device disconnects without saying goodbye, e.g. to create an event
+	if cfg.WillMessage != "" {
+		opts.SetWill("s/us", cfg.WillMessage, 1, false)
+	}
+
+	// with a file store QoS 1 messages that weren't acknowledged yet survive a restart of the process
+	if cfg.StoreDir != "" {
+		opts.SetStore(mqtt.NewFileStore(cfg.StoreDir))
+	}
+
+	if err := applySubscribeQoS(cfg.Subscriptions, cfg.SubscribeQoS); err != nil {
+		return nil, err
+	}
+	for _, s := range cfg.Subscriptions {
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("invalid subscription: %w", err)
+		}
+	}
+	// with a persistent session the broker keeps the subscriptions, the connection is opened by the client to learn
+	// whether it resumed the session (paho only tells for the first connect)
+	opts.SetCleanSession(cfg.CleanSession)
+	sessions := &sessionTracker{}
+	if !cfg.CleanSession {
+		opts.SetCustomOpenConnectionFn(sessions.openConnection)
+	}
+	// subscriptions are made on every connect unless the broker resumed the session, so they are restored after a
+	// reconnect with a clean session
+	opts.OnConnect = func(client mqtt.Client) {
+		connectHandler(client)
+		sessionPresent := !cfg.CleanSession && sessions.Present()
+		if sessionPresent {
+			logger.Info("Broker resumed the session, keeping its subscriptions")
+			routeAll(client, cfg.Subscriptions, cfg.InboundMaxSize)
+		} else {
+			subscribeAll(client, cfg.Subscriptions, cfg.InboundMaxSize)
+		}
+		quotaGuard.Restored(client)
+		outages.Connected(client)
+		networkMonitor.Refresh()
+		if OnReady != nil {
+			OnReady(client, sessionPresent)
+		}
+	}
+	// reconnecting right away after being disconnected for the tenant's quota only gets the device disconnected again
+	opts.SetConnectionNotificationHandler(func(client mqtt.Client, n mqtt.ConnectionNotification) {
+		switch n := n.(type) {
+		case mqtt.ConnectionNotificationLost:
+			quotaGuard.Observe(n.Reason)
+		case mqtt.ConnectionNotificationFailed:
+			quotaGuard.Observe(n.Reason)
+			outages.AttemptFailed()
+		}
+	})
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		quotaGuard.Wait()
+	})
+	opts.OnConnectionLost = connectLostHandler
+	return opts, nil
+}
+
+// resolveAuthMode returns the configured auth mode, or derives it from the given credentials
+func resolveAuthMode(cfg Config) (string, error) {
+	hasBasic := cfg.Username != "" || cfg.Password != ""
+	hasCert := cfg.ClientCert != "" || cfg.ClientKey != "" || cfg.PKCS11Module != ""
+	// with PKCS#11 the key is on the token, the certificate may be as well
+	if cfg.PKCS11Module == "" && (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		return "", fmt.Errorf("client certificate and key must be configured together")
+	}
+
+	switch cfg.AuthMode {
+	case "":
+		if hasBasic && hasCert {
+			return "", fmt.Errorf("both username/password and client certificate are configured, set C8Y_AUTH_MODE to basic, cert or both")
+		}
+		if hasCert {
+			return authCert, nil
+		}
+		if !hasBasic {
+			return "", fmt.Errorf("no credentials configured")
+		}
+		return authBasic, nil
+	case authBasic:
+		if cfg.Username == "" || cfg.Password == "" {
+			return "", fmt.Errorf("auth mode basic needs username and password")
+		}
+	case authCert:
+		if !hasCert {
+			return "", fmt.Errorf("auth mode cert needs client certificate and key")
+		}
+	case authBoth:
+		if cfg.Username == "" || cfg.Password == "" || !hasCert {
+			return "", fmt.Errorf("auth mode both needs username, password, client certificate and key")
+		}
+	default:
+		return "", fmt.Errorf("C8Y_AUTH_MODE must be one of basic, cert, both, got %q", cfg.AuthMode)
+	}
+	return cfg.AuthMode, nil
+}
+
+// buildTLSConfig returns nil if the defaults of paho (system CAs, no client certificate) are fine
+func buildTLSConfig(cfg Config, authMode string) (*tls.Config, error) {
+	if cfg.CACert == "" && authMode == authBasic {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if authMode == authCert || authMode == authBoth {
+		var cert tls.Certificate
+		var err error
+		if cfg.PKCS11Module != "" {
+			cert, err = loadPKCS11Certificate(cfg)
+		} else {
+			cert, err = tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validOptionsConfig is the smallest configuration buildClientOptions accepts, with basic auth
+func validOptionsConfig() Config {
+	return Config{
+		Brokers:        []string{"mqtts://mqtt.eu-latest.cumulocity.com:8883"},
+		ClientID:       "DeviceSerial",
+		Username:       "t12345/device",
+		Password:       "secret",
+		KeepAlive:      60 * time.Second,
+		ConnectTimeout: 30 * time.Second,
+		CleanSession:   true,
+	}
+}
+
+// writeTestKeyPair writes a self-signed client certificate and its key as PEM files
+func writeTestKeyPair(t *testing.T) (certFile string, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "DeviceSerial"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestBuildClientOptionsBasicAuth(t *testing.T) {
+	cfg := validOptionsConfig()
+	cfg.Brokers = append(cfg.Brokers, "mqtts://mqtt.eu-latest-2.cumulocity.com:8883")
+	cfg.AutoReconnect = true
+	cfg.MaxReconnectInterval = 2 * time.Minute
+	cfg.WillMessage = "400,c8y_ConnectionLost,Connection lost"
+	opts, err := buildClientOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Servers) != 2 || opts.Servers[0].Host != "mqtt.eu-latest.cumulocity.com:8883" {
+		t.Errorf("servers = %v, want both brokers in order", opts.Servers)
+	}
+	if opts.ClientID != "DeviceSerial" || opts.Username != "t12345/device" || opts.Password != "secret" {
+		t.Errorf("client id %q, username %q, password %q don't match the configuration", opts.ClientID, opts.Username, opts.Password)
+	}
+	if opts.KeepAlive != 60 || opts.ConnectTimeout != 30*time.Second {
+		t.Errorf("keepalive %ds, connect timeout %s don't match the configuration", opts.KeepAlive, opts.ConnectTimeout)
+	}
+	if !opts.AutoReconnect || opts.MaxReconnectInterval != 2*time.Minute {
+		t.Errorf("auto reconnect %t every %s doesn't match the configuration", opts.AutoReconnect, opts.MaxReconnectInterval)
+	}
+	if !opts.WillEnabled || opts.WillTopic != "s/us" || string(opts.WillPayload) != cfg.WillMessage || opts.WillQos != 1 {
+		t.Errorf("will on %q with %q (QoS %d) doesn't match the configuration", opts.WillTopic, opts.WillPayload, opts.WillQos)
+	}
+	if !opts.CleanSession {
+		t.Error("clean session not set")
+	}
+	// basic auth without own CA uses the defaults of paho
+	if opts.TLSConfig != nil {
+		t.Errorf("unexpected TLS config %+v", opts.TLSConfig)
+	}
+	if opts.OnConnect == nil || opts.OnConnectionLost == nil {
+		t.Error("connection handlers not set")
+	}
+}
+
+func TestBuildClientOptionsCertAuth(t *testing.T) {
+	certFile, keyFile := writeTestKeyPair(t)
+	cfg := validOptionsConfig()
+	cfg.Username, cfg.Password = "", ""
+	cfg.ClientCert, cfg.ClientKey = certFile, keyFile
+	opts, err := buildClientOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Username != "" || opts.Password != "" {
+		t.Errorf("username %q and password set with certificate auth", opts.Username)
+	}
+	if opts.TLSConfig == nil || len(opts.TLSConfig.Certificates) != 1 {
+		t.Fatalf("client certificate not in the TLS config")
+	}
+
+	// with both the certificate is used for the handshake and the credentials are sent as well
+	cfg.Username, cfg.Password, cfg.AuthMode = "t12345/device", "secret", authBoth
+	if opts, err = buildClientOptions(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Username != "t12345/device" || opts.TLSConfig == nil || len(opts.TLSConfig.Certificates) != 1 {
+		t.Errorf("auth mode both needs the credentials and the certificate")
+	}
+}
+
+func TestBuildClientOptionsInvalid(t *testing.T) {
+	certFile, keyFile := writeTestKeyPair(t)
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		wantErr string
+	}{
+		{"no broker", func(cfg *Config) { cfg.Brokers = nil }, "no broker configured"},
+		{"unsupported scheme", func(cfg *Config) { cfg.Brokers = []string{"http://mqtt.example.com"} }, `unsupported scheme "http"`},
+		{"no host", func(cfg *Config) { cfg.Brokers = []string{"mqtts://:8883"} }, "has no host"},
+		{"empty client id", func(cfg *Config) { cfg.ClientID = "" }, "client id must not be empty"},
+		{"no credentials", func(cfg *Config) { cfg.Username, cfg.Password = "", "" }, "no credentials configured"},
+		{"certificate without key", func(cfg *Config) { cfg.ClientCert = certFile }, "must be configured together"},
+		{"credentials and certificate without intent", func(cfg *Config) { cfg.ClientCert, cfg.ClientKey = certFile, keyFile }, "set C8Y_AUTH_MODE"},
+		{"basic without password", func(cfg *Config) { cfg.AuthMode, cfg.Password = authBasic, "" }, "auth mode basic needs username and password"},
+		{"cert without certificate", func(cfg *Config) { cfg.AuthMode = authCert }, "auth mode cert needs client certificate and key"},
+		{"both without certificate", func(cfg *Config) { cfg.AuthMode = authBoth }, "auth mode both needs"},
+		{"unknown auth mode", func(cfg *Config) { cfg.AuthMode = "token" }, "C8Y_AUTH_MODE must be one of"},
+		{"unreadable CA", func(cfg *Config) { cfg.CACert = filepath.Join(t.TempDir(), "missing.pem") }, "reading CA certificate"},
+		{"CA without certificate", func(cfg *Config) { cfg.CACert = keyFile }, "no certificate found"},
+		{"zero keepalive", func(cfg *Config) { cfg.KeepAlive = 0 }, "keepalive and connect timeout must be positive"},
+		{"invalid subscription", func(cfg *Config) {
+			cfg.Subscriptions = []Subscription{{Topic: "s/#/x", QoS: 1, Handler: handleErrorMessage}}
+		}, "'#' must be the last topic level"},
+		{"QoS for unknown topic", func(cfg *Config) { cfg.SubscribeQoS = map[string]byte{"s/ds": 0} }, "not subscribed to topic s/ds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validOptionsConfig()
+			tt.modify(&cfg)
+			_, err := buildClientOptions(cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// connection types of NetworkInfo
+const (
+	connEthernet = "ethernet"
+	connWifi     = "wifi"
+	connCellular = "cellular"
+)
+
+// NetworkInfo is the network configuration of the device, as far as the source knows it
+type NetworkInfo struct {
+	Interface      string
+	IP             string
+	Netmask        string
+	MAC            string
+	Gateway        string
+	ConnectionType string
+	// nil unless the source knows the modem
+	Mobile *MobileInfo
+}
+
+// MobileInfo is the state of the cellular modem
+type MobileInfo struct {
+	IMEI             string
+	Operator         string
+	AccessTechnology string
+	APN              string
+	// percent
+	SignalQuality int
+}
+
+// NetworkInfoSource reads the network configuration, implement it for devices with their own connection manager
+type NetworkInfoSource interface {
+	NetworkInfo(ctx context.Context) (NetworkInfo, error)
+}
+
+// OSNetworkInfo takes the network configuration from the interface the broker is reached through, it works on every
+// platform. The default gateway is read from /proc/net/route, the modem (with modem set) from ModemManager via mmcli
+type OSNetworkInfo struct {
+	// broker address the outbound interface is looked up for
+	address string
+	modem   bool
+}
+
+func NewOSNetworkInfo(broker string, modem bool) (*OSNetworkInfo, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	return &OSNetworkInfo{address: net.JoinHostPort(u.Hostname(), brokerPort(u)), modem: modem}, nil
+}
+
+func (s *OSNetworkInfo) NetworkInfo(ctx context.Context) (NetworkInfo, error) {
+	// connecting a UDP socket only picks the route, nothing is sent
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", s.address)
+	if err != nil {
+		return NetworkInfo{}, fmt.Errorf("no route to %s: %w", s.address, err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	info := NetworkInfo{IP: local.String()}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return info, err
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(local) {
+				info.Interface = iface.Name
+				info.MAC = iface.HardwareAddr.String()
+				info.Netmask = net.IP(ipNet.Mask).String()
+			}
+		}
+	}
+	info.ConnectionType = connectionType(info.Interface)
+	info.Gateway = defaultGateway(info.Interface)
+	if s.modem {
+		if info.Mobile, err = readModemManager(ctx); err != nil {
+			logger.Warn("Failed to read the modem state", "err", err)
+		} else {
+			info.ConnectionType = connCellular
+		}
+	}
+	return info, nil
+}
+
+// connectionType guesses the type of connection from the usual interface names
+func connectionType(name string) string {
+	if _, err := os.Stat("/sys/class/net/" + name + "/wireless"); err == nil {
+		return connWifi
+	}
+	if strings.HasPrefix(name, "wl") {
+		return connWifi
+	}
+	for _, prefix := range []string{"ww", "ppp", "rmnet"} {
+		if strings.HasPrefix(name, prefix) {
+			return connCellular
+		}
+	}
+	return connEthernet
+}
+
+// defaultGateway reads the default route of the interface from /proc/net/route, empty if there is none (or no procfs)
+func defaultGateway(iface string) string {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., addresses are hex in host byte order
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != iface || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		gateway := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(gateway, binary.BigEndian.Uint32(raw))
+		return gateway.String()
+	}
+	return ""
+}
+
+// readModemManager asks ModemManager for the state of the first modem and the APN of its first bearer
+func readModemManager(ctx context.Context) (*MobileInfo, error) {
+	var modem struct {
+		Modem struct {
+			ThreeGPP struct {
+				IMEI     string `json:"imei"`
+				Operator string `json:"operator-name"`
+			} `json:"3gpp"`
+			Generic struct {
+				AccessTechnologies []string `json:"access-technologies"`
+				SignalQuality      struct {
+					Value string `json:"value"`
+				} `json:"signal-quality"`
+				Bearers []string `json:"bearers"`
+			} `json:"generic"`
+		} `json:"modem"`
+	}
+	if err := mmcli(ctx, &modem, "-m", "any"); err != nil {
+		return nil, err
+	}
+	m := modem.Modem
+	info := &MobileInfo{IMEI: m.ThreeGPP.IMEI, Operator: m.ThreeGPP.Operator, AccessTechnology: strings.Join(m.Generic.AccessTechnologies, ",")}
+	info.SignalQuality, _ = strconv.Atoi(m.Generic.SignalQuality.Value)
+	if len(m.Generic.Bearers) > 0 {
+		var bearer struct {
+			Bearer struct {
+				Properties struct {
+					APN string `json:"apn"`
+				} `json:"properties"`
+			} `json:"bearer"`
+		}
+		if err := mmcli(ctx, &bearer, "-b", m.Generic.Bearers[0]); err != nil {
+			logger.Debug("Failed to read the bearer of the modem", "err", err)
+		} else {
+			info.APN = bearer.Bearer.Properties.APN
+		}
+	}
+	return info, nil
+}
+
+func mmcli(ctx context.Context, v any, args ...string) error {
+	output, err := exec.CommandContext(ctx, "mmcli", append(args, "-J")...).Output()
+	if err != nil {
+		return fmt.Errorf("mmcli %s: %w", strings.Join(args, " "), err)
+	}
+	return json.Unmarshal(output, v)
+}
+
+// NetworkMonitor publishes the network configuration as c8y_Network (and c8y_Mobile) fragment whenever it changed
+// it is read on every interval and after every connect, a reconnect often comes with a changed network
+type NetworkMonitor struct {
+	client  mqtt.Client
+	serial  string
+	source  NetworkInfoSource
+	refresh chan struct{}
+	last    string
+}
+
+func NewNetworkMonitor(client mqtt.Client, serial string, source NetworkInfoSource) *NetworkMonitor {
+	return &NetworkMonitor{client: client, serial: serial, source: source, refresh: make(chan struct{}, 1)}
+}
+
+// Refresh reads the network configuration right away, nil-safe and non-blocking
+func (n *NetworkMonitor) Refresh() {
+	if n == nil {
+		return
+	}
+	select {
+	case n.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *NetworkMonitor) Run(ctx context.Context, interval time.Duration) {
+	for {
+		n.update(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.refresh:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (n *NetworkMonitor) update(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	info, err := n.source.NetworkInfo(ctx)
+	if err != nil {
+		logger.Warn("Failed to read the network configuration", "err", err)
+		return
+	}
+	doc, err := json.Marshal(networkFragments(info))
+	if err != nil || string(doc) == n.last {
+		return
+	}
+	if err := publishJsonViaMqttMessage(n.client, "inventory/managedObjects/update/"+n.serial, string(doc)); err != nil {
+		logger.Warn("Failed to publish the network configuration", "err", err)
+		return
+	}
+	logger.Info("Published network configuration", "interface", info.Interface, "ip", info.IP, "type", info.ConnectionType)
+	n.last = string(doc)
+}
+
+// networkFragments renders the info in the structure of the platform's standard fragments
+func networkFragments(info NetworkInfo) map[string]any {
+	network := map[string]any{
+		"connectionType": info.ConnectionType,
+		"c8y_LAN": map[string]any{
+			"name":    info.Interface,
+			"ip":      info.IP,
+			"netmask": info.Netmask,
+			"mac":     info.MAC,
+			"gateway": info.Gateway,
+			"enabled": 1,
+		},
+	}
+	fragments := map[string]any{"c8y_Network": network}
+	if m := info.Mobile; m != nil {
+		network["c8y_WAN"] = map[string]any{"apn": m.APN}
+		fragments["c8y_Mobile"] = map[string]any{
+			"imei":            m.IMEI,
+			"currentOperator": m.Operator,
+			"connType":        m.AccessTechnology,
+			"signalQuality":   m.SignalQuality,
+		}
+	}
+	return fragments
+}
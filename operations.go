@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// operationMinFields is the number of CSV fields (including the template id) a handler indexes into
+// the platform may append fields to a template in future versions, additional trailing fields are ignored
+var operationMinFields = map[string]int{
+	"510": 2, // 510,serial
+	"511": 3, // 511,serial,command
+	"515": 5, // 515,serial,name,version,url
+	"518": 3, // 518,serial,state
+	"519": 3, // 519,serial,state...
+	"522": 7, // 522,serial,logfile,start,end,searchText,maxLines
+	"528": 2, // 528,serial,[name,version,url,action]...
+	"530": 5, // 530,serial,host,port,connectionKey
+	// no static template, translated from the JSON operation by jsonOperationRecord
+	"c8y_Message":             3, // c8y_Message,serial,text
+	"c8y_RepublishProperties": 2, // c8y_RepublishProperties,serial
+}
+
+// operationFragments maps the operation templates to the fragment used to report their status (501/502/503)
+var operationFragments = map[string]string{
+	"510":                     "c8y_Restart",
+	"511":                     "c8y_Command",
+	"515":                     "c8y_Firmware",
+	"518":                     "c8y_Relay",
+	"519":                     "c8y_RelayArray",
+	"522":                     "c8y_LogfileRequest",
+	"528":                     "c8y_SoftwareUpdate",
+	"530":                     "c8y_RemoteAccessConnect",
+	"c8y_Message":             "c8y_Message",
+	"c8y_RepublishProperties": "c8y_RepublishProperties",
+}
+
+// reportOperationReceived publishes a c8y_OperationReceived event for the operation, before it is queued or executed
+// only the operation and its number of fields are reported, arguments like shell commands or download URLs stay on the device
+func reportOperationReceived(client mqtt.Client, templateId string, payload []byte) {
+	if templateId == "" {
+		return
+	}
+	name, ok := operationFragments[templateId]
+	if !ok {
+		name = "template " + templateId
+	}
+	fields := 0
+	if records, err := parseSmartRest(payload); err == nil && len(records) > 0 {
+		fields = len(records[0])
+	}
+	err := publishEvent(client, Event{
+		Type: "c8y_OperationReceived",
+		Text: "Received operation " + name,
+		Fragments: map[string]any{
+			"c8y_OperationReceived": map[string]any{"templateId": templateId, "operation": name, "fields": fields},
+		},
+	})
+	if err != nil {
+		logger.Warn("Failed to report received operation", "templateId", templateId, "err", err)
+	}
+}
+
+// checkOperationFields returns an error if the record is too short for the handler of its template
+func checkOperationFields(record []string) error {
+	if len(record) == 0 {
+		return fmt.Errorf("empty operation")
+	}
+	if min, ok := operationMinFields[record[0]]; ok && len(record) < min {
+		return fmt.Errorf("operation %s has %d fields, expected at least %d", record[0], len(record), min)
+	}
+	return nil
+}
+
+// logfileRequest is the typed form of a 522 log file retrieval operation
+type logfileRequest struct {
+	Serial     string
+	LogFile    string
+	StartDate  string
+	EndDate    string
+	SearchText string
+	MaxLines   int
+}
+
+// parseLogfileRequest parses 522,serial,logfile,start,end,searchText,maxLines
+func parseLogfileRequest(record []string) (logfileRequest, error) {
+	if err := checkOperationFields(record); err != nil {
+		return logfileRequest{}, err
+	}
+	maxLines, err := strconv.Atoi(record[6])
+	if err != nil || maxLines < 0 {
+		return logfileRequest{}, fmt.Errorf("invalid maxLines %q", record[6])
+	}
+	return logfileRequest{
+		Serial:     record[1],
+		LogFile:    record[2],
+		StartDate:  record[3],
+		EndDate:    record[4],
+		SearchText: record[5],
+		MaxLines:   maxLines,
+	}, nil
+}
+
+// checkDownloadURL checks the URL of a firmware or software download before anything is downloaded
+func checkDownloadURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is no http(s) URL", raw)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogfileRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    logfileRequest
+		wantErr string
+	}{
+		{
+			name:    "all fields",
+			payload: `522,DeviceSerial,syslog,2024-01-01T00:00:00+0000,2024-01-02T00:00:00+0000,"error, warning",1000`,
+			want:    logfileRequest{Serial: "DeviceSerial", LogFile: "syslog", StartDate: "2024-01-01T00:00:00+0000", EndDate: "2024-01-02T00:00:00+0000", SearchText: "error, warning", MaxLines: 1000},
+		},
+		{
+			name:    "no search text, no line limit",
+			payload: "522,DeviceSerial,syslog,2024-01-01T00:00:00+0000,2024-01-02T00:00:00+0000,,0",
+			want:    logfileRequest{Serial: "DeviceSerial", LogFile: "syslog", StartDate: "2024-01-01T00:00:00+0000", EndDate: "2024-01-02T00:00:00+0000"},
+		},
+		{name: "maxLines not a number", payload: "522,DeviceSerial,syslog,a,b,,many", wantErr: `invalid maxLines "many"`},
+		{name: "negative maxLines", payload: "522,DeviceSerial,syslog,a,b,,-1", wantErr: `invalid maxLines "-1"`},
+		{name: "empty maxLines", payload: "522,DeviceSerial,syslog,a,b,,", wantErr: `invalid maxLines ""`},
+		{name: "missing fields", payload: "522,DeviceSerial,syslog", wantErr: "operation 522 has 3 fields, expected at least 7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := parseSmartRest([]byte(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := parseLogfileRequest(records[0])
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req != tt.want {
+				t.Errorf("got %+v, want %+v", req, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogfileRequestFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		// logRetriever for the test, nil if not ready
+		retriever func(t *testing.T) *LogRetriever
+		// messages expected on s/us
+		published []string
+	}{
+		{
+			// an invalid operation is set to executing and failed right away, a 502 alone would leave it PENDING
+			name:      "invalid",
+			payload:   "522,DeviceSerial,syslog,a,b,,many",
+			published: []string{"501,c8y_LogfileRequest", `502,c8y_LogfileRequest,"C8Y-OP-INVALID: Invalid operation: invalid maxLines ""many"""`},
+		},
+		{
+			name:      "not ready",
+			payload:   "522,DeviceSerial,syslog,2024-01-01T00:00:00+0000,2024-01-02T00:00:00+0000,,10",
+			published: []string{"501,c8y_LogfileRequest", "502,c8y_LogfileRequest,C8Y-DEVICE-STARTING: Device is still starting"},
+		},
+		{
+			// a line over the scanner buffer must not cut the log off silently
+			name:    "line too long",
+			payload: "522,DeviceSerial,syslog,,,,0",
+			retriever: func(t *testing.T) *LogRetriever {
+				path := filepath.Join(t.TempDir(), "syslog")
+				content := "first line\n" + strings.Repeat("x", 2*1024*1024) + "\nlast line\n"
+				if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				return NewLogRetriever(map[string]LogSource{"syslog": {Path: path}}, nil)
+			},
+			published: []string{"501,c8y_LogfileRequest", "502,c8y_LogfileRequest,C8Y-LOG-RETRIEVAL-FAILED: Retrieving log file syslog failed: reading log file syslog: bufio.Scanner: token too long"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logRetriever = nil
+			if tt.retriever != nil {
+				logRetriever = tt.retriever(t)
+			}
+			t.Cleanup(func() { logRetriever = nil })
+			client, status := handleOperation(t, []byte(tt.payload))
+			if status != "FAILED" {
+				t.Errorf("status = %q, want FAILED", status)
+			}
+			if published := client.messages("s/us"); strings.Join(published, "\n") != strings.Join(tt.published, "\n") {
+				t.Errorf("published %q, want %q", published, tt.published)
+			}
+		})
+	}
+}
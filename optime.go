@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// OperationTimes finds out when an operation was created, to tell how long it waited before the device picked it up
+// the static operation templates don't carry any timestamp, so the creation time is taken from the oldest pending operation
+// with the same fragment, which is the one the platform delivered first
+type OperationTimes struct {
+	rest         *RestClient
+	measurements *MeasurementPublisher
+}
+
+func NewOperationTimes(rest *RestClient, measurements *MeasurementPublisher) *OperationTimes {
+	return &OperationTimes{rest: rest, measurements: measurements}
+}
+
+// PickedUp looks up the creation time of the operation, logs the latency until pickedUp and publishes it as
+// c8y_OperationLatency measurement. A zero time is returned if the creation time is unknown
+func (o *OperationTimes) PickedUp(templateId string, pickedUp time.Time) time.Time {
+	fragment, ok := operationFragments[templateId]
+	if o == nil || !ok {
+		return time.Time{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	created, err := o.rest.PendingOperationCreated(ctx, fragment)
+	if err != nil {
+		logger.Debug("Creation time of operation unknown", "templateId", templateId, "err", err)
+		return time.Time{}
+	}
+	latency := max(pickedUp.Sub(created), 0)
+	logger.Info("Operation picked up", "templateId", templateId, "created", created, "latency", latency)
+	o.measurements.Publish([]Measurement{{Fragment: "c8y_OperationLatency", Series: fragment, Value: latency.Seconds(), Unit: "s"}})
+	return created
+}
+
+// PendingOperationCreated returns the creation time of the oldest pending operation of this device with the given fragment
+func (r *RestClient) PendingOperationCreated(ctx context.Context, fragment string) (time.Time, error) {
+	deviceID, err := r.DeviceID(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var page struct {
+		Operations []struct {
+			CreationTime string `json:"creationTime"`
+		} `json:"operations"`
+	}
+	query := url.Values{"deviceId": {deviceID}, "fragmentType": {fragment}, "status": {"PENDING"}, "pageSize": {"1"}}
+	if err := r.do(ctx, http.MethodGet, "/devicecontrol/operations?"+query.Encode(), "", nil, &page); err != nil {
+		return time.Time{}, err
+	}
+	if len(page.Operations) == 0 {
+		return time.Time{}, fmt.Errorf("no pending %s operation", fragment)
+	}
+	created, err := time.Parse(time.RFC3339Nano, page.Operations[0].CreationTime)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid creationTime %q: %w", page.Operations[0].CreationTime, err)
+	}
+	return created, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// OutageTracker measures how long the device was offline and how many reconnect attempts failed meanwhile
+// every outage is reported with a c8y_Outage event once connected again, outages exceeding a threshold
+// (C8Y_OUTAGE_ALARMS) additionally raise an alarm whose severity grows with the duration
+// the outage is persisted, so it is also reported if the process restarted (or the device rebooted) while offline
+type OutageTracker struct {
+	path       string
+	thresholds []outageThreshold
+
+	mu    sync.Mutex
+	state outageState
+}
+
+type outageState struct {
+	Since    time.Time `json:"since"`
+	Attempts int       `json:"attempts"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// outageThreshold raises an alarm of the severity for outages lasting at least After
+type outageThreshold struct {
+	After    time.Duration
+	Severity string
+}
+
+func NewOutageTracker(path string, thresholds []outageThreshold) *OutageTracker {
+	o := &OutageTracker{path: path, thresholds: thresholds}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Failed to read outage state", "path", path, "err", err)
+		}
+		return o
+	}
+	if err := json.Unmarshal(data, &o.state); err != nil {
+		logger.Warn("Ignoring invalid outage state", "path", path, "err", err)
+	}
+	return o
+}
+
+// Lost starts an outage, called when the connection is lost
+func (o *OutageTracker) Lost(reason error) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.state.Since.IsZero() {
+		o.state = outageState{Since: time.Now().UTC()}
+		if reason != nil {
+			o.state.Reason = reason.Error()
+		}
+	}
+	o.save()
+}
+
+// AttemptFailed counts a failed reconnect attempt of the current outage
+func (o *OutageTracker) AttemptFailed() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.state.Since.IsZero() {
+		return
+	}
+	o.state.Attempts++
+	o.save()
+}
+
+// Connected reports the outage that just ended, if there was one
+func (o *OutageTracker) Connected(client mqtt.Client) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	outage := o.state
+	o.state = outageState{}
+	if err := os.Remove(o.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warn("Failed to remove outage state", "path", o.path, "err", err)
+	}
+	o.mu.Unlock()
+	if outage.Since.IsZero() {
+		return
+	}
+
+	duration := time.Since(outage.Since).Round(time.Second)
+	details := map[string]any{"since": formatTimestamp(outage.Since), "durationSeconds": int(duration.Seconds()), "failedAttempts": outage.Attempts}
+	if outage.Reason != "" {
+		details["reason"] = outage.Reason
+	}
+	text := fmt.Sprintf("Connection was down for %s (%d failed reconnect attempts)", duration, outage.Attempts)
+	logger.Info("Connection restored", "outage", duration, "failedAttempts", outage.Attempts)
+	if err := publishEvent(client, Event{Type: "c8y_Outage", Text: text, Fragments: map[string]any{"c8y_Outage": details}}); err != nil {
+		logger.Warn("Failed to report outage", "err", err)
+	}
+	if severity := o.severity(duration); severity != "" {
+		err := RaiseAlarm(client, Alarm{Type: "c8y_LongOutage", Text: text, Severity: severity, Fragments: map[string]any{"c8y_Outage": details}})
+		if err != nil {
+			logger.Warn("Failed to raise outage alarm", "err", err)
+		}
+	}
+}
+
+// severity returns the severity of the highest threshold the duration reached, empty if none
+func (o *OutageTracker) severity(duration time.Duration) string {
+	severity := ""
+	for _, t := range o.thresholds {
+		if duration >= t.After {
+			severity = t.Severity
+		}
+	}
+	return severity
+}
+
+// save persists the state, called with mu held
+func (o *OutageTracker) save() {
+	data, err := json.Marshal(o.state)
+	if err == nil {
+		err = os.WriteFile(o.path, data, 0o644)
+	}
+	if err != nil {
+		logger.Warn("Failed to persist outage state", "path", o.path, "err", err)
+	}
+}
+
+// parseOutageThresholds parses "1h=MAJOR,24h=CRITICAL", the result is sorted by duration
+func parseOutageThresholds(specs []string) ([]outageThreshold, error) {
+	var thresholds []outageThreshold
+	for _, spec := range specs {
+		after, severity, found := strings.Cut(spec, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(after))
+		severity = strings.ToUpper(strings.TrimSpace(severity))
+		if _, known := alarmTemplates[severity]; !found || err != nil || d <= 0 || !known {
+			return nil, fmt.Errorf("%q must be duration=severity, e.g. 1h=MAJOR", spec)
+		}
+		thresholds = append(thresholds, outageThreshold{After: d, Severity: severity})
+	}
+	slices.SortFunc(thresholds, func(a, b outageThreshold) int { return cmp.Compare(a.After, b.After) })
+	return thresholds, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runPipe publishes lines read from stdin, for "./client pipe"
+// a line is either a SmartREST row (e.g. "400,c8y_Door,Door opened") or a measurement as "fragment,series,value[,unit]",
+// every published line is acknowledged with "ok <line>" on stdout, malformed lines are reported on stderr.
+// EOF disconnects and exits. Returns the exit code
+func runPipe(cfg Config) int {
+	// stdout carries the acknowledgements, so only warnings and errors are logged
+	setLogLevel(max(cfg.LogLevel, slog.LevelWarn))
+
+	device, err := NewDevice(cfg, newCredentialsProvider(cfg))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid connection settings: %v\n", err)
+		return 1
+	}
+	if err := device.Connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect: %v\n", err)
+		return 1
+	}
+	defer device.Client().Disconnect(250)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row, err := pipeRow(text)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error %d: %v\n", line, err)
+			continue
+		}
+		publishSmartRestMessage(device.Client(), row)
+		fmt.Printf("ok %d\n", line)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "reading stdin: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// pipeRow returns the SmartREST row to publish for a line of pipe input
+func pipeRow(text string) (string, error) {
+	records, err := parseSmartRest([]byte(text))
+	if err != nil {
+		return "", err
+	}
+	record := records[0]
+	// rows start with the numeric template id, anything else is a measurement
+	if _, err := strconv.Atoi(record[0]); err == nil {
+		if len(record) < 2 {
+			return "", fmt.Errorf("SmartREST row %q has no fields", text)
+		}
+		return text, nil
+	}
+	if len(record) < 3 || len(record) > 4 {
+		return "", fmt.Errorf("expected fragment,series,value[,unit] but got %d fields", len(record))
+	}
+	value, err := strconv.ParseFloat(record[2], 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid value %q", record[2])
+	}
+	m := Measurement{Fragment: record[0], Series: record[1], Value: value}
+	if len(record) == 4 {
+		m.Unit = record[3]
+	}
+	return measurementTemplate200.render(m)
+}
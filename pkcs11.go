@@ -0,0 +1,85 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// pkcs11Supported tells loadConfig whether C8Y_PKCS11_MODULE can be used, see pkcs11_disabled.go
+const pkcs11Supported = true
+
+// the module is loaded once, the session has to stay open as long as the key is used for handshakes
+var (
+	pkcs11Once    sync.Once
+	pkcs11Context *crypto11.Context
+	pkcs11Err     error
+)
+
+// loadPKCS11Certificate returns the client certificate with a private key that signs on the token
+// the certificate is read from C8Y_CLIENT_CERT if set, otherwise from the token by the label of the key
+func loadPKCS11Certificate(cfg Config) (tls.Certificate, error) {
+	pkcs11Once.Do(func() {
+		config := &crypto11.Config{Path: cfg.PKCS11Module, TokenLabel: cfg.PKCS11TokenLabel, Pin: cfg.PKCS11Pin}
+		if cfg.PKCS11Slot >= 0 {
+			slot := cfg.PKCS11Slot
+			config.SlotNumber = &slot
+		}
+		pkcs11Context, pkcs11Err = crypto11.Configure(config)
+	})
+	if pkcs11Err != nil {
+		return tls.Certificate{}, fmt.Errorf("opening PKCS#11 token: %w", pkcs11Err)
+	}
+	label := []byte(cfg.PKCS11KeyLabel)
+	signer, err := pkcs11Context.FindKeyPair(nil, label)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("finding key %q on the token: %w", cfg.PKCS11KeyLabel, err)
+	}
+	if signer == nil {
+		return tls.Certificate{}, fmt.Errorf("no key %q on the token", cfg.PKCS11KeyLabel)
+	}
+
+	if cfg.ClientCert != "" {
+		chain, err := readCertificateChain(cfg.ClientCert)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.Certificate{Certificate: chain, PrivateKey: signer}, nil
+	}
+	leaf, err := pkcs11Context.FindCertificate(nil, label, nil)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("finding certificate %q on the token: %w", cfg.PKCS11KeyLabel, err)
+	}
+	if leaf == nil {
+		return tls.Certificate{}, fmt.Errorf("no certificate %q on the token, set C8Y_CLIENT_CERT", cfg.PKCS11KeyLabel)
+	}
+	return tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: signer, Leaf: leaf}, nil
+}
+
+// readCertificateChain reads the DER encoded certificates of a PEM file, the client certificate first
+func readCertificateChain(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading client certificate: %w", err)
+	}
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return chain, nil
+}
@@ -0,0 +1,15 @@
+//go:build !pkcs11
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// PKCS#11 needs cgo and an additional dependency, so it is only built with "-tags pkcs11", see pkcs11.go
+const pkcs11Supported = false
+
+func loadPKCS11Certificate(cfg Config) (tls.Certificate, error) {
+	return tls.Certificate{}, errors.New("built without PKCS#11 support, rebuild with -tags pkcs11")
+}
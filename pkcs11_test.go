@@ -0,0 +1,165 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// TestPKCS11Handshake runs against an initialized SoftHSM token, e.g.
+//
+//	softhsm2-util --init-token --free --label c8y-test --pin 1234 --so-pin 0000
+//	C8Y_TEST_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so C8Y_TEST_PKCS11_TOKEN_LABEL=c8y-test C8Y_TEST_PKCS11_PIN=1234 go test -tags pkcs11
+//
+// a key pair and certificate are created on the token, then a TLS handshake is done with the certificate loaded from it
+func TestPKCS11Handshake(t *testing.T) {
+	module := os.Getenv("C8Y_TEST_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("C8Y_TEST_PKCS11_MODULE not set")
+	}
+	cfg := Config{
+		PKCS11Module:     module,
+		PKCS11Slot:       -1,
+		PKCS11TokenLabel: os.Getenv("C8Y_TEST_PKCS11_TOKEN_LABEL"),
+		PKCS11Pin:        os.Getenv("C8Y_TEST_PKCS11_PIN"),
+		PKCS11KeyLabel:   fmt.Sprintf("c8y-test-%d", time.Now().UnixNano()),
+	}
+	token, err := crypto11.Configure(&crypto11.Config{Path: cfg.PKCS11Module, TokenLabel: cfg.PKCS11TokenLabel, Pin: cfg.PKCS11Pin})
+	if err != nil {
+		t.Fatalf("opening token: %v", err)
+	}
+	defer token.Close()
+	label := []byte(cfg.PKCS11KeyLabel)
+	key, err := token.GenerateECDSAKeyPairWithLabel(label, label, elliptic.P256())
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	leaf := selfSigned(t, key.Public(), key)
+	if err := token.ImportCertificateWithLabel(label, label, leaf); err != nil {
+		t.Fatalf("importing certificate: %v", err)
+	}
+
+	cert, err := loadPKCS11Certificate(cfg)
+	if err != nil {
+		t.Fatalf("loadPKCS11Certificate: %v", err)
+	}
+	if !cert.Leaf.Equal(leaf) {
+		t.Fatalf("loaded another certificate than the one on the token")
+	}
+	handshake(t, cert, leaf)
+}
+
+// handshake connects with the client certificate to a local TLS server that requires exactly that certificate
+func handshake(t *testing.T, client tls.Certificate, expected *x509.Certificate) {
+	t.Helper()
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := tls.Certificate{Certificate: [][]byte{selfSigned(t, &serverKey.PublicKey, serverKey).Raw}, PrivateKey: serverKey}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	peer := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			peer <- err
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			peer <- err
+			return
+		}
+		if got := tlsConn.ConnectionState().PeerCertificates; len(got) == 0 || !got[0].Equal(expected) {
+			peer <- fmt.Errorf("server got another client certificate")
+			return
+		}
+		peer <- nil
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{Certificates: []tls.Certificate{client}, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake with the key on the token: %v", err)
+	}
+	defer conn.Close()
+	if err := <-peer; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func selfSigned(t *testing.T, pub any, priv any) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "c8y-test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestReadCertificateChain(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := selfSigned(t, &key.PublicKey, key)
+	dir := t.TempDir()
+	chainFile := filepath.Join(dir, "chain.pem")
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key in between is skipped, only certificates make up the chain
+	pemData := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})...)
+	if err := os.WriteFile(chainFile, pemData, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := readCertificateChain(chainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(chain))
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("no pem"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCertificateChain(empty); err == nil {
+		t.Fatal("expected an error for a file without certificates")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// PowerStatus is the state of the battery of a device
+type PowerStatus struct {
+	// charge level in percent
+	Level    float64
+	Charging bool
+}
+
+// PowerSource provides the battery state, implement it for your hardware
+type PowerSource interface {
+	PowerStatus() (PowerStatus, error)
+}
+
+// demoPowerSource simulates a battery that discharges by 1% per read down to 5% and then charges back to 100%
+type demoPowerSource struct {
+	mu       sync.Mutex
+	level    float64
+	charging bool
+}
+
+func (d *demoPowerSource) PowerStatus() (PowerStatus, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.level == 0 {
+		d.level = 100
+	}
+	switch {
+	case d.charging && d.level >= 100:
+		d.charging = false
+	case !d.charging && d.level <= 5:
+		d.charging = true
+	}
+	if d.charging {
+		d.level += 5
+	} else {
+		d.level--
+	}
+	d.level = min(max(d.level, 0), 100)
+	return PowerStatus{Level: d.level, Charging: d.charging}, nil
+}
+
+// sysfsPowerSource reads the battery state the Linux kernel exposes in /sys/class/power_supply/<name>
+type sysfsPowerSource struct {
+	dir string
+}
+
+func newSysfsPowerSource(name string) *sysfsPowerSource {
+	return &sysfsPowerSource{dir: filepath.Join("/sys/class/power_supply", name)}
+}
+
+func (s *sysfsPowerSource) PowerStatus() (PowerStatus, error) {
+	capacity, err := os.ReadFile(filepath.Join(s.dir, "capacity"))
+	if err != nil {
+		return PowerStatus{}, err
+	}
+	level, err := strconv.ParseFloat(strings.TrimSpace(string(capacity)), 64)
+	if err != nil {
+		return PowerStatus{}, fmt.Errorf("invalid capacity %q: %w", capacity, err)
+	}
+	// possible values: Unknown, Charging, Discharging, Not charging, Full
+	status, err := os.ReadFile(filepath.Join(s.dir, "status"))
+	if err != nil {
+		return PowerStatus{}, err
+	}
+	state := strings.TrimSpace(string(status))
+	return PowerStatus{Level: level, Charging: state == "Charging" || state == "Full"}, nil
+}
+
+// newPowerSource returns the source for C8Y_POWER_SOURCE: "demo" or "sysfs[:<name>]" (default name BAT0)
+func newPowerSource(spec string) (PowerSource, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "demo":
+		return &demoPowerSource{}, nil
+	case "sysfs":
+		if name == "" {
+			name = "BAT0"
+		}
+		return newSysfsPowerSource(name), nil
+	}
+	return nil, fmt.Errorf("unknown power source %q, expected demo or sysfs[:<name>]", spec)
+}
+
+// BatteryMonitor publishes the battery level as c8y_Battery measurement and raises a c8y_LowBattery alarm below a threshold
+// the alarm is cleared once the device is charging or the level has recovered above threshold+hysteresis,
+// so a level bouncing around the threshold doesn't raise and clear the alarm over and over again
+type BatteryMonitor struct {
+	client       mqtt.Client
+	measurements *MeasurementPublisher
+	source       PowerSource
+	threshold    float64
+	hysteresis   float64
+	alarmActive  bool
+}
+
+func NewBatteryMonitor(client mqtt.Client, measurements *MeasurementPublisher, source PowerSource, cfg Config) *BatteryMonitor {
+	return &BatteryMonitor{
+		client:       client,
+		measurements: measurements,
+		source:       source,
+		threshold:    cfg.BatteryLowThreshold,
+		hysteresis:   cfg.BatteryHysteresis,
+	}
+}
+
+func (b *BatteryMonitor) Run(ctx context.Context, interval time.Duration) {
+	for {
+		done := cycles.Start("battery", interval)
+		b.check()
+		done()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (b *BatteryMonitor) check() {
+	status, err := b.source.PowerStatus()
+	if err != nil {
+		logger.Warn("Failed to read power status", "err", err)
+		return
+	}
+	b.measurements.Publish([]Measurement{{Fragment: "c8y_Battery", Series: "level", Value: status.Level, Unit: "%"}})
+
+	switch {
+	case !b.alarmActive && !status.Charging && status.Level < b.threshold:
+		// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#302
+		publishSmartRestMessage(b.client, buildSmartRest("302", "c8y_LowBattery", fmt.Sprintf("Battery low: %.0f%%", status.Level)))
+		b.alarmActive = true
+	case b.alarmActive && (status.Charging || status.Level >= b.threshold+b.hysteresis):
+		// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#306
+		publishSmartRestMessage(b.client, buildSmartRest("306", "c8y_LowBattery"))
+		b.alarmActive = false
+	}
+}
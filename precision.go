@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// measurementPrecision is the number of decimals measurement values are rounded to, by "fragment.series", "fragment" or "*"
+// the most specific entry wins, values of signals without entry are sent as they are
+type measurementPrecision map[string]int
+
+// max decimals, a float64 has no more significant digits anyway
+const maxPrecision = 15
+
+// parseMeasurementPrecision parses "c8y_Temperature.T=1,c8y_Battery=0,*=2"
+func parseMeasurementPrecision(specs []string) (measurementPrecision, error) {
+	precision := measurementPrecision{}
+	for _, spec := range specs {
+		signal, value, found := strings.Cut(spec, "=")
+		signal = strings.TrimSpace(signal)
+		decimals, err := strconv.Atoi(strings.TrimSpace(value))
+		if !found || signal == "" || err != nil {
+			return nil, fmt.Errorf("%q must be signal=decimals, e.g. c8y_Temperature.T=1", spec)
+		}
+		if decimals < 0 || decimals > maxPrecision {
+			return nil, fmt.Errorf("decimals of %s must be within 0..%d, got %d", signal, maxPrecision, decimals)
+		}
+		precision[signal] = decimals
+	}
+	return precision, nil
+}
+
+// round returns the value of m rounded to the configured decimals
+// rounding goes through the decimal representation, so 15.000000001 becomes exactly what "15" or "15.00" is
+func (p measurementPrecision) round(m Measurement) float64 {
+	decimals, ok := p[m.Fragment+"."+m.Series]
+	if !ok {
+		decimals, ok = p[m.Fragment]
+	}
+	if !ok {
+		decimals, ok = p["*"]
+	}
+	if !ok {
+		return m.Value
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(m.Value, 'f', decimals, 64), 64)
+	if err != nil {
+		return m.Value
+	}
+	return rounded
+}
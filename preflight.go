@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"time"
+)
+
+// clock skew beyond which connecting is pointless, TLS certificates and timestamps would be rejected anyway
+const maxClockSkewFatal = 24 * time.Hour
+
+// preflight checks the usual suspects of opaque connection failures before connecting: DNS and the system clock
+// problems are logged with a hint what to do, a clock that is far off (e.g. on boot before NTP synced) fails startup
+func preflight(cfg Config) error {
+	for _, broker := range cfg.Brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			continue
+		}
+		if _, err := net.LookupHost(u.Hostname()); err != nil {
+			logger.Warn("Can't resolve broker host, check the DNS configuration of the device (e.g. /etc/resolv.conf)", "host", u.Hostname(), "err", err)
+		}
+	}
+
+	if built := buildTime(); time.Now().Before(built) {
+		return fmt.Errorf("system clock (%s) is before the build time of this binary (%s), wait for the time to be synchronized (NTP)",
+			time.Now().Format(time.RFC3339), built.Format(time.RFC3339))
+	}
+	if !cfg.ClockCheck {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	defer cancel()
+	skew, err := clockSkew(ctx, cfg.BaseURL)
+	switch {
+	case err != nil:
+		logger.Warn("Can't compare the system clock with the platform", "url", cfg.BaseURL, "err", err)
+	case skew.Abs() > maxClockSkewFatal:
+		return fmt.Errorf("system clock is off by %s compared to the platform, TLS and timestamps would be rejected; wait for the time to be synchronized (NTP)", skew.Round(time.Second))
+	case skew.Abs() > cfg.MaxClockSkew:
+		logger.Warn("System clock differs from the platform, check the time synchronization (NTP) of the device", "skew", skew.Round(time.Second))
+	}
+	return nil
+}
+
+// clockSkew returns how far the system clock is ahead of the Date header of the platform (negative if behind)
+func clockSkew(ctx context.Context, baseURL string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, baseURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	// only the Date header is read and no credentials are sent, certificates can't be verified with a wrong clock anyway
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no valid Date header: %w", err)
+	}
+	// the header was created somewhere during the round trip, assume the middle
+	now := sent.Add(time.Since(sent) / 2)
+	return now.Sub(date), nil
+}
+
+// buildTime is the commit time of the sources this binary was built from, the clock can't be earlier than that
+func buildTime() time.Time {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return time.Time{}
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.time" {
+			t, _ := time.Parse(time.RFC3339, setting.Value)
+			return t
+		}
+	}
+	return time.Time{}
+}
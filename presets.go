@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// DevicePreset are the defaults for a common type of device, selected with --device-preset or C8Y_DEVICE_PRESET
+// the sensor mappings translate readings with the given keys (see MeasurementPublisher.PublishReadings) to the
+// measurements the platform's standard widgets expect. Everything can still be overridden: C8Y_DEVICE_TYPE,
+// C8Y_MEASUREMENT_TEMPLATE, and the entries of C8Y_SENSOR_MAPPING replace the preset's mapping of the same key
+type DevicePreset struct {
+	DeviceType string
+	// measurement template, see parseMeasurementTemplate
+	Template string
+	Sensors  map[string]SensorMapping
+}
+
+var devicePresets = map[string]DevicePreset{
+	// same measurements as the 201 example in the measurement loop
+	"energy-meter": {
+		DeviceType: "c8y_EnergyMeter",
+		Template:   "201",
+		Sensors: map[string]SensorMapping{
+			"A1": {Fragment: "c8y_SinglePhaseEnergyMeasurement", Series: "A1", Unit: "kWh", Scale: 1},
+			"A2": {Fragment: "c8y_SinglePhaseEnergyMeasurement", Series: "A2", Unit: "kWh", Scale: 1},
+		},
+	},
+	"temperature-sensor": {
+		DeviceType: "c8y_TemperatureSensor",
+		Template:   "200",
+		Sensors: map[string]SensorMapping{
+			"temperature": {Fragment: "c8y_TemperatureMeasurement", Series: "T", Unit: "C", Scale: 1},
+			"humidity":    {Fragment: "c8y_HumidityMeasurement", Series: "h", Unit: "%RH", Scale: 1},
+			"battery":     {Fragment: "c8y_Battery", Series: "level", Unit: "%", Scale: 1},
+		},
+	},
+	// the position itself is reported via c8y_Position, see PositionTracker
+	"tracker": {
+		DeviceType: "c8y_Tracker",
+		Template:   "200",
+		Sensors: map[string]SensorMapping{
+			"speed":   {Fragment: "c8y_SpeedMeasurement", Series: "speed", Unit: "km/h", Scale: 1},
+			"battery": {Fragment: "c8y_Battery", Series: "level", Unit: "%", Scale: 1},
+			"rssi":    {Fragment: "c8y_SignalStrength", Series: "rssi", Unit: "dBm", Scale: 1},
+		},
+	},
+}
+
+// lookupDevicePreset returns the named preset, an empty name is no preset
+func lookupDevicePreset(name string) (DevicePreset, error) {
+	if name == "" {
+		return DevicePreset{}, nil
+	}
+	preset, ok := devicePresets[name]
+	if !ok {
+		known := slices.Sorted(maps.Keys(devicePresets))
+		return DevicePreset{}, fmt.Errorf("unknown device preset %q, expected one of %s", name, strings.Join(known, ", "))
+	}
+	return preset, nil
+}
+
+// sensorMappings returns the preset's mappings with the configured ones applied on top
+func (p DevicePreset) sensorMappings(configured map[string]SensorMapping) map[string]SensorMapping {
+	if len(p.Sensors) == 0 {
+		return configured
+	}
+	mappings := maps.Clone(p.Sensors)
+	maps.Copy(mappings, configured)
+	return mappings
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is a named set of settings for one environment, selected with --profile
+//
+//	prod:
+//	  broker: mqtts://mqtt.eu-latest.cumulocity.com:8883
+//	  tenant: t12345
+//	  credentials: /etc/c8y/prod.credentials
+//	  deviceNamePrefix: prod-
+//	  logLevel: warn
+type Profile struct {
+	Broker           string `yaml:"broker"`
+	Tenant           string `yaml:"tenant"`
+	Credentials      string `yaml:"credentials"`
+	DeviceNamePrefix string `yaml:"deviceNamePrefix"`
+	LogLevel         string `yaml:"logLevel"`
+}
+
+// env returns the profile as the environment variables it stands for, unset values are left out
+func (p Profile) env() map[string]string {
+	env := map[string]string{}
+	for key, value := range map[string]string{
+		"C8Y_BROKER":             p.Broker,
+		"C8Y_TENANT":             p.Tenant,
+		"C8Y_CREDENTIALS_FILE":   p.Credentials,
+		"C8Y_DEVICE_NAME_PREFIX": p.DeviceNamePrefix,
+		"C8Y_LOG_LEVEL":          p.LogLevel,
+	} {
+		if value != "" {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// applyProfile sets the environment variables of the named profile from the profiles file, they take precedence over
+// the environment and .env. It has to be applied again after the .env file is re-read (see watchConfigReload)
+func applyProfile(path string, name string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading profiles: %w", err)
+	}
+	var profiles map[string]Profile
+	if err := yaml.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("invalid profiles file %s: %w", path, err)
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("profile %q not found in %s, available: %s", name, path, strings.Join(names, ", "))
+	}
+	for key, value := range profile.env() {
+		os.Setenv(key, value)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ProgressReporter publishes the progress of long running operations as c8y_OperationProgress events
+// updates are sent at most once per interval (except for 100%) and never go backwards, so the UI shows a smooth progress
+// without a flood of messages for every chunk transferred
+type ProgressReporter struct {
+	client   mqtt.Client
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]progressUpdate
+}
+
+type progressUpdate struct {
+	percent int
+	at      time.Time
+}
+
+func NewProgressReporter(client mqtt.Client, interval time.Duration) *ProgressReporter {
+	return &ProgressReporter{client: client, interval: interval, last: map[string]progressUpdate{}}
+}
+
+// Start resets the progress of the operation, call it when the operation begins
+func (p *ProgressReporter) Start(fragment string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.last, fragment)
+}
+
+// Report publishes the progress of the operation if it advanced and the interval since the last update has passed
+func (p *ProgressReporter) Report(fragment string, percent int) {
+	percent = min(max(percent, 0), 100)
+	p.mu.Lock()
+	last, reported := p.last[fragment]
+	if reported && (percent <= last.percent || (percent < 100 && time.Since(last.at) < p.interval)) {
+		p.mu.Unlock()
+		return
+	}
+	p.last[fragment] = progressUpdate{percent: percent, at: time.Now()}
+	p.mu.Unlock()
+
+	publishSmartRestMessage(p.client, buildSmartRest("400", "c8y_OperationProgress", fmt.Sprintf("%s: %d%%", fragment, percent)))
+}
+
+// progressWriter reports the progress of a transfer of total bytes, e.g. as io.Copy(io.MultiWriter(file, progress), body)
+type progressWriter struct {
+	fragment string
+	total    int64
+	written  int64
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.written += int64(len(b))
+	if w.total > 0 {
+		reportProgress(w.fragment, int(w.written*100/w.total))
+	}
+	return len(b), nil
+}
+
+// reportProgress publishes the progress of the operation with the given fragment, see ProgressReporter
+func reportProgress(fragment string, percent int) {
+	if progress != nil {
+		progress.Report(fragment, percent)
+	}
+}
+
+// simulateDownload pretends to download size bytes within duration, reporting the progress like a real download would
+func simulateDownload(fragment string, size int64, duration time.Duration) {
+	if progress != nil {
+		progress.Start(fragment)
+	}
+	const chunks = 50
+	writer := &progressWriter{fragment: fragment, total: size}
+	for range chunks {
+		time.Sleep(duration / chunks)
+		io.CopyN(writer, zeroReader{}, size/chunks)
+	}
+	io.CopyN(writer, zeroReader{}, size%chunks)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// PropertyCache remembers the device properties published on previous runs, so unchanged properties aren't sent again on every start
+// the cache belongs to a device serial, a cache written for another serial is ignored
+type PropertyCache struct {
+	path  string
+	force bool
+
+	mu   sync.Mutex
+	file propertyCacheFile
+}
+
+type propertyCacheFile struct {
+	Serial     string            `json:"serial"`
+	Properties map[string]string `json:"properties"`
+}
+
+// NewPropertyCache loads the cache from path, with force every property counts as changed
+func NewPropertyCache(path string, serial string, force bool) (*PropertyCache, error) {
+	c := &PropertyCache{path: path, force: force}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &c.file); err != nil {
+			return nil, fmt.Errorf("invalid property cache %s: %w", path, err)
+		}
+	}
+	if c.file.Serial != serial || c.file.Properties == nil {
+		c.file = propertyCacheFile{Serial: serial, Properties: map[string]string{}}
+	}
+	return c, nil
+}
+
+// Changed records value as the current value of the property and reports whether it differs from the one published last
+func (c *PropertyCache) Changed(key string, value string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.force && c.file.Properties[key] == value {
+		return false
+	}
+	c.file.Properties[key] = value
+	return true
+}
+
+// Forget drops the recorded value, so the property counts as changed, e.g. as the platform rejected it
+func (c *PropertyCache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.file.Properties, key)
+}
+
+// Save persists the cache, call it once the properties have been published
+func (c *PropertyCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(c.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0o644)
+}
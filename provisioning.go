@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Provisioning creates a c8y_ProvisioningComplete event once the device has been created, declared its capabilities
+// and published its first measurement, so a provisioning dashboard sees which devices came online
+// a flag file remembers the event was sent, it is sent once per device (serial) and not on every restart
+type Provisioning struct {
+	client mqtt.Client
+	path   string
+	serial string
+
+	mu           sync.Mutex
+	done         bool
+	created      bool
+	capabilities bool
+	measured     bool
+}
+
+// NewProvisioning returns nil (which ignores all calls) if the event is disabled or has been sent already
+func NewProvisioning(client mqtt.Client, cfg Config) *Provisioning {
+	if !cfg.ProvisioningEvent {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.ProvisioningFlagPath)
+	if err == nil && strings.TrimSpace(string(data)) == cfg.DeviceSerial {
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warn("Failed to read provisioning flag", "path", cfg.ProvisioningFlagPath, "err", err)
+	}
+	return &Provisioning{client: client, path: cfg.ProvisioningFlagPath, serial: cfg.DeviceSerial}
+}
+
+func (p *Provisioning) DeviceCreated() {
+	p.step(func() { p.created = true })
+}
+
+func (p *Provisioning) CapabilitiesDeclared() {
+	p.step(func() { p.capabilities = true })
+}
+
+func (p *Provisioning) MeasurementPublished() {
+	p.step(func() { p.measured = true })
+}
+
+// step records a completed step and sends the event once all are done
+func (p *Provisioning) step(record func()) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	record()
+	if p.done || !p.created || !p.capabilities || !p.measured {
+		return
+	}
+	err := publishEvent(p.client, Event{
+		Type: "c8y_ProvisioningComplete",
+		Text: "Device " + p.serial + " is provisioned",
+		Fragments: map[string]any{
+			"c8y_ProvisioningComplete": map[string]any{"serial": p.serial, "version": buildVersion()},
+		},
+	})
+	if err != nil {
+		// not done yet, the next measurement tries again
+		logger.Warn("Failed to report completed provisioning", "err", err)
+		return
+	}
+	p.done = true
+	logger.Info("Reported completed provisioning")
+	if err := os.WriteFile(p.path, []byte(p.serial+"\n"), 0o644); err != nil {
+		logger.Warn("Failed to write provisioning flag, the event is sent again on the next start", "path", p.path, "err", err)
+	}
+}
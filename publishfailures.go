@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// PublishFailures raises a c8y_DataPublishFailure alarm once measurements failed to publish a number of times in a row,
+// e.g. because the broker rejects them while the connection looks fine, and clears it once measurements go through again
+// the alarm itself may fail to publish as well, raising it is tried again on the next failure
+type PublishFailures struct {
+	client    mqtt.Client
+	threshold int
+
+	mu          sync.Mutex
+	consecutive int
+	alarmActive bool
+}
+
+func NewPublishFailures(client mqtt.Client, threshold int) *PublishFailures {
+	return &PublishFailures{client: client, threshold: threshold}
+}
+
+// Failed counts a failed publish, a nil tracker (alarm disabled) counts nothing
+func (f *PublishFailures) Failed(err error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.consecutive++
+	if f.alarmActive || f.consecutive < f.threshold {
+		return
+	}
+	text := fmt.Sprintf("Measurements failed to publish %d times in a row: %v", f.consecutive, err)
+	// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#302
+	if RaiseAlarm(f.client, Alarm{Type: "c8y_DataPublishFailure", Severity: "MAJOR", Text: text}) == nil {
+		f.alarmActive = true
+	}
+}
+
+// Succeeded resets the count and clears the alarm
+func (f *PublishFailures) Succeeded() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.consecutive = 0
+	if f.alarmActive && ClearAlarm(f.client, "c8y_DataPublishFailure") == nil {
+		f.alarmActive = false
+	}
+}
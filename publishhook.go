@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// OnPublish is called after each publish completed, with the error if it failed (nil when the broker acknowledged it)
+// set it before connecting to implement own delivery tracking or retries, nil disables it
+// calls happen one after another on a separate goroutine in publish order, so a slow callback doesn't block publishing,
+// outcomes are dropped (and counted) while publishOutcomeBuffer outcomes are waiting for the callback
+var OnPublish func(topic string, payload string, err error)
+
+// number of outcomes waiting for OnPublish before further ones are dropped
+const publishOutcomeBuffer = 1000
+
+type publishOutcome struct {
+	topic   string
+	payload string
+	err     error
+}
+
+var (
+	publishOutcomes     chan publishOutcome
+	startPublishOutcome sync.Once
+	droppedOutcomes     atomic.Int64
+)
+
+// notifyPublished hands the outcome of a publish to OnPublish without waiting for it
+func notifyPublished(topic string, payload string, err error) {
+	callback := OnPublish
+	if callback == nil {
+		return
+	}
+	startPublishOutcome.Do(func() {
+		publishOutcomes = make(chan publishOutcome, publishOutcomeBuffer)
+		go func() {
+			for o := range publishOutcomes {
+				callback(o.topic, o.payload, o.err)
+			}
+		}()
+	})
+	select {
+	case publishOutcomes <- publishOutcome{topic: topic, payload: payload, err: err}:
+	default:
+		if dropped := droppedOutcomes.Add(1); dropped == 1 || dropped%100 == 0 {
+			logger.Warn("OnPublish can't keep up, dropping publish outcomes", "dropped", dropped)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// errAckTimeout is returned for a QoS 1 publish not acknowledged within the ack timeout
+// the message may still be delivered, the client keeps retrying it
+var errAckTimeout = errors.New("publish not acknowledged in time")
+
+// acknowledged QoS 1 publishes in a row after which telemetry is sent with QoS 1 again
+const qosRecoverAfter = 3
+
+// time between two telemetry publishes sent with QoS 1 while downgraded, to find out whether acks arrive again
+const qosProbeInterval = 30 * time.Second
+
+// QoSPolicy trades reliability for liveness when the broker doesn't acknowledge publishes (overloaded or flaky):
+// after a number of QoS 1 publishes in a row timed out, telemetry is sent with QoS 0 so measurements keep flowing
+// instead of every publish blocking for the ack timeout. Everything else (operation status, events, alarms) stays at
+// QoS 1. Telemetry goes back to QoS 1 once acks arrive again, probed by an occasional telemetry publish with QoS 1
+type QoSPolicy struct {
+	threshold  int
+	ackTimeout time.Duration
+
+	mu          sync.Mutex
+	timeouts    int
+	acked       int
+	downgraded  bool
+	lastProbe   time.Time
+	downgradeAt time.Time
+}
+
+func NewQoSPolicy(threshold int, ackTimeout time.Duration) *QoSPolicy {
+	return &QoSPolicy{threshold: threshold, ackTimeout: ackTimeout}
+}
+
+// TelemetryQoS is the QoS to send telemetry with, always 1 for a nil policy (downgrading disabled)
+func (q *QoSPolicy) TelemetryQoS() byte {
+	if q == nil {
+		return 1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.downgraded {
+		return 1
+	}
+	if time.Since(q.lastProbe) >= qosProbeInterval {
+		q.lastProbe = time.Now()
+		return 1
+	}
+	return 0
+}
+
+// wait waits for the publish to complete, for QoS 1 at most the ack timeout. A nil policy waits as long as it takes
+func (q *QoSPolicy) wait(token mqtt.Token, qos byte) error {
+	if q == nil || qos == 0 {
+		token.Wait()
+		return token.Error()
+	}
+	if !token.WaitTimeout(q.ackTimeout) {
+		q.observe(false)
+		return errAckTimeout
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	q.observe(true)
+	return nil
+}
+
+// observe counts acknowledged and timed out QoS 1 publishes and switches the telemetry QoS
+func (q *QoSPolicy) observe(acked bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !acked {
+		q.acked = 0
+		q.timeouts++
+		if !q.downgraded && q.timeouts >= q.threshold {
+			q.downgraded = true
+			q.downgradeAt = time.Now()
+			q.lastProbe = time.Now()
+			logger.Warn("Publishes aren't acknowledged, sending telemetry with QoS 0", "timeouts", q.timeouts, "ackTimeout", q.ackTimeout)
+		}
+		return
+	}
+	q.timeouts = 0
+	q.acked++
+	if q.downgraded && q.acked >= qosRecoverAfter {
+		q.downgraded = false
+		logger.Info("Publishes are acknowledged again, sending telemetry with QoS 1", "downgradedFor", time.Since(q.downgradeAt).Round(time.Second))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// QuotaGuard keeps the client from reconnecting in a tight loop while the tenant exceeds its quota or limits
+// the platform disconnects (or refuses) such devices right away again, so reconnects are held back for the backoff period
+// once the connection is back, an event tells the platform users why the device was offline
+type QuotaGuard struct {
+	backoff time.Duration
+
+	mu      sync.Mutex
+	until   time.Time
+	reason  string
+	pending bool
+}
+
+func NewQuotaGuard(backoff time.Duration) *QuotaGuard {
+	return &QuotaGuard{backoff: backoff}
+}
+
+// Observe checks why a connection was lost or refused, quota related reasons start the backoff
+func (q *QuotaGuard) Observe(err error) {
+	if q == nil || q.backoff <= 0 || !isQuotaError(err) {
+		return
+	}
+	q.mu.Lock()
+	q.until = time.Now().Add(q.backoff)
+	q.reason = err.Error()
+	q.pending = true
+	q.mu.Unlock()
+	logger.Warn("Disconnected because of the tenant's quota or limits, backing off before reconnecting", "reason", err, "backoff", q.backoff)
+	publishLimiter.Throttled("quota exceeded")
+}
+
+// Wait blocks until the backoff is over, called before each reconnect attempt
+func (q *QuotaGuard) Wait() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	until := q.until
+	q.mu.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+// Restored publishes a c8y_QuotaExceeded event if the connection was lost because of the quota, called on connect
+func (q *QuotaGuard) Restored(client mqtt.Client) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	pending, reason := q.pending, q.reason
+	q.pending = false
+	q.mu.Unlock()
+	if !pending {
+		return
+	}
+	publishSmartRestMessage(client, buildSmartRest("400", "c8y_QuotaExceeded", "Device was disconnected because of the tenant's quota or limits: "+reason))
+}
+
+// isQuotaError reports whether the reason of a disconnect or refused connect points to exceeded quota or limits
+// the broker refuses connects with "server unavailable" while the tenant is over its limits
+func isQuotaError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, packets.ErrorRefusedServerUnavailable) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, hint := range []string{"quota", "exceeded"} {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
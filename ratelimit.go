@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimiter spaces out publishes to at most rate messages per second
+// when the platform signals throttling the rate is halved, once no signal arrived for a recovery period it grows again by a quarter,
+// up to the configured maximum. So the device backs off under load without manual tuning and returns to full speed afterwards
+type AdaptiveLimiter struct {
+	max      float64
+	min      float64
+	recovery time.Duration
+
+	mu            sync.Mutex
+	rate          float64
+	next          time.Time
+	lastThrottled time.Time
+	lastChange    time.Time
+}
+
+func NewAdaptiveLimiter(maxRate float64, recovery time.Duration) *AdaptiveLimiter {
+	return &AdaptiveLimiter{max: maxRate, min: max(maxRate/64, 0.1), recovery: recovery, rate: maxRate}
+}
+
+// Wait blocks until the next publish is allowed, a nil limiter doesn't limit
+func (l *AdaptiveLimiter) Wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.recover(now)
+	at := now
+	if l.next.After(now) {
+		at = l.next
+	}
+	l.next = at.Add(time.Duration(float64(time.Second) / l.rate))
+	l.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// Throttled reduces the rate, signals arriving in quick succession (e.g. several rejected messages of one batch) count once
+func (l *AdaptiveLimiter) Throttled(reason string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.lastThrottled = now
+	if now.Sub(l.lastChange) < time.Second {
+		return
+	}
+	previous := l.rate
+	l.rate = max(l.rate/2, l.min)
+	l.lastChange = now
+	if l.rate != previous {
+		logger.Warn("Platform is throttling, reducing publish rate", "reason", reason, "from", previous, "to", l.rate)
+	}
+}
+
+// recover raises the rate step by step while there are no throttling signals, called with mu held
+func (l *AdaptiveLimiter) recover(now time.Time) {
+	if l.rate >= l.max || now.Sub(l.lastThrottled) < l.recovery || now.Sub(l.lastChange) < l.recovery {
+		return
+	}
+	previous := l.rate
+	l.rate = min(l.rate*1.25, l.max)
+	l.lastChange = now
+	logger.Info("No throttling anymore, raising publish rate", "from", previous, "to", l.rate)
+}
+
+// isThrottlingError reports whether an error message from the platform (s/e, REST) is about rate limits
+func isThrottlingError(message string) bool {
+	message = strings.ToLower(message)
+	for _, hint := range []string{"429", "too many requests", "throttl", "rate limit"} {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
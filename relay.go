@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// states of c8y_Relay and c8y_RelayArray
+const (
+	relayOpen   = "OPEN"
+	relayClosed = "CLOSED"
+)
+
+// RelayController switches the outputs of the device, implement it for your hardware
+// relays are numbered from 0 in the order of the relay array, the single relay of 518 is relay 0
+type RelayController interface {
+	// SetRelay switches the relay to OPEN or CLOSED
+	SetRelay(index int, state string) error
+	// RelayState reads the current state of the relay
+	RelayState(index int) (string, error)
+}
+
+// simulatedRelays only remembers the states, relays never switched are CLOSED
+type simulatedRelays struct {
+	mu     sync.Mutex
+	states map[int]string
+}
+
+func (s *simulatedRelays) SetRelay(index int, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states == nil {
+		s.states = map[int]string{}
+	}
+	logger.Info("Simulating relay", "relay", index, "state", state)
+	s.states[index] = state
+	return nil
+}
+
+func (s *simulatedRelays) RelayState(index int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.states[index]; ok {
+		return state, nil
+	}
+	return relayClosed, nil
+}
+
+// parseRelayStates parses the states of 518,serial,state and 519,serial,state1,state2,...
+// the platform's examples use CLOSE as well as CLOSED, both are accepted
+func parseRelayStates(record []string) ([]string, error) {
+	if err := checkOperationFields(record); err != nil {
+		return nil, err
+	}
+	fields := record[2:]
+	if record[0] == "518" {
+		fields = fields[:1]
+	}
+	states := make([]string, 0, len(fields))
+	for i, field := range fields {
+		switch state := strings.ToUpper(strings.TrimSpace(field)); state {
+		case relayOpen:
+			states = append(states, relayOpen)
+		case relayClosed, "CLOSE":
+			states = append(states, relayClosed)
+		default:
+			return nil, fmt.Errorf("invalid state %q of relay %d, expected OPEN or CLOSED", field, i)
+		}
+	}
+	return states, nil
+}
+
+// switchRelays sets the relays to the states, all relays are switched even if some of them fail
+// the result are the states the relays are in afterwards, the error names every relay that failed
+func switchRelays(controller RelayController, states []string) ([]string, error) {
+	result := make([]string, len(states))
+	var errs []error
+	for i, state := range states {
+		if err := controller.SetRelay(i, state); err != nil {
+			errs = append(errs, fmt.Errorf("relay %d: %w", i, err))
+			// the relay may or may not have switched, ask the hardware
+			if result[i], err = controller.RelayState(i); err != nil {
+				result[i] = ""
+			}
+			continue
+		}
+		result[i] = state
+	}
+	return result, errors.Join(errs...)
+}
+
+// reportRelayStates updates the c8y_Relay (single relay) or c8y_RelayArray fragment of the device twin
+// the update is skipped if the state of a relay is unknown, a wrong state in the UI is worse than a stale one
+func reportRelayStates(client mqtt.Client, serial string, fragment string, states []string) {
+	for i, state := range states {
+		if state == "" {
+			logger.Warn("Not reporting relay states, the state of a relay is unknown", "relay", i)
+			return
+		}
+	}
+	var value any = states
+	if fragment == "c8y_Relay" {
+		value = map[string]any{"relayState": states[0]}
+	}
+	doc, err := json.Marshal(map[string]any{fragment: value})
+	if err != nil {
+		logger.Warn("Failed to report relay states", "err", err)
+		return
+	}
+	publishJsonViaMqttMessage(client, "inventory/managedObjects/update/"+serial, string(doc))
+}
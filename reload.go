@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/joho/godotenv"
+)
+
+// hotReloadable lists the Config fields that can be changed on a running device
+// everything else (broker, credentials, audit log, ...) is only picked up on the next start
+var hotReloadable = map[string]bool{
+	"LogLevel":               true,
+	"MeasurementInterval":    true,
+	"MinInterval":            true,
+	"MeasurementTemplate":    true,
+	"SensorMappings":         true,
+	"MeasurementPrecision":   true,
+	"MeasurementTransport":   true,
+	"RequiredIntervalFactor": true,
+	"MqttMaxPayload":         true,
+	"RestChunkSize":          true,
+	"PauseBufferSize":        true,
+}
+
+// watchConfigReload re-reads the configuration on SIGHUP and hands the reloadable part of it to apply
+// the .env file is loaded with override semantics, so edited values replace the ones loaded on startup
+func watchConfigReload(ctx context.Context, current Config, apply func(Config)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+		logger.Info("Received SIGHUP, reloading configuration")
+		if err := godotenv.Overload(); err != nil && !os.IsNotExist(err) {
+			logger.Error("Failed to read .env file, keeping current configuration", "err", err)
+			continue
+		}
+		if *profileName != "" {
+			if err := applyProfile(*profilesFile, *profileName); err != nil {
+				logger.Error("Invalid profile, keeping current configuration", "err", err)
+				continue
+			}
+		}
+		next, err := loadConfig()
+		if err != nil {
+			logger.Error("Invalid configuration, keeping current configuration", "err", err)
+			continue
+		}
+
+		changed := changedConfigFields(current, next)
+		if len(changed) == 0 {
+			logger.Info("Configuration unchanged")
+			continue
+		}
+		// start from the running configuration and only take over what can be applied right away
+		updated := current
+		updatedValue := reflect.ValueOf(&updated).Elem()
+		nextValue := reflect.ValueOf(next)
+		for _, name := range changed {
+			if !hotReloadable[name] {
+				logger.Warn("Configuration change requires a restart to take effect", "field", name)
+				continue
+			}
+			updatedValue.FieldByName(name).Set(nextValue.FieldByName(name))
+			logger.Info("Applying configuration change", "field", name)
+		}
+		current = updated
+		apply(current)
+	}
+}
+
+// changedConfigFields returns the names of the fields that differ between a and b
+// fields tagged with `reload:"-"` are set up in code (e.g. handlers) and not compared
+func changedConfigFields(a Config, b Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := range va.NumField() {
+		if va.Type().Field(i).Tag.Get("reload") == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, va.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
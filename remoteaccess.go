@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocols of Cloud Remote Access endpoints
+// for the device all of them are a plain TCP pass-through, the protocol specific part (SSH client, VNC viewer, ...) runs in the platform
+const (
+	protocolSSH         = "SSH"
+	protocolVNC         = "VNC"
+	protocolTelnet      = "TELNET"
+	protocolPassthrough = "PASSTHROUGH"
+)
+
+// remoteAccessRequest is the typed form of a 530 remote access operation
+type remoteAccessRequest struct {
+	Serial        string
+	Host          string
+	Port          int
+	ConnectionKey string
+	Protocol      string
+}
+
+// parseRemoteAccessRequest parses 530,serial,host,port,connectionKey[,protocol]
+// the protocol isn't part of the static template today, without it the protocol is guessed from the well-known ports
+func parseRemoteAccessRequest(record []string) (remoteAccessRequest, error) {
+	if err := checkOperationFields(record); err != nil {
+		return remoteAccessRequest{}, err
+	}
+	port, err := strconv.Atoi(record[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return remoteAccessRequest{}, fmt.Errorf("invalid port %q", record[3])
+	}
+	req := remoteAccessRequest{Serial: record[1], Host: record[2], Port: port, ConnectionKey: record[4]}
+	if len(record) > 5 && record[5] != "" {
+		req.Protocol = strings.ToUpper(record[5])
+	} else {
+		req.Protocol = protocolForPort(port)
+	}
+	return req, nil
+}
+
+func protocolForPort(port int) string {
+	switch {
+	case port == 22:
+		return protocolSSH
+	case port == 23:
+		return protocolTelnet
+	case port >= 5900 && port <= 5999:
+		return protocolVNC
+	}
+	return protocolPassthrough
+}
+
+// RemoteAccess bridges local TCP endpoints to the platform through a WebSocket
+// see: https://cumulocity.com/docs/cloud-remote-access/cra-general-aspects/
+type RemoteAccess struct {
+	baseURL string
+	// asked on every tunnel, so rotated credentials are picked up
+	credentials func() Credentials
+	protocols   map[string]bool
+}
+
+func NewRemoteAccess(baseURL string, credentials func() Credentials, protocols []string) *RemoteAccess {
+	allowed := map[string]bool{}
+	for _, p := range protocols {
+		allowed[strings.ToUpper(p)] = true
+	}
+	return &RemoteAccess{baseURL: strings.TrimSuffix(baseURL, "/"), credentials: credentials, protocols: allowed}
+}
+
+// Connect dials the local endpoint and the platform and copies data between both until one side closes
+// it returns as soon as both connections are established, the tunnel itself runs in background
+// nil until the tenant is known, an operation arriving right after connect is refused
+func (r *RemoteAccess) Connect(req remoteAccessRequest) error {
+	if r == nil {
+		return fmt.Errorf("remote access isn't ready yet")
+	}
+	if !r.protocols[req.Protocol] {
+		return fmt.Errorf("protocol %s is not supported by this device", req.Protocol)
+	}
+
+	local, err := net.DialTimeout("tcp", net.JoinHostPort(req.Host, strconv.Itoa(req.Port)), 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("connecting to local %s endpoint: %w", req.Protocol, err)
+	}
+
+	wsURL := strings.Replace(r.baseURL, "https://", "wss://", 1)
+	wsURL = strings.Replace(wsURL, "http://", "ws://", 1) + "/service/remoteaccess/device/" + req.ConnectionKey
+	header := http.Header{}
+	creds := r.credentials()
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password)))
+	dialer := websocket.Dialer{HandshakeTimeout: 15 * time.Second, Subprotocols: []string{"binary"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	ws, _, err := dialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		local.Close()
+		return fmt.Errorf("connecting to remote access service: %w", err)
+	}
+
+	logger.Info("Remote access tunnel established", "protocol", req.Protocol, "host", req.Host, "port", req.Port)
+	go bridgeTunnel(ws, local, req)
+	return nil
+}
+
+// bridgeTunnel copies in both directions, closing both connections once either direction ends
+func bridgeTunnel(ws *websocket.Conn, local net.Conn, req remoteAccessRequest) {
+	done := make(chan struct{}, 2)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := local.Read(buf)
+			if n > 0 {
+				if werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		for {
+			_, reader, err := ws.NextReader()
+			if err != nil {
+				break
+			}
+			if _, err := io.Copy(local, reader); err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	ws.Close()
+	local.Close()
+	logger.Info("Remote access tunnel closed", "protocol", req.Protocol, "host", req.Host, "port", req.Port)
+}
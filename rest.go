@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RestClient talks to the Cumulocity REST API using the same credentials as the MQTT connection
+// It is used for the few things MQTT can't do well, like uploading large batches of measurements
+type RestClient struct {
+	baseURL string
+	// asked on every request, so rotated credentials are picked up
+	credentials func() Credentials
+	serial      string
+	http        *http.Client
+
+	mu       sync.Mutex
+	deviceID string
+}
+
+func NewRestClient(baseURL string, credentials func() Credentials, serial string) *RestClient {
+	return &RestClient{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		credentials: credentials,
+		serial:      serial,
+		http:        &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// httpStatusError is returned for non-2xx responses, 5xx responses are considered transient
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *httpStatusError) transient() bool {
+	return e.StatusCode >= 500
+}
+
+// do sends the request and decodes a JSON response into out (if not nil)
+// transient failures are retried with a growing delay, see retryable
+func (r *RestClient) do(ctx context.Context, method string, path string, contentType string, body []byte, out any) error {
+	const attempts = 3
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		lastErr = r.doOnce(ctx, method, path, contentType, body, out)
+		if lastErr == nil {
+			return nil
+		}
+		if !retryable(method, lastErr) {
+			return lastErr
+		}
+		if attempt < attempts {
+			logger.Warn("REST request failed, retrying", "method", method, "path", path, "attempt", attempt, "err", lastErr)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+	}
+	return lastErr
+}
+
+// retryable reports whether a failed request may be sent again. Network errors and 5xx are transient, but a POST that
+// reached the platform may have been processed with only the response lost, sending it again would create its
+// measurements or events twice. So POSTs are only retried if the connection couldn't be established, or the gateway
+// answered that the platform didn't take the request (502, 503, 504)
+func retryable(method string, err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		if method != http.MethodPost {
+			return statusErr.transient()
+		}
+		switch statusErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if method != http.MethodPost {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (r *RestClient) doOnce(ctx context.Context, method string, path string, contentType string, body []byte, out any) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	creds := r.credentials()
+	req.SetBasicAuth(creds.Username, creds.Password)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		publishLimiter.Throttled("REST " + path)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpStatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	if out != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+// DeviceID resolves the managed object id of this device via its c8y_Serial external id
+// the result is cached as the id never changes for an existing device
+func (r *RestClient) DeviceID(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.deviceID != "" {
+		return r.deviceID, nil
+	}
+	id, err := r.ManagedObjectID(ctx, r.serial)
+	if err != nil {
+		return "", err
+	}
+	r.deviceID = id
+	return r.deviceID, nil
+}
+
+// ManagedObjectID resolves the managed object id of a device via its c8y_Serial external id
+func (r *RestClient) ManagedObjectID(ctx context.Context, serial string) (string, error) {
+	var identity struct {
+		ManagedObject struct {
+			ID string `json:"id"`
+		} `json:"managedObject"`
+	}
+	path := "/identity/externalIds/c8y_Serial/" + url.PathEscape(serial)
+	if err := r.do(ctx, http.MethodGet, path, "", nil, &identity); err != nil {
+		return "", fmt.Errorf("looking up device id of %s: %w", serial, err)
+	}
+	return identity.ManagedObject.ID, nil
+}
+
+// CreateMeasurements uploads the measurements of the device with the given managed object id via the bulk endpoint,
+// splitting them in chunks of chunkSize
+func (r *RestClient) CreateMeasurements(ctx context.Context, deviceID string, measurements []Measurement, chunkSize int) error {
+	for start := 0; start < len(measurements); start += chunkSize {
+		end := min(start+chunkSize, len(measurements))
+		docs := make([]map[string]any, 0, end-start)
+		for _, m := range measurements[start:end] {
+			docs = append(docs, m.toJSON(deviceID))
+		}
+		body, err := json.Marshal(map[string]any{"measurements": docs})
+		if err != nil {
+			return err
+		}
+		err = r.do(ctx, http.MethodPost, "/measurement/measurements",
+			"application/vnd.com.nsn.cumulocity.measurementcollection+json", body, nil)
+		if err != nil {
+			return fmt.Errorf("uploading measurements %d-%d of %d: %w", start, end, len(measurements), err)
+		}
+		logger.Info("Uploaded measurements via REST", "count", end-start)
+	}
+	return nil
+}
+
+// UploadEventBinary creates an event on the device and attaches content as file to it, e.g. for a requested log file
+// the returned URL points to the binary, it is what the platform expects as result of a log file request
+func (r *RestClient) UploadEventBinary(ctx context.Context, deviceID string, eventType string, text string, filename string, content []byte) (string, error) {
+	event, err := json.Marshal(map[string]any{
+		"source": map[string]string{"id": deviceID},
+		"type":   eventType,
+		"text":   text,
+		"time":   formatTimestamp(time.Now()),
+	})
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := r.do(ctx, http.MethodPost, "/event/events", "application/json", event, &created); err != nil {
+		return "", fmt.Errorf("creating event for %s: %w", filename, err)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	part.Write(content)
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+	path := "/event/events/" + url.PathEscape(created.ID) + "/binaries"
+	if err := r.do(ctx, http.MethodPost, path, form.FormDataContentType(), body.Bytes(), nil); err != nil {
+		return "", fmt.Errorf("uploading %s: %w", filename, err)
+	}
+	return r.baseURL + path, nil
+}
+
+// baseURLFromBroker derives the REST endpoint from the broker address (mqtts://mqtt.eu-latest.cumulocity.com:8883 -> https://eu-latest.cumulocity.com)
+func baseURLFromBroker(brokerURI string) (string, error) {
+	u, err := url.Parse(brokerURI)
+	if err != nil {
+		return "", fmt.Errorf("invalid broker address %q: %w", brokerURI, err)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid broker address %q: missing host", brokerURI)
+	}
+	return "https://" + strings.TrimPrefix(u.Hostname(), "mqtt."), nil
+}
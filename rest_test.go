@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		name   string
+		method string
+		err    error
+		want   bool
+	}{
+		{"GET 500", http.MethodGet, &httpStatusError{StatusCode: 500}, true},
+		{"GET 404", http.MethodGet, &httpStatusError{StatusCode: 404}, false},
+		{"GET connection reset", http.MethodGet, readErr, true},
+		{"POST 500", http.MethodPost, &httpStatusError{StatusCode: 500}, false},
+		{"POST 502", http.MethodPost, &httpStatusError{StatusCode: 502}, true},
+		{"POST 503", http.MethodPost, &httpStatusError{StatusCode: 503}, true},
+		{"POST 504", http.MethodPost, &httpStatusError{StatusCode: 504}, true},
+		{"POST 422", http.MethodPost, &httpStatusError{StatusCode: 422}, false},
+		{"POST connection refused", http.MethodPost, dialErr, true},
+		// the request may have been processed, only the response is lost
+		{"POST connection reset", http.MethodPost, readErr, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.method, tt.err); got != tt.want {
+				t.Errorf("retryable = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateMeasurementsNotRetriedOnServerError(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	rest := NewRestClient(server.URL, func() Credentials { return Credentials{Username: "t12345/device", Password: "secret"} }, "DeviceSerial")
+	err := rest.CreateMeasurements(context.Background(), "4711", []Measurement{{Fragment: "c8y_Temperature", Series: "T", Value: 21.5}}, 10)
+	if err == nil {
+		t.Fatal("upload succeeded")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1: the measurements may have been created already", n)
+	}
+}
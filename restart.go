@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultRestartCommand is the command rebooting the host, there is no sensible default outside of Linux
+func defaultRestartCommand() string {
+	if runtime.GOOS == "linux" {
+		return "systemctl reboot"
+	}
+	return ""
+}
+
+// Restarter executes restart operations (510)
+// the reboot takes this process down before it could report success, so a marker file is written before the restart
+// command runs and the operation is set to successful on the next start once the marker is found
+// when restarts aren't enabled, the restart is only simulated
+type Restarter struct {
+	client  mqtt.Client
+	enabled bool
+	command []string
+	marker  string
+}
+
+func NewRestarter(client mqtt.Client, cfg Config) *Restarter {
+	return &Restarter{
+		client:  client,
+		enabled: cfg.RestartEnabled,
+		command: strings.Fields(cfg.RestartCommand),
+		marker:  cfg.RestartMarkerPath,
+	}
+}
+
+// Check returns an error if restarts are enabled but the restart command can't be executed
+func (r *Restarter) Check() error {
+	if !r.enabled {
+		return nil
+	}
+	if len(r.command) == 0 {
+		return fmt.Errorf("no restart command configured")
+	}
+	if _, err := exec.LookPath(r.command[0]); err != nil {
+		return fmt.Errorf("restart command not found: %w", err)
+	}
+	return nil
+}
+
+// Restart reboots the host, it only returns on failure or if restarts are simulated
+func (r *Restarter) Restart() error {
+	if !r.enabled {
+		logger.Info("Simulating restart, set C8Y_RESTART_ENABLED to reboot for real")
+		time.Sleep(3 * time.Second)
+		publishSmartRestMessage(r.client, "503,c8y_Restart")
+		return nil
+	}
+	if err := os.WriteFile(r.marker, []byte(time.Now().UTC().Format(time.RFC3339)), 0o644); err != nil {
+		return fmt.Errorf("persisting pending restart: %w", err)
+	}
+	logger.Info("Restarting", "command", strings.Join(r.command, " "))
+	if output, err := exec.Command(r.command[0], r.command[1:]...).CombinedOutput(); err != nil {
+		os.Remove(r.marker)
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	// the command only triggers the reboot, the operation is completed by ResumePending after it
+	return nil
+}
+
+// ResumePending sets the restart operation to successful if this start follows a restart triggered by an operation
+func (r *Restarter) ResumePending() {
+	since, err := os.ReadFile(r.marker)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		logger.Warn("Failed to read restart marker", "path", r.marker, "err", err)
+		return
+	}
+	logger.Info("Completing restart operation", "restartedAt", string(since))
+	publishSmartRestMessage(r.client, "503,c8y_Restart")
+	if err := os.Remove(r.marker); err != nil {
+		logger.Warn("Failed to remove restart marker, the next start reports the restart again", "path", r.marker, "err", err)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// measurement type of the summaries, also keeps them from being rolled up again
+const rollupType = "c8y_Rollup"
+
+// rollupFunctions computes an aggregate of a period, supported in C8Y_ROLLUP
+var rollupFunctions = map[string]func(a *rollupAggregate) float64{
+	"min":   func(a *rollupAggregate) float64 { return a.min },
+	"max":   func(a *rollupAggregate) float64 { return a.max },
+	"avg":   func(a *rollupAggregate) float64 { return a.sum / float64(a.count) },
+	"sum":   func(a *rollupAggregate) float64 { return a.sum },
+	"count": func(a *rollupAggregate) float64 { return float64(a.count) },
+	"last":  func(a *rollupAggregate) float64 { return a.last },
+}
+
+// rollupSpec lists the aggregates per signal ("fragment.series")
+type rollupSpec map[string][]string
+
+// parseRollupSpec parses "c8y_Temperature.T=min|max,c8y_Energy.total=sum"
+func parseRollupSpec(specs []string) (rollupSpec, error) {
+	spec := rollupSpec{}
+	for _, s := range specs {
+		signal, functions, found := strings.Cut(s, "=")
+		signal = strings.TrimSpace(signal)
+		fragment, series, ok := strings.Cut(signal, ".")
+		if !found || !ok || fragment == "" || series == "" {
+			return nil, fmt.Errorf("%q must be fragment.series=aggregates, e.g. c8y_Temperature.T=min|max", s)
+		}
+		for _, f := range strings.Split(functions, "|") {
+			f = strings.TrimSpace(f)
+			if _, ok := rollupFunctions[f]; !ok {
+				return nil, fmt.Errorf("unknown aggregate %q of %s, expected one of min, max, avg, sum, count, last", f, signal)
+			}
+			if !slices.Contains(spec[signal], f) {
+				spec[signal] = append(spec[signal], f)
+			}
+		}
+	}
+	return spec, nil
+}
+
+type rollupAggregate struct {
+	unit  string
+	count int
+	sum   float64
+	min   float64
+	max   float64
+	last  float64
+}
+
+// Rollup summarizes the measurements published during a period (e.g. a day) and publishes the summary at the end of it,
+// as series <series>_<aggregate> of the signal's fragment with type c8y_Rollup and the period's end as time.
+// The samples are aggregated in memory: a restart starts the period over, the summary published after a restart
+// only covers the time since the start. Periods without samples of a signal publish nothing for it
+type Rollup struct {
+	publisher *MeasurementPublisher
+	schedule  cronSchedule
+	spec      rollupSpec
+
+	mu      sync.Mutex
+	signals map[string]*rollupAggregate
+}
+
+func NewRollup(publisher *MeasurementPublisher, schedule cronSchedule, spec rollupSpec) *Rollup {
+	return &Rollup{publisher: publisher, schedule: schedule, spec: spec, signals: map[string]*rollupAggregate{}}
+}
+
+// Add records a published measurement if its signal is rolled up, a nil rollup ignores it
+func (r *Rollup) Add(m Measurement) {
+	if r == nil || m.Type == rollupType {
+		return
+	}
+	signal := m.Fragment + "." + m.Series
+	if _, ok := r.spec[signal]; !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	agg, ok := r.signals[signal]
+	if !ok {
+		r.signals[signal] = &rollupAggregate{unit: m.Unit, count: 1, sum: m.Value, min: m.Value, max: m.Value, last: m.Value}
+		return
+	}
+	agg.count++
+	agg.sum += m.Value
+	agg.min = min(agg.min, m.Value)
+	agg.max = max(agg.max, m.Value)
+	agg.last = m.Value
+}
+
+// Run publishes the summary at every boundary of the schedule. The unfinished period is dropped on shutdown,
+// a summary of part of the period would look like a complete one in reports
+func (r *Rollup) Run(ctx context.Context) {
+	for {
+		boundary := r.schedule.Next(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(boundary)):
+		}
+		r.flush(boundary)
+	}
+}
+
+func (r *Rollup) flush(end time.Time) {
+	r.mu.Lock()
+	signals := r.signals
+	r.signals = make(map[string]*rollupAggregate, len(signals))
+	r.mu.Unlock()
+
+	var measurements []Measurement
+	for signal, agg := range signals {
+		fragment, series, _ := strings.Cut(signal, ".")
+		for _, f := range r.spec[signal] {
+			measurements = append(measurements, Measurement{
+				Fragment: fragment, Series: series + "_" + f, Value: rollupFunctions[f](agg), Unit: agg.unit, Time: end, Type: rollupType,
+			})
+		}
+	}
+	logger.Info("Publishing rollup", "end", end, "signals", len(signals))
+	r.publisher.Publish(measurements)
+}
+
+// cronSchedule is a cron expression "minute hour day-of-month month day-of-week" in local time
+// fields take *, numbers, lists (1,15), ranges (1-5) and steps (*/15, 0-30/10), day-of-week 0 and 7 are Sunday.
+// As in cron, a day matches either restricted day field if both are restricted
+type cronSchedule struct {
+	minute, hour, dom, month, dow []bool
+	domAny, dowAny                bool
+}
+
+// shortcuts for common schedules
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCronSchedule(expr string) (cronSchedule, error) {
+	if shortcut, ok := cronShortcuts[strings.TrimSpace(expr)]; ok {
+		expr = shortcut
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("%q must have 5 fields (minute hour day-of-month month day-of-week) or be one of @hourly, @daily, @weekly, @monthly", expr)
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return s, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return s, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return s, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return s, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return s, fmt.Errorf("day of week: %w", err)
+	}
+	s.dow[0] = s.dow[0] || s.dow[7]
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+	if _, ok := s.next(time.Now()); !ok {
+		return s, fmt.Errorf("%q never matches", expr)
+	}
+	return s, nil
+}
+
+// parseCronField returns which values of lo..hi the field matches, indexed by value
+func parseCronField(field string, lo, hi int) ([]bool, error) {
+	match := make([]bool, hi+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(first); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(last); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			match[v] = true
+		}
+	}
+	return match, nil
+}
+
+// Next returns the first time after t matching the schedule
+func (s cronSchedule) Next(t time.Time) time.Time {
+	next, _ := s.next(t)
+	return next
+}
+
+// next is Next reporting whether the schedule matched within the next 5 years
+func (s cronSchedule) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a schedule like "0 0 30 2 *" never matches, give up after some years instead of looping forever
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return limit, false
+}
+
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[t.Weekday()]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
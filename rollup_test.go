@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCronScheduleNeverMatches(t *testing.T) {
+	for _, expr := range []string{"0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		if _, err := parseCronSchedule(expr); err == nil || !strings.Contains(err.Error(), "never matches") {
+			t.Errorf("%q: err = %v, want never matches", expr, err)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	from := time.Date(2025, 3, 1, 10, 15, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"@daily", time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, 3, 1, 11, 0, 0, 0, time.UTC)},
+		{"0 6 * * 1-5", time.Date(2025, 3, 3, 6, 0, 0, 0, time.UTC)},
+		// only matches in leap years
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseCronSchedule(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next := s.Next(from); !next.Equal(tt.want) {
+				t.Errorf("Next = %s, want %s", next, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollupFlushKeepsType(t *testing.T) {
+	p, client := newChildTestPublisher(t)
+	schedule, err := parseCronSchedule("@daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRollup(p, schedule, rollupSpec{"c8y_Temperature.T": {"max"}})
+	r.Add(Measurement{Fragment: "c8y_Temperature", Series: "T", Value: 21.5, Unit: "C"})
+	r.flush(time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC))
+	// template 200 has no type, the summary is sent as JSON so it doesn't look like a live value
+	if lines := client.messages("s/us"); len(lines) > 0 {
+		t.Errorf("summary published with template 200: %q", lines)
+	}
+	published := client.messages("measurement/measurements/create")
+	if len(published) != 1 || !strings.Contains(published[0], `"type":"c8y_Rollup"`) || !strings.Contains(published[0], `"T_max"`) {
+		t.Errorf("published %q, want the summary with type c8y_Rollup", published)
+	}
+}
+
+func TestRollupFlushOutsideActiveWindow(t *testing.T) {
+	setInactiveWindow(t)
+	p, client := newChildTestPublisher(t)
+	r := NewRollup(p, cronSchedule{}, rollupSpec{"c8y_Temperature.T": {"max"}})
+	r.Add(Measurement{Fragment: "c8y_Temperature", Series: "T", Value: 21.5, Unit: "C"})
+	r.flush(time.Now())
+	// the summary of the period is due at its end, active hours or not
+	if published := client.messages("measurement/measurements/create"); len(published) != 1 {
+		t.Errorf("published %q, want the summary", published)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CycleMonitor notices periodic loops whose cycles take longer than their interval, e.g. a slow sensor or a slow link
+// such a loop can't sustain the configured rate and silently drifts. Overruns are logged at most once per warnEvery
+// and loop, along with a c8y_CycleOverrun measurement counting the overruns since the last warning
+type CycleMonitor struct {
+	warnEvery time.Duration
+
+	mu           sync.Mutex
+	loops        map[string]*loopOverruns
+	measurements *MeasurementPublisher
+}
+
+type loopOverruns struct {
+	count    int
+	worst    time.Duration
+	lastWarn time.Time
+}
+
+func NewCycleMonitor(warnEvery time.Duration) *CycleMonitor {
+	return &CycleMonitor{warnEvery: warnEvery, loops: map[string]*loopOverruns{}}
+}
+
+// Attach sets the publisher the overrun measurements are sent with, until then overruns are only logged
+func (c *CycleMonitor) Attach(measurements *MeasurementPublisher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.measurements = measurements
+}
+
+// Start begins a cycle of the loop, the returned function ends it
+//
+//	done := cycles.Start("battery", interval)
+//	... read and publish ...
+//	done()
+func (c *CycleMonitor) Start(loop string, interval time.Duration) func() {
+	started := time.Now()
+	return func() { c.observe(loop, time.Since(started), interval) }
+}
+
+func (c *CycleMonitor) observe(loop string, took time.Duration, interval time.Duration) {
+	if took <= interval {
+		return
+	}
+	c.mu.Lock()
+	o, ok := c.loops[loop]
+	if !ok {
+		o = &loopOverruns{}
+		c.loops[loop] = o
+	}
+	o.count++
+	o.worst = max(o.worst, took)
+	if time.Since(o.lastWarn) < c.warnEvery {
+		c.mu.Unlock()
+		return
+	}
+	count, worst, measurements := o.count, o.worst, c.measurements
+	*o = loopOverruns{lastWarn: time.Now()}
+	c.mu.Unlock()
+
+	logger.Warn("Loop can't keep up with its interval, consider a longer interval",
+		"loop", loop, "interval", interval, "overruns", count, "slowest", worst)
+	if measurements != nil {
+		measurements.Publish([]Measurement{{Fragment: "c8y_CycleOverrun", Series: loop, Value: float64(count)}})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// secretEnvVars can be given as <name>_FILE instead, naming a file that holds the value (Docker and Kubernetes secrets)
+var secretEnvVars = []string{"USERNAME", "PASSWORD", "C8Y_PKCS11_PIN", "C8Y_CONNECTION"}
+
+// readSecretFile returns the content of the file given in <key>_FILE, ok is false if key isn't a secret or has no file
+// the file is read on every lookup, so secrets rotated by the orchestrator are picked up by C8Y_CREDENTIALS_REFRESH
+func readSecretFile(key string) (value string, ok bool, err error) {
+	if !slices.Contains(secretEnvVars, key) {
+		return "", false, nil
+	}
+	path, ok := os.LookupEnv(key + "_FILE")
+	if !ok || path == "" {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("reading %s_FILE: %w", key, err)
+	}
+	// editors and "echo secret > file" add a newline that isn't part of the secret
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// checkSecretFiles validates the <name>_FILE variables on startup: the file has to be readable, and a secret must not
+// be given both directly and as file as it's unclear which one is meant
+func checkSecretFiles() error {
+	for _, key := range secretEnvVars {
+		if _, ok := os.LookupEnv(key + "_FILE"); !ok {
+			continue
+		}
+		if v, ok := os.LookupEnv(key); ok && v != "" {
+			return fmt.Errorf("%s and %s_FILE are both set, set only one of them", key, key)
+		}
+		if _, _, err := readSecretFile(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SensorMapping translates a raw sensor value to a Cumulocity measurement: value = raw*Scale + Offset
+type SensorMapping struct {
+	Fragment string
+	Series   string
+	Unit     string
+	Scale    float64
+	Offset   float64
+}
+
+// SensorReading is a raw value as read from a sensor, Key selects the mapping
+type SensorReading struct {
+	Key   string
+	Value float64
+	// zero value means "now"
+	Time time.Time
+}
+
+// loadSensorMappings reads the mapping file, keyed by the source key of the sensor value
+//
+//	temp_raw:
+//	  fragment: c8y_Temperature
+//	  series: T
+//	  unit: C
+//	  scale: 0.1    # optional, defaults to 1
+//	  offset: -40   # optional, defaults to 0
+func loadSensorMappings(path string) (map[string]SensorMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// scale is a pointer to tell a missing scale (1) from an explicit 0 (invalid)
+	var raw map[string]struct {
+		Fragment string   `yaml:"fragment"`
+		Series   string   `yaml:"series"`
+		Unit     string   `yaml:"unit"`
+		Scale    *float64 `yaml:"scale"`
+		Offset   float64  `yaml:"offset"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid sensor mapping %s: %w", path, err)
+	}
+	mappings := make(map[string]SensorMapping, len(raw))
+	for key, entry := range raw {
+		m := SensorMapping{Fragment: entry.Fragment, Series: entry.Series, Unit: entry.Unit, Scale: 1, Offset: entry.Offset}
+		if entry.Scale != nil {
+			m.Scale = *entry.Scale
+		}
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("invalid sensor mapping for %q in %s: %w", key, path, err)
+		}
+		mappings[key] = m
+	}
+	return mappings, nil
+}
+
+func (m SensorMapping) validate() error {
+	if m.Fragment == "" || m.Series == "" {
+		return errors.New("fragment and series are required")
+	}
+	if m.Scale == 0 || math.IsNaN(m.Scale) || math.IsInf(m.Scale, 0) {
+		return fmt.Errorf("scale must be a finite number other than 0, got %v", m.Scale)
+	}
+	if math.IsNaN(m.Offset) || math.IsInf(m.Offset, 0) {
+		return fmt.Errorf("offset must be a finite number, got %v", m.Offset)
+	}
+	// units are shown as they are in the UI, anything longer than a few characters is most likely a mistake
+	if len(m.Unit) > 16 {
+		return fmt.Errorf("unit %q is too long", m.Unit)
+	}
+	for _, r := range m.Unit {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("unit %q contains non-printable characters", m.Unit)
+		}
+	}
+	return nil
+}
+
+// apply converts the raw reading to a measurement, failing if the result isn't a finite number
+func (m SensorMapping) apply(r SensorReading) (Measurement, error) {
+	value := r.Value*m.Scale + m.Offset
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return Measurement{}, fmt.Errorf("converted value of %s is %v", r.Key, value)
+	}
+	return Measurement{Fragment: m.Fragment, Series: m.Series, Value: value, Unit: m.Unit, Time: r.Time}, nil
+}
+
+// applySensorMappings translates the readings, readings without a mapping or with a value that can't be converted are dropped
+func applySensorMappings(mappings map[string]SensorMapping, readings []SensorReading) []Measurement {
+	measurements := make([]Measurement, 0, len(readings))
+	for _, r := range readings {
+		mapping, ok := mappings[r.Key]
+		if !ok {
+			logger.Debug("Dropping sensor reading without mapping", "key", r.Key)
+			continue
+		}
+		m, err := mapping.apply(r)
+		if err != nil {
+			logger.Warn("Dropping sensor reading", "key", r.Key, "err", err)
+			continue
+		}
+		measurements = append(measurements, m)
+	}
+	return measurements
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// supported values for C8Y_OPERATION_CONCURRENCY
+const (
+	// all operations run one after another, in the order they were received
+	concurrencySerial = "serial"
+	// operations of the same group run one after another, different groups run in parallel
+	concurrencyGroups = "groups"
+)
+
+// operationGroups assigns each operation template to a group of operations that must not run at the same time
+// a restart in the middle of a firmware or software update would leave the device in an undefined state, so these share a group
+// templates without an entry get a group of their own
+var operationGroups = map[string]string{
+	"510": "system",  // restart
+	"515": "system",  // firmware update
+	"528": "system",  // software update
+	"511": "shell",   // shell command
+	"518": "relay",   // relay
+	"519": "relay",   // relay array
+	"522": "logfile", // log file retrieval
+	"530": "tunnel",  // remote access
+}
+
+// supported values for C8Y_OPERATION_QUEUE_POLICY, applied once more operations of a group are waiting than C8Y_OPERATION_QUEUE_THRESHOLD
+// the threshold is per group: priority only reorders the queue of a group, and a pile in one group doesn't delay the others
+const (
+	// priority operations are moved ahead of the other waiting operations of their group
+	queuePrioritize = "prioritize"
+	// operations without priority are rejected, so a device coming back from a long outage doesn't work through a pile of stale requests
+	queueShed = "shed"
+)
+
+// errQueueFull is returned by Submit for an operation that has been shed
+var errQueueFull = errors.New("too many pending operations")
+
+// QueueDepth is the number of operations waiting to be executed and currently executing
+type QueueDepth struct {
+	Pending  int
+	InFlight int
+}
+
+type queuedOperation struct {
+	templateId string
+	run        func()
+}
+
+// OperationSerializer runs operations in the background while making sure conflicting operations don't overlap
+// Operations of a group are executed in the order they were submitted, unless the queue of the group exceeds the threshold
+type OperationSerializer struct {
+	policy      string
+	threshold   int
+	queuePolicy string
+	priority    map[string]bool
+
+	mu       sync.Mutex
+	queues   map[string][]queuedOperation
+	pending  int
+	inFlight int
+}
+
+func NewOperationSerializer(cfg Config) *OperationSerializer {
+	priority := map[string]bool{}
+	for _, templateId := range cfg.OperationPriority {
+		priority[templateId] = true
+	}
+	return &OperationSerializer{
+		policy:      cfg.OperationConcurrency,
+		threshold:   cfg.OperationQueueThreshold,
+		queuePolicy: cfg.OperationQueuePolicy,
+		priority:    priority,
+		queues:      map[string][]queuedOperation{},
+	}
+}
+
+func (s *OperationSerializer) group(templateId string) string {
+	if s.policy == concurrencySerial {
+		return "all"
+	}
+	if group, ok := operationGroups[templateId]; ok {
+		return group
+	}
+	return templateId
+}
+
+// Depth returns the number of pending and executing operations
+func (s *OperationSerializer) Depth() QueueDepth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return QueueDepth{Pending: s.pending, InFlight: s.inFlight}
+}
+
+// Submit queues the operation and returns right away, so the MQTT callback isn't blocked by long running operations
+// it returns errQueueFull if the operation has been shed, the caller has to report it as failed
+func (s *OperationSerializer) Submit(templateId string, operation func()) error {
+	group := s.group(templateId)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue, running := s.queues[group]
+	overloaded := s.threshold > 0 && len(queue) >= s.threshold
+	switch {
+	case overloaded && !s.priority[templateId] && s.queuePolicy == queueShed:
+		return errQueueFull
+	case overloaded && s.priority[templateId]:
+		// both policies let priority operations pass the waiting ones, behind those with priority themselves
+		pos := 0
+		for pos < len(queue) && s.priority[queue[pos].templateId] {
+			pos++
+		}
+		queue = slices.Insert(queue, pos, queuedOperation{templateId, operation})
+	default:
+		queue = append(queue, queuedOperation{templateId, operation})
+	}
+	s.queues[group] = queue
+	s.pending++
+	if !running {
+		go s.drain(group)
+	}
+	return nil
+}
+
+// drain executes the queued operations of a group until the queue is empty, only one drain runs per group at a time
+func (s *OperationSerializer) drain(group string) {
+	for {
+		s.mu.Lock()
+		queue := s.queues[group]
+		if len(queue) == 0 {
+			delete(s.queues, group)
+			s.mu.Unlock()
+			return
+		}
+		operation := queue[0]
+		s.queues[group] = queue[1:]
+		s.pending--
+		s.inFlight++
+		s.mu.Unlock()
+
+		operation.run()
+
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}
+}
+
+// operationTemplateID returns the first CSV field of an operation message, e.g. "510" for "510,DeviceSerial"
+func operationTemplateID(payload []byte) string {
+	templateId, _, _ := bytes.Cut(payload, []byte(","))
+	return string(bytes.TrimSpace(templateId))
+}
+
+func validateQueuePolicy(policy string) error {
+	switch policy {
+	case queuePrioritize, queueShed:
+		return nil
+	}
+	return fmt.Errorf("C8Y_OPERATION_QUEUE_POLICY must be one of prioritize, shed, got %q", policy)
+}
+
+func validateConcurrencyPolicy(policy string) error {
+	switch policy {
+	case concurrencySerial, concurrencyGroups:
+		return nil
+	}
+	return fmt.Errorf("C8Y_OPERATION_CONCURRENCY must be one of serial, groups, got %q", policy)
+}
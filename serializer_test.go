@@ -0,0 +1,155 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingOperation records its start and blocks until released
+type blockingOperation struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingOperation() *blockingOperation {
+	return &blockingOperation{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (o *blockingOperation) run() {
+	close(o.started)
+	<-o.release
+}
+
+func waitStarted(t *testing.T, o *blockingOperation, name string) {
+	t.Helper()
+	select {
+	case <-o.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s didn't start", name)
+	}
+}
+
+func assertNotStarted(t *testing.T, o *blockingOperation, name string) {
+	t.Helper()
+	select {
+	case <-o.started:
+		t.Fatalf("%s started while a conflicting operation was running", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOperationSerializerFirmwareOperationsDontOverlap(t *testing.T) {
+	s := NewOperationSerializer(Config{OperationConcurrency: concurrencyGroups})
+	first, second, restart := newBlockingOperation(), newBlockingOperation(), newBlockingOperation()
+	for _, op := range []struct {
+		templateId string
+		operation  *blockingOperation
+	}{{"515", first}, {"515", second}, {"510", restart}} {
+		if err := s.Submit(op.templateId, op.operation.run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitStarted(t, first, "first firmware update")
+	assertNotStarted(t, second, "second firmware update")
+	if depth := s.Depth(); depth.InFlight != 1 || depth.Pending != 2 {
+		t.Errorf("depth = %+v, want 1 in flight and 2 pending", depth)
+	}
+	close(first.release)
+	waitStarted(t, second, "second firmware update")
+	// the restart shares the group, it waits for the firmware update as well
+	assertNotStarted(t, restart, "restart")
+	close(second.release)
+	waitStarted(t, restart, "restart")
+	close(restart.release)
+}
+
+func TestOperationSerializerGroupsRunInParallel(t *testing.T) {
+	s := NewOperationSerializer(Config{OperationConcurrency: concurrencyGroups})
+	firmware, relay := newBlockingOperation(), newBlockingOperation()
+	if err := s.Submit("515", firmware.run); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Submit("518", relay.run); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, firmware, "firmware update")
+	// a relay doesn't conflict with a firmware update
+	waitStarted(t, relay, "relay")
+	close(firmware.release)
+	close(relay.release)
+}
+
+func TestOperationSerializerSerialKeepsOrder(t *testing.T) {
+	s := NewOperationSerializer(Config{OperationConcurrency: concurrencySerial})
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for _, templateId := range []string{"515", "518", "511", "522"} {
+		wg.Add(1)
+		if err := s.Submit(templateId, func() {
+			defer wg.Done()
+			mu.Lock()
+			order = append(order, templateId)
+			mu.Unlock()
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if want := []string{"515", "518", "511", "522"}; !slices.Equal(order, want) {
+		t.Errorf("executed %v, want %v", order, want)
+	}
+}
+
+func TestOperationSerializerPriorityPassesWaitingOperations(t *testing.T) {
+	s := NewOperationSerializer(Config{OperationConcurrency: concurrencyGroups, OperationQueueThreshold: 1,
+		OperationQueuePolicy: queuePrioritize, OperationPriority: []string{"510"}})
+	running, software, restart := newBlockingOperation(), newBlockingOperation(), newBlockingOperation()
+	if err := s.Submit("515", running.run); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, running, "firmware update")
+	for _, op := range []struct {
+		templateId string
+		operation  *blockingOperation
+	}{{"528", software}, {"510", restart}} {
+		if err := s.Submit(op.templateId, op.operation.run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(running.release)
+	// the software update waiting in the same group is over the threshold, the restart passes it
+	waitStarted(t, restart, "restart")
+	assertNotStarted(t, software, "software update")
+	close(restart.release)
+	waitStarted(t, software, "software update")
+	close(software.release)
+}
+
+func TestOperationSerializerShedsPerGroup(t *testing.T) {
+	s := NewOperationSerializer(Config{OperationConcurrency: concurrencyGroups, OperationQueueThreshold: 1,
+		OperationQueuePolicy: queueShed, OperationPriority: []string{"510"}})
+	running, waiting, relay := newBlockingOperation(), newBlockingOperation(), newBlockingOperation()
+	if err := s.Submit("515", running.run); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, running, "firmware update")
+	if err := s.Submit("528", waiting.run); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Submit("515", func() {}); err != errQueueFull {
+		t.Errorf("err = %v for a third operation of the system group, want errQueueFull", err)
+	}
+	// the pile in the system group doesn't count for the relay group
+	if err := s.Submit("518", relay.run); err != nil {
+		t.Errorf("relay shed because of the system group: %v", err)
+	}
+	waitStarted(t, relay, "relay")
+	close(relay.release)
+	close(running.release)
+	waitStarted(t, waiting, "software update")
+	close(waiting.release)
+}
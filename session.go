@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+)
+
+// OnReady is called after every connect once the subscriptions are in place. sessionPresent tells whether the broker
+// resumed the session of a previous connection (C8Y_CLEAN_SESSION=false), which kept its subscriptions and the QoS 1
+// messages queued while the device was offline. Set it before connecting, nil disables it
+var OnReady func(client mqtt.Client, sessionPresent bool)
+
+// sessionTracker remembers the session present flag of the last CONNACK, paho only reports it for the first connect
+// (in the ConnectToken) but not for its automatic reconnects
+type sessionTracker struct {
+	present atomic.Bool
+}
+
+// Present reports whether the broker resumed the session on the last connect
+func (t *sessionTracker) Present() bool {
+	return t.present.Load()
+}
+
+// openConnection is used as paho's CustomOpenConnectionFn, it opens the connection like paho would and watches the CONNACK
+func (t *sessionTracker) openConnection(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	t.present.Store(false)
+	conn, err := dialBroker(uri, options)
+	if err != nil {
+		return nil, err
+	}
+	return &connackConn{Conn: conn, tracker: t}, nil
+}
+
+// dialBroker opens the network connection to the broker for the schemes buildClientOptions accepts, the same way
+// paho does by default (proxies from the environment, websockets via paho's implementation)
+func dialBroker(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	dialer := options.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 30 * time.Second}
+	}
+	switch uri.Scheme {
+	case "ws", "wss":
+		// the websocket library doesn't accept URLs with credentials
+		dialURI := *uri
+		dialURI.User = nil
+		var tlsConfig *tls.Config
+		if uri.Scheme == "wss" {
+			tlsConfig = options.TLSConfig
+		}
+		return mqtt.NewWebsocket(dialURI.String(), tlsConfig, options.ConnectTimeout, options.HTTPHeaders, options.WebsocketOptions)
+	case "tcp", "mqtt":
+		return proxy.FromEnvironmentUsing(dialer).Dial("tcp", uri.Host)
+	case "ssl", "tls", "mqtts":
+		conn, err := proxy.FromEnvironmentUsing(dialer).Dial("tcp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := options.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = uri.Hostname()
+		}
+		// a broker stalling mid-handshake mustn't hang the connect attempt
+		timeout := options.ConnectTimeout
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme %q", uri.Scheme)
+}
+
+// connackConn reads the session present flag from the CONNACK, the first packet the broker sends on a connection
+// for MQTT 3.1.1 it is 0x20 (CONNACK), 0x02 (remaining length), the acknowledge flags (bit 0: session present) and the return code
+type connackConn struct {
+	net.Conn
+	tracker *sessionTracker
+	header  []byte
+}
+
+func (c *connackConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if len(c.header) < 3 {
+		c.header = append(c.header, p[:min(n, 3-len(c.header))]...)
+		if len(c.header) == 3 && c.header[0] == 0x20 && c.header[1] == 0x02 {
+			c.tracker.present.Store(c.header[2]&0x01 != 0)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestDialBrokerHandshakeTimeout(t *testing.T) {
+	// a broker that accepts the connection but never answers the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			stalled <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-stalled:
+			conn.Close()
+		default:
+		}
+	}()
+
+	options := mqtt.NewClientOptions()
+	options.ConnectTimeout = 200 * time.Millisecond
+	start := time.Now()
+	_, err = dialBroker(&url.URL{Scheme: "mqtts", Host: listener.Addr().String()}, *options)
+	if err == nil {
+		t.Fatal("handshake with a stalled broker succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dial returned after %s, want the connect timeout", elapsed)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ShellRunner executes the commands of shell operations (511) and streams their output to the platform while they run
+// output is sent as c8y_CommandOutput events (at most one per progress interval), the complete output is the result of the operation
+type ShellRunner struct {
+	client           mqtt.Client
+	enabled          bool
+	timeout          time.Duration
+	progressInterval time.Duration
+	maxOutput        int
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func NewShellRunner(client mqtt.Client, cfg Config) *ShellRunner {
+	return &ShellRunner{
+		client:           client,
+		enabled:          cfg.ShellEnabled,
+		timeout:          cfg.ShellTimeout,
+		progressInterval: cfg.ShellProgressInterval,
+		maxOutput:        cfg.ShellMaxOutput,
+		running:          map[string]bool{},
+	}
+}
+
+// errAlreadyRunning is returned for a command that is still running, e.g. when the broker redelivers the operation after a reconnect
+var errAlreadyRunning = errors.New("command is already running")
+
+// Run executes the command with "sh -c" and returns its combined stdout/stderr
+// when shell commands aren't enabled, execution is only simulated
+func (s *ShellRunner) Run(command string) (string, error) {
+	s.mu.Lock()
+	if s.running[command] {
+		s.mu.Unlock()
+		return "", errAlreadyRunning
+	}
+	s.running[command] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, command)
+		s.mu.Unlock()
+	}()
+
+	if !s.enabled {
+		time.Sleep(3 * time.Second) // simulating shell execution
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	output := &streamBuffer{max: s.maxOutput}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	// send what has been written since the last tick, until the command is done
+	done := make(chan struct{})
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		ticker := time.NewTicker(s.progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if chunk := output.next(); chunk != "" {
+					publishSmartRestMessage(s.client, buildSmartRest("400", "c8y_CommandOutput", chunk))
+				}
+			}
+		}
+	}()
+	err := cmd.Run()
+	close(done)
+	<-streamed
+
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("command timed out after %s", s.timeout)
+	}
+	return output.String(), err
+}
+
+// streamBuffer collects command output up to max bytes and remembers which part has already been streamed
+type streamBuffer struct {
+	max int
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	sent      int
+	truncated bool
+}
+
+func (b *streamBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	// the command must not fail because we drop its output
+	return len(p), nil
+}
+
+// next returns the output written since the last call
+func (b *streamBuffer) next() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	chunk := b.buf.String()[b.sent:]
+	b.sent = b.buf.Len()
+	return chunk
+}
+
+func (b *streamBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		return b.buf.String() + fmt.Sprintf("\n[output truncated after %d bytes]", b.max)
+	}
+	return b.buf.String()
+}
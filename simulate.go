@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// runSimulateOperation hands an operation to the operation handlers, for "./client simulate-op"
+//
+//	./client simulate-op --template 515 --args "serial,myFirmware,1.0,http://www.my.url"
+//
+// by default the operation is injected locally (dry): nothing connects to the platform, the handler runs as if the
+// operation arrived on s/ds and the messages it would publish (501/502/503, 115, ...) are only logged.
+// With --remote a real operation is created on the platform via REST, the running client of this device picks it up
+// like any operation scheduled by a user. Returns the exit code
+func runSimulateOperation(cfg Config, args []string) int {
+	flags := flag.NewFlagSet("simulate-op", flag.ContinueOnError)
+	templateId := flags.String("template", "", "template id of the operation, e.g. 515")
+	fields := flags.String("args", "", "fields of the operation after the template id, starting with the serial")
+	remote := flags.Bool("remote", false, "create a real operation on the platform instead of injecting it locally")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *templateId == "" {
+		fmt.Fprintln(os.Stderr, "--template is required")
+		return 2
+	}
+	if *fields == "" {
+		*fields = cfg.DeviceSerial
+	}
+	records, err := parseSmartRest([]byte(*templateId + "," + *fields))
+	if err != nil || len(records) == 0 {
+		fmt.Fprintf(os.Stderr, "invalid operation: %v\n", err)
+		return 2
+	}
+	record := records[0]
+	if err := checkOperationFields(record); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid operation: %v\n", err)
+		return 2
+	}
+	if *remote {
+		return createRemoteOperation(cfg, record)
+	}
+	return injectOperation(cfg, record)
+}
+
+// injectOperation runs the handler of the operation without a connection
+// restarts are always simulated, shell commands run if C8Y_SHELL_ENABLED is set, log files are read but not uploaded
+func injectOperation(cfg Config, record []string) int {
+	if record[0] == "530" {
+		fmt.Fprintln(os.Stderr, "remote access needs the platform, it can't be simulated locally")
+		return 1
+	}
+	cfg.RestartEnabled = false
+	client := dryRunClient{}
+	shellRunner = NewShellRunner(client, cfg)
+	restarter = NewRestarter(client, cfg)
+	progress = NewProgressReporter(client, cfg.ProgressInterval)
+	logRetriever = NewLogRetriever(cfg.LogSources, nil)
+
+	line := buildSmartRest(record[0], record[1:]...)
+	fmt.Printf("injecting %s locally, nothing is sent to the platform\n", line)
+	handleReceivedMessage(client, simulatedMessage{topic: "s/ds", payload: []byte(line)})
+	return 0
+}
+
+// dryRunClient stands in for the MQTT connection of simulated operations, publishing succeeds without sending anything
+// (the message is logged by publishMqttMessage as usual), the methods handlers don't use are left to the embedded (nil) interface
+type dryRunClient struct {
+	mqtt.Client
+}
+
+func (dryRunClient) IsConnected() bool      { return true }
+func (dryRunClient) IsConnectionOpen() bool { return true }
+
+func (dryRunClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	return &mqtt.DummyToken{}
+}
+
+// simulatedMessage is an operation injected by simulate-op or translated from a JSON operation, instead of received on s/ds
+type simulatedMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (simulatedMessage) Duplicate() bool   { return false }
+func (simulatedMessage) Qos() byte         { return 1 }
+func (simulatedMessage) Retained() bool    { return false }
+func (m simulatedMessage) Topic() string   { return m.topic }
+func (simulatedMessage) MessageID() uint16 { return 0 }
+func (m simulatedMessage) Payload() []byte { return m.payload }
+func (simulatedMessage) Ack()              {}
+
+// createRemoteOperation creates the operation for this device on the platform
+func createRemoteOperation(cfg Config, record []string) int {
+	fragment, value, err := operationFragment(record)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid operation: %v\n", err)
+		return 2
+	}
+	creds, err := newCredentialsProvider(cfg).Get(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetching credentials: %v\n", err)
+		return 1
+	}
+	if creds.Username, err = composeUsername(cfg.Tenant, creds.Username); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	rest := NewRestClient(cfg.BaseURL, func() Credentials { return creds }, cfg.DeviceSerial)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	deviceID, err := rest.DeviceID(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	id, err := rest.CreateOperation(ctx, deviceID, "Simulated "+fragment+" operation", fragment, value)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("created operation %s (%s) on device %s, it is executed by the running client of %s\n", id, fragment, deviceID, cfg.DeviceSerial)
+	return 0
+}
+
+// operationFragment returns the fragment of the platform operation the platform translates to the given static template
+func operationFragment(record []string) (string, any, error) {
+	fragment, ok := operationFragments[record[0]]
+	if !ok {
+		return "", nil, fmt.Errorf("template %s isn't an operation handled by this client", record[0])
+	}
+	switch record[0] {
+	case "510":
+		return fragment, map[string]any{}, nil
+	case "511":
+		return fragment, map[string]any{"text": record[2]}, nil
+	case "515":
+		return fragment, map[string]any{"name": record[2], "version": record[3], "url": record[4]}, nil
+	case "518", "519":
+		states, err := parseRelayStates(record)
+		if err != nil {
+			return "", nil, err
+		}
+		if record[0] == "518" {
+			return fragment, map[string]any{"relayState": states[0]}, nil
+		}
+		return fragment, states, nil
+	case "522":
+		req, err := parseLogfileRequest(record)
+		if err != nil {
+			return "", nil, err
+		}
+		return fragment, map[string]any{
+			"logFile":      req.LogFile,
+			"dateFrom":     req.StartDate,
+			"dateTo":       req.EndDate,
+			"searchText":   req.SearchText,
+			"maximumLines": req.MaxLines,
+		}, nil
+	case "528":
+		updates, err := parseSoftwareUpdates(record)
+		if err != nil {
+			return "", nil, err
+		}
+		list := make([]map[string]any, 0, len(updates))
+		for _, u := range updates {
+			list = append(list, map[string]any{"name": u.Name, "version": u.Version, "url": u.URL, "action": u.Action})
+		}
+		return fragment, list, nil
+	case "c8y_Message":
+		return fragment, map[string]any{"text": record[2]}, nil
+	case "c8y_RepublishProperties":
+		return fragment, map[string]any{}, nil
+	}
+	// remote access operations reference a configuration of the cloud remote access service, which can't be made up here
+	return "", nil, fmt.Errorf("%s operations can't be created by simulate-op", fragment)
+}
+
+// CreateOperation creates an operation for the device with the given managed object id and returns the operation id
+func (r *RestClient) CreateOperation(ctx context.Context, deviceID string, description string, fragment string, value any) (string, error) {
+	body, err := json.Marshal(map[string]any{"deviceId": deviceID, "description": description, fragment: value})
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := r.do(ctx, http.MethodPost, "/devicecontrol/operations", "application/json", body, &created); err != nil {
+		return "", fmt.Errorf("creating %s operation: %w", fragment, err)
+	}
+	return created.ID, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/csv"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the operation parsed by the benchmark, a 522 log file request
+var benchmarkOperation = []byte(`522,DeviceSerial,syslog,2024-01-01T00:00:00+0000,2024-01-02T00:00:00+0000,"error, warning",1000`)
+
+// the implementations replaced by buildSmartRest and parseSmartRest, kept as baseline of the benchmarks
+
+func legacySmartRestField(value string) string {
+	if !strings.ContainsAny(value, ",\"\n\r") && strings.TrimSpace(value) == value {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+}
+
+func legacyBuildSmartRest(templateId string, fields ...string) string {
+	var sb strings.Builder
+	sb.WriteString(templateId)
+	for _, field := range fields {
+		sb.WriteByte(',')
+		sb.WriteString(legacySmartRestField(field))
+	}
+	return sb.String()
+}
+
+func BenchmarkBuildSmartRest(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			legacyBuildSmartRest("502", "c8y_Restart", "failed, reason: XYZ", "C8Y-RESTART-FAILED")
+		}
+	})
+	b.Run("current", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			buildSmartRest("502", "c8y_Restart", "failed, reason: XYZ", "C8Y-RESTART-FAILED")
+		}
+	})
+}
+
+func BenchmarkParseSmartRest(b *testing.B) {
+	b.Run("csv", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := csv.NewReader(strings.NewReader(string(benchmarkOperation))).ReadAll(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("current", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := parseSmartRest(benchmarkOperation); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestBuildSmartRestMatchesLegacy(t *testing.T) {
+	for _, fields := range [][]string{
+		{"c8y_Restart"},
+		{"c8y_Restart", "failed, reason: XYZ"},
+		{"c8y_Message", `say "hi"`, " padded ", "line\nbreak", ""},
+	} {
+		if got, want := buildSmartRest("502", fields...), legacyBuildSmartRest("502", fields...); got != want {
+			t.Errorf("buildSmartRest(%q) = %q, want %q", fields, got, want)
+		}
+	}
+}
+
+func TestParseSmartRestLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		fields  int
+		wantErr string
+	}{
+		{"fields at the limit", "529" + strings.Repeat(",x", maxSmartRestFields-1), maxSmartRestFields, ""},
+		{"too many fields", "529" + strings.Repeat(",x", maxSmartRestFields), 0, "more than 4096 fields"},
+		{"field at the limit", "511,serial," + strings.Repeat("x", maxSmartRestFieldSize), 3, ""},
+		{"field too large", "511,serial," + strings.Repeat("x", maxSmartRestFieldSize+1), 0, "field 3 exceeds 65536 bytes"},
+		{"quoted field too large", `511,serial,"` + strings.Repeat("x", maxSmartRestFieldSize+1) + `"`, 0, "field 3 exceeds 65536 bytes"},
+		{"too many fields on a later line", "510,serial\n529" + strings.Repeat(",x", maxSmartRestFields), 0, "line 2: more than 4096 fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := parseSmartRest([]byte(tt.payload))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 || len(records[0]) != tt.fields {
+				t.Fatalf("got %d records, want 1 record with %d fields", len(records), tt.fields)
+			}
+		})
+	}
+}
+
+func TestParseSmartRestNewlineWrapped(t *testing.T) {
+	// the payload of the demo in main, wrapped in newlines like a raw string literal
+	demo := `
+201,yourMeaType,,c8y_SinglePhaseEnergyMeasurement,A1,1234,kWh,c8y_SinglePhaseEnergyMeasurement,A2,2345,kWh
+400,yourEventType,"Your Event description"
+301,yourAlarmType,"here is your alarm text"
+`
+	want := [][]string{
+		// the empty time field is a value of the positional template and kept
+		{"201", "yourMeaType", "", "c8y_SinglePhaseEnergyMeasurement", "A1", "1234", "kWh", "c8y_SinglePhaseEnergyMeasurement", "A2", "2345", "kWh"},
+		{"400", "yourEventType", "Your Event description"},
+		{"301", "yourAlarmType", "here is your alarm text"},
+	}
+	for name, payload := range map[string]string{
+		"demo":                 demo,
+		"windows line endings": strings.ReplaceAll(demo, "\n", "\r\n"),
+		"blank lines between":  strings.ReplaceAll(demo, "\n", "\n \t\n\n"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			records, err := parseSmartRest([]byte(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.EqualFunc(records, want, slices.Equal) {
+				t.Errorf("got %q, want %q", records, want)
+			}
+		})
+	}
+}
+
+func TestParseSmartRestTrailingEmptyFields(t *testing.T) {
+	records, err := parseSmartRest([]byte("528,DeviceSerial,a,1.0,http://example.com/a,install,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0]) != 7 || records[0][6] != "" {
+		t.Fatalf("got %q, want the trailing empty field kept by the parser", records)
+	}
+	updates, err := parseSoftwareUpdates(records[0])
+	if err != nil {
+		t.Fatalf("line terminated with a separator taken for an incomplete update: %v", err)
+	}
+	if len(updates) != 1 || updates[0].Name != "a" {
+		t.Errorf("got %+v, want the update of a", updates)
+	}
+	// the builder writes empty fields as they are, a trailing one included
+	if got := buildSmartRest("201", "c8y_Temperature", "T", "21.5", ""); got != "201,c8y_Temperature,T,21.5," {
+		t.Errorf("buildSmartRest = %q", got)
+	}
+}
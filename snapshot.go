@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Config fields left out of snapshots, they hold secrets or URLs that may embed them
+var redactedConfigFields = []string{"Password", "PKCS11Pin", "ConnectionWebhook"}
+
+// number of operations kept for snapshots
+const recentOperationsSize = 20
+
+// DeviceSnapshot is the in-memory state of the running client, for support bundles and to find out why a device
+// doesn't behave as expected without attaching a debugger
+type DeviceSnapshot struct {
+	Time             time.Time         `json:"time"`
+	Connected        bool              `json:"connected"`
+	ManagedObjectID  string            `json:"managedObjectId"`
+	Capabilities     []string          `json:"capabilities"`
+	Commands         []string          `json:"commands"`
+	Subscriptions    []string          `json:"subscriptions"`
+	Tasks            []string          `json:"tasks"`
+	Intervals        map[string]string `json:"intervals"`
+	Publishes        PublishStats      `json:"publishes"`
+	Buffered         map[string]int    `json:"buffered"`
+	OperationQueue   QueueDepth        `json:"operationQueue"`
+	RecentOperations []AuditRecord     `json:"recentOperations"`
+	Config           map[string]any    `json:"config"`
+}
+
+// Snapshot collects the current state of the device and the background tasks of the client
+func (d *Device) Snapshot() DeviceSnapshot {
+	d.mu.Lock()
+	capabilities := slices.Clone(d.capabilities)
+	d.mu.Unlock()
+
+	s := DeviceSnapshot{
+		Time:             time.Now().UTC(),
+		Connected:        d.client.IsConnected(),
+		ManagedObjectID:  d.ManagedObjectID(),
+		Capabilities:     capabilities,
+		Tasks:            supervisor.Tasks(),
+		Publishes:        publishStats.Snapshot(),
+		OperationQueue:   d.OperationQueueDepth(),
+		RecentOperations: recentOperations.List(),
+		Config:           redactedConfig(d.cfg),
+	}
+	commands.mu.RLock()
+	s.Commands = slices.Sorted(maps.Keys(commands.handlers))
+	commands.mu.RUnlock()
+	for _, sub := range d.cfg.Subscriptions {
+		s.Subscriptions = append(s.Subscriptions, sub.Topic)
+	}
+
+	s.Intervals = map[string]string{}
+	if d.measurements != nil {
+		s.Intervals["measurements"] = d.measurements.Interval().String()
+	}
+	if d.cfg.PowerSource != "" {
+		s.Intervals["battery"] = d.cfg.BatteryInterval.String()
+	}
+	if d.cfg.SNMPTarget != "" {
+		s.Intervals["snmp"] = d.cfg.SNMPInterval.String()
+	}
+	if d.cfg.AggregationWindow > 0 {
+		s.Intervals["aggregation"] = d.cfg.AggregationWindow.String()
+		s.Intervals["sampling"] = d.cfg.SampleInterval.String()
+	}
+
+	s.Buffered = map[string]int{}
+	if d.measurements != nil {
+		s.Buffered["pausedMeasurements"] = d.measurements.heldCount()
+	}
+	return s
+}
+
+// redactedConfig renders the exported fields of cfg, secrets and values JSON can't carry (like handlers) are left out
+func redactedConfig(cfg Config) map[string]any {
+	doc := map[string]any{}
+	v := reflect.ValueOf(cfg)
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if slices.Contains(redactedConfigFields, field.Name) {
+			if !v.Field(i).IsZero() {
+				doc[field.Name] = "<redacted>"
+			}
+			continue
+		}
+		value := v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if _, err := json.Marshal(value); err != nil {
+			continue
+		}
+		doc[field.Name] = value
+	}
+	return doc
+}
+
+// PublishStats counts the MQTT publishes of the client
+type PublishStats struct {
+	Published   int64                `json:"published"`
+	Failed      int64                `json:"failed"`
+	LastError   string               `json:"lastError,omitempty"`
+	LastFailure time.Time            `json:"lastFailure,omitzero"`
+	LastByTopic map[string]time.Time `json:"lastByTopic"`
+}
+
+var publishStats = &publishCounter{PublishStats: PublishStats{LastByTopic: map[string]time.Time{}}}
+
+type publishCounter struct {
+	mu sync.Mutex
+	PublishStats
+}
+
+// Record counts the outcome of a publish
+func (p *publishCounter) Record(topic string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now().UTC()
+	if err != nil {
+		p.Failed++
+		p.LastError = err.Error()
+		p.LastFailure = now
+		return
+	}
+	p.Published++
+	p.LastByTopic[topic] = now
+}
+
+// Snapshot copies the counters
+func (p *publishCounter) Snapshot() PublishStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.PublishStats
+	stats.LastByTopic = maps.Clone(p.LastByTopic)
+	return stats
+}
+
+// recentOperations keeps the last operations handled, without their payload which may carry secrets (shell commands)
+var recentOperations = &operationRing{}
+
+type operationRing struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (r *operationRing) Add(rec AuditRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, AuditRecord{Time: rec.Time, TemplateID: rec.TemplateID, DurationMs: rec.DurationMs, Status: rec.Status, Error: rec.Error})
+	if len(r.records) > recentOperationsSize {
+		r.records = slices.Delete(r.records, 0, len(r.records)-recentOperationsSize)
+	}
+}
+
+func (r *operationRing) List() []AuditRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.records)
+}
+
+// serveState serves the snapshot as JSON on GET /state of the local address until ctx is done
+func serveState(ctx context.Context, addr string, device *Device) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(device.Snapshot())
+	})
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("serving state: %w", err)
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Info("Serving device state", "url", "http://"+listener.Addr().String()+"/state")
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// runState prints the state of the running client, as served on C8Y_STATE_ADDR. Returns the exit code
+func runState(cfg Config) int {
+	if cfg.StateAddr == "" {
+		fmt.Fprintln(os.Stderr, "C8Y_STATE_ADDR isn't set, the running client doesn't serve its state")
+		return 1
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + cfg.StateAddr + "/state")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to get the state, is the client running?", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "Failed to get the state:", resp.Status)
+		return 1
+	}
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read the state:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+//go:build snmp
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/big"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// snmpSupported tells loadConfig whether C8Y_SNMP_TARGET can be used, see snmp_disabled.go
+const snmpSupported = true
+
+// snmpSource polls the OIDs of the SNMP mapping (C8Y_SNMP_MAPPING) from one agent, the readings are keyed by OID
+// counters are reported as they are, map them to a series that is meant to grow (e.g. bytes received so far)
+type snmpSource struct {
+	host      string
+	port      uint16
+	community string
+	version   gosnmp.SnmpVersion
+	timeout   time.Duration
+	oids      []string
+}
+
+func newSNMPSource(cfg Config) (MeasurementSource, error) {
+	s := &snmpSource{
+		host:      cfg.SNMPTarget,
+		port:      161,
+		community: cfg.SNMPCommunity,
+		version:   gosnmp.Version2c,
+		timeout:   cfg.SNMPTimeout,
+		oids:      slices.Sorted(maps.Keys(cfg.SNMPMappings)),
+	}
+	if host, port, err := net.SplitHostPort(cfg.SNMPTarget); err == nil {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in C8Y_SNMP_TARGET %q", cfg.SNMPTarget)
+		}
+		s.host, s.port = host, uint16(p)
+	}
+	if cfg.SNMPVersion == "1" {
+		s.version = gosnmp.Version1
+	}
+	return s, nil
+}
+
+func (s *snmpSource) Name() string {
+	return "snmp"
+}
+
+func (s *snmpSource) Read(ctx context.Context) ([]SensorReading, error) {
+	g := &gosnmp.GoSNMP{
+		Target:    s.host,
+		Port:      s.port,
+		Community: s.community,
+		Version:   s.version,
+		Timeout:   s.timeout,
+		Retries:   1,
+		Context:   ctx,
+	}
+	if err := g.Connect(); err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", s.host, err)
+	}
+	defer g.Conn.Close()
+
+	now := time.Now()
+	readings := make([]SensorReading, 0, len(s.oids))
+	// agents refuse requests with too many variables
+	for oids := range slices.Chunk(s.oids, gosnmp.MaxOids) {
+		result, err := g.Get(oids)
+		if err != nil {
+			return nil, fmt.Errorf("polling %s: %w", s.host, err)
+		}
+		for _, v := range result.Variables {
+			value, ok := snmpNumber(v)
+			if !ok {
+				logger.Warn("Skipping SNMP value that isn't a number", "oid", v.Name, "type", v.Type)
+				continue
+			}
+			readings = append(readings, SensorReading{Key: strings.TrimPrefix(v.Name, "."), Value: value, Time: now})
+		}
+	}
+	return readings, nil
+}
+
+// snmpNumber returns the numeric value of the variable, missing OIDs (noSuchObject, noSuchInstance) aren't numbers
+func snmpNumber(v gosnmp.SnmpPDU) (float64, bool) {
+	switch v.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		f, _ := new(big.Float).SetInt(gosnmp.ToBigInt(v.Value)).Float64()
+		return f, true
+	case gosnmp.OpaqueFloat:
+		f, ok := v.Value.(float32)
+		return float64(f), ok
+	case gosnmp.OpaqueDouble:
+		f, ok := v.Value.(float64)
+		return f, ok
+	case gosnmp.OctetString:
+		// some agents report decimals as strings, e.g. sensor tables of UPSs
+		b, ok := v.Value.([]byte)
+		if !ok {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,12 @@
+//go:build !snmp
+
+package main
+
+import "errors"
+
+// SNMP pulls in an additional dependency, so it is only built with "-tags snmp", see snmp.go
+const snmpSupported = false
+
+func newSNMPSource(cfg Config) (MeasurementSource, error) {
+	return nil, errors.New("built without SNMP support, rebuild with -tags snmp")
+}
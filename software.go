@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// SoftwareItem is an installed software package as reported with 116
+type SoftwareItem struct {
+	Name    string
+	Version string
+	// optional
+	URL string
+}
+
+// SoftwareList is the list of installed software of a device
+type SoftwareList []SoftwareItem
+
+// SmartRest returns the 116 line, every package as name,version,url triplet (an unknown url stays an empty field)
+// see: https://cumulocity.com/docs/smartrest/mqtt-static-templates/#116
+func (l SoftwareList) SmartRest() (string, error) {
+	fields := make([]string, 0, 3*len(l))
+	for i, item := range l {
+		if item.Name == "" || item.Version == "" {
+			return "", fmt.Errorf("software package %d needs name and version, got %q %q", i+1, item.Name, item.Version)
+		}
+		fields = append(fields, item.Name, item.Version, item.URL)
+	}
+	return buildSmartRest("116", fields...), nil
+}
+
+// parseSoftwareList parses the fields of a 116 line (without template id) back into the list
+func parseSoftwareList(fields []string) (SoftwareList, error) {
+	if len(fields)%3 != 0 {
+		return nil, fmt.Errorf("software list has %d fields, expected name,version,url triplets", len(fields))
+	}
+	l := make(SoftwareList, 0, len(fields)/3)
+	for i := 0; i < len(fields); i += 3 {
+		item := SoftwareItem{Name: fields[i], Version: fields[i+1], URL: fields[i+2]}
+		if item.Name == "" || item.Version == "" {
+			return nil, fmt.Errorf("software package %d needs name and version", i/3+1)
+		}
+		l = append(l, item)
+	}
+	return l, nil
+}
+
+// software update actions of 528
+const (
+	softwareInstall = "install"
+	softwareDelete  = "delete"
+)
+
+// SoftwareUpdate is a package of a software update operation (528)
+type SoftwareUpdate struct {
+	SoftwareItem
+	Action string
+}
+
+// parseSoftwareUpdates parses 528,serial,[name,version,url,action]...
+func parseSoftwareUpdates(record []string) ([]SoftwareUpdate, error) {
+	if err := checkOperationFields(record); err != nil {
+		return nil, err
+	}
+	// "528,serial,a,1.0,,install," must not be taken for an incomplete quadruple
+	fields := trimTrailingEmptyFields(record[2:])
+	if len(fields)%4 != 0 {
+		return nil, fmt.Errorf("software update has %d fields, expected name,version,url,action quadruples", len(fields))
+	}
+	updates := make([]SoftwareUpdate, 0, len(fields)/4)
+	for i := 0; i < len(fields); i += 4 {
+		u := SoftwareUpdate{SoftwareItem: SoftwareItem{Name: fields[i], Version: fields[i+1], URL: fields[i+2]}, Action: fields[i+3]}
+		if u.Name == "" {
+			return nil, fmt.Errorf("software package %d has no name", i/4+1)
+		}
+		switch u.Action {
+		case softwareInstall:
+			if u.Version == "" {
+				return nil, fmt.Errorf("software package %s needs a version to install", u.Name)
+			}
+		case softwareDelete:
+		default:
+			return nil, fmt.Errorf("unknown action %q for software package %s", u.Action, u.Name)
+		}
+		updates = append(updates, u)
+	}
+	return updates, nil
+}
+
+// Apply returns the list after the updates: installed packages replace an installed version, deleted ones are removed
+func (l SoftwareList) Apply(updates []SoftwareUpdate) SoftwareList {
+	result := slices.Clone(l)
+	for _, u := range updates {
+		result = slices.DeleteFunc(result, func(item SoftwareItem) bool { return item.Name == u.Name })
+		if u.Action == softwareInstall {
+			result = append(result, u.SoftwareItem)
+		}
+	}
+	return result
+}
+
+// Diff returns the updates turning l into target
+func (l SoftwareList) Diff(target SoftwareList) []SoftwareUpdate {
+	var updates []SoftwareUpdate
+	for _, item := range target {
+		if !slices.Contains(l, item) {
+			updates = append(updates, SoftwareUpdate{SoftwareItem: item, Action: softwareInstall})
+		}
+	}
+	for _, item := range l {
+		if !slices.ContainsFunc(target, func(t SoftwareItem) bool { return t.Name == item.Name }) {
+			updates = append(updates, SoftwareUpdate{SoftwareItem: item, Action: softwareDelete})
+		}
+	}
+	return updates
+}
+
+// SoftwareInventory holds the installed software of the device, updated by software update operations
+type SoftwareInventory struct {
+	mu   sync.Mutex
+	list SoftwareList
+}
+
+func (s *SoftwareInventory) List() SoftwareList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.list)
+}
+
+// Update applies the updates and returns the resulting list
+func (s *SoftwareInventory) Update(updates []SoftwareUpdate) SoftwareList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = s.list.Apply(updates)
+	return slices.Clone(s.list)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MeasurementSource provides raw readings of external equipment, implement it to bridge other protocols to the platform
+// Read is called once per poll interval, the Key of the readings selects the sensor mapping of the source
+type MeasurementSource interface {
+	// Name identifies the source in logs and in the type of its sensor fault alarm
+	Name() string
+	Read(ctx context.Context) ([]SensorReading, error)
+}
+
+// SourcePoller reads a MeasurementSource periodically and publishes its readings translated via the mapping
+// a failing source (unreachable, timing out) raises a c8y_SensorFault_<name> alarm, cleared by the next successful read
+type SourcePoller struct {
+	client       mqtt.Client
+	measurements *MeasurementPublisher
+	source       MeasurementSource
+	mappings     map[string]SensorMapping
+	timeout      time.Duration
+	faulted      bool
+}
+
+func NewSourcePoller(client mqtt.Client, measurements *MeasurementPublisher, source MeasurementSource, mappings map[string]SensorMapping, timeout time.Duration) *SourcePoller {
+	return &SourcePoller{client: client, measurements: measurements, source: source, mappings: mappings, timeout: timeout}
+}
+
+func (s *SourcePoller) Run(ctx context.Context, interval time.Duration) {
+	for {
+		done := cycles.Start(s.source.Name(), interval)
+		s.poll(ctx)
+		done()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *SourcePoller) poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	readings, err := s.source.Read(ctx)
+	alarmType := "c8y_SensorFault_" + s.source.Name()
+	if err != nil {
+		logger.Warn("Failed to read measurement source", "source", s.source.Name(), "err", err)
+		if !s.faulted {
+			RaiseAlarm(s.client, Alarm{Type: alarmType, Severity: "MAJOR", Text: fmt.Sprintf("Reading %s failed: %v", s.source.Name(), err)})
+			s.faulted = true
+		}
+		return
+	}
+	if s.faulted {
+		ClearAlarm(s.client, alarmType)
+		s.faulted = false
+	}
+	s.measurements.Publish(applySensorMappings(s.mappings, readings))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startupPacer spaces the publishes of the startup burst (capabilities and device properties) by gap, so a fleet
+// connecting at once (or a constrained device) doesn't send them all in the same instant. The first publish goes right away
+type startupPacer struct {
+	gap  time.Duration
+	last time.Time
+}
+
+func newStartupPacer(gap time.Duration) *startupPacer {
+	return &startupPacer{gap: gap}
+}
+
+// wait blocks until gap has passed since the previous call
+func (p *startupPacer) wait() {
+	if p.gap > 0 && !p.last.IsZero() {
+		time.Sleep(time.Until(p.last.Add(p.gap)))
+	}
+	p.last = time.Now()
+}
+
+// startupUpdate is one publish of the startup burst
+type startupUpdate struct {
+	// name in logs, and the key of the property in the property cache
+	name string
+	// SmartREST template id the platform refers to when rejecting the update on s/e, empty for JSON updates
+	template string
+	publish  func() error
+}
+
+// startupVerifier publishes the startup burst and retries the updates that failed, so the device twin isn't left
+// incomplete by a flaky start. Errors on s/e only name the template of the rejected line, so an update counts as
+// rejected if an error for its template arrives within settle after publishing. JSON updates are only checked for
+// publish errors. A retried update is removed from the property cache first, otherwise it would be skipped as unchanged
+type startupVerifier struct {
+	properties *PropertyCache
+	settle     time.Duration
+	retries    int
+	updates    []startupUpdate
+}
+
+func newStartupVerifier(properties *PropertyCache, settle time.Duration, retries int) *startupVerifier {
+	return &startupVerifier{properties: properties, settle: settle, retries: retries}
+}
+
+func (v *startupVerifier) Add(name string, template string, publish func() error) {
+	v.updates = append(v.updates, startupUpdate{name: name, template: template, publish: publish})
+}
+
+// Run publishes the updates and retries the failed ones up to the retry cap, it returns the names of those that still
+// failed. They are removed from the property cache, so they are published again on the next start
+func (v *startupVerifier) Run() []string {
+	pending := v.updates
+	for attempt := 0; ; attempt++ {
+		rejectedBefore := map[string]int{}
+		failed := map[string]bool{}
+		for _, u := range pending {
+			if _, ok := rejectedBefore[u.template]; !ok && u.template != "" {
+				rejectedBefore[u.template] = rejections.Count(u.template)
+			}
+			if err := u.publish(); err != nil {
+				failed[u.name] = true
+			}
+		}
+		if v.settle > 0 {
+			time.Sleep(v.settle)
+		}
+		var next []startupUpdate
+		var names []string
+		for _, u := range pending {
+			if failed[u.name] || (u.template != "" && rejections.Count(u.template) > rejectedBefore[u.template]) {
+				v.properties.Forget(u.name)
+				next = append(next, u)
+				names = append(names, u.name)
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		if attempt == v.retries {
+			logger.Error("Failed to set device properties, the device twin is incomplete", "properties", names, "attempts", attempt+1)
+			return names
+		}
+		logger.Warn("Device properties failed or were rejected, retrying", "properties", names, "attempt", attempt+1)
+		pending = next
+	}
+}
+
+// Republisher publishes the capabilities and all device properties again on demand (c8y_RepublishProperties operation
+// or SIGUSR2), e.g. when the device twin got into an incomplete state. It runs the verified startup burst with the
+// property cache bypassed, concurrent requests wait for the running one
+type Republisher struct {
+	mu sync.Mutex
+	// runs the startup burst, returning the names of the updates that failed
+	run func() ([]string, error)
+}
+
+func NewRepublisher(run func() ([]string, error)) *Republisher {
+	return &Republisher{run: run}
+}
+
+// Republish fails if an update failed even after the retries, nil-safe
+func (r *Republisher) Republish(reason string) error {
+	if r == nil {
+		return errors.New("device properties aren't published yet")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	logger.Info("Re-publishing capabilities and device properties", "reason", reason)
+	failed, err := r.run()
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("not confirmed by the platform: %s", strings.Join(failed, ", "))
+	}
+	logger.Info("Re-published capabilities and device properties")
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// RepublishOnSignal does nothing, there is no SIGUSR2 outside unix. The c8y_RepublishProperties operation still works,
+// see startup_unix.go
+func (r *Republisher) RepublishOnSignal(ctx context.Context) {}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// RepublishOnSignal re-publishes on every SIGUSR2 until ctx is done
+func (r *Republisher) RepublishOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+		if err := r.Republish("SIGUSR2"); err != nil {
+			logger.Error("Failed to re-publish device properties", "err", err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Subscription is a topic the device listens to, it is (re-)applied on every connect
+type Subscription struct {
+	Topic   string
+	QoS     byte
+	Handler mqtt.MessageHandler
+}
+
+func (s Subscription) validate() error {
+	if s.Topic == "" {
+		return fmt.Errorf("empty topic")
+	}
+	if s.QoS > 2 {
+		return fmt.Errorf("topic %s: QoS must be 0, 1 or 2, got %d", s.Topic, s.QoS)
+	}
+	if s.Handler == nil {
+		return fmt.Errorf("topic %s: no handler", s.Topic)
+	}
+	// wildcards must fill a whole topic level, "#" is only allowed as last level
+	levels := strings.Split(s.Topic, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("topic %s: '#' must be the last topic level", s.Topic)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("topic %s: '+' must fill a whole topic level", s.Topic)
+		}
+	}
+	return nil
+}
+
+// subscribeAll subscribes to all topics, failing subscriptions are logged and don't prevent the others
+// the broker may grant a lower QoS than requested, e.g. QoS 0 for s/ds means operations are delivered at most once.
+// Messages larger than maxSize bytes don't reach the handlers, see limitInboundSize
+func subscribeAll(client mqtt.Client, subscriptions []Subscription, maxSize int) {
+	for _, s := range subscriptions {
+		token := client.Subscribe(s.Topic, s.QoS, limitInboundSize(s.Handler, maxSize))
+		if token.Wait() && token.Error() != nil {
+			logger.Error("Error subscribing to topic", "topic", s.Topic, "err", token.Error())
+			continue
+		}
+		granted, ok := token.(*mqtt.SubscribeToken).Result()[s.Topic]
+		switch {
+		case !ok:
+			logger.Info("Subscribed to topic", "topic", s.Topic, "qos", s.QoS)
+		case granted == subscribeFailure:
+			logger.Error("Broker rejected subscription", "topic", s.Topic, "qos", s.QoS)
+		case granted < s.QoS:
+			logger.Warn("Broker granted a lower QoS than requested, messages may be lost", "topic", s.Topic, "requested", s.QoS, "granted", granted)
+		default:
+			logger.Info("Subscribed to topic", "topic", s.Topic, "qos", granted)
+		}
+	}
+}
+
+// routeAll registers the handlers of all subscriptions without subscribing, for a session the broker resumed with its
+// subscriptions. The handlers are local to the client, after a restart of the process they are gone either way
+func routeAll(client mqtt.Client, subscriptions []Subscription, maxSize int) {
+	for _, s := range subscriptions {
+		client.AddRoute(s.Topic, limitInboundSize(s.Handler, maxSize))
+	}
+}
+
+// limitInboundSize drops messages larger than maxSize bytes before the handler parses them. The MQTT client has read
+// the packet already, but parsing an oversized operation would multiply the memory it takes (fields, audit record,
+// logs) and handlers would work on it for long. An oversized operation on s/ds is failed, otherwise it stays pending
+func limitInboundSize(handler mqtt.MessageHandler, maxSize int) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		size := len(msg.Payload())
+		if size <= maxSize {
+			handler(client, msg)
+			return
+		}
+		logger.Warn("Dropping oversized MQTT message", "topic", msg.Topic(), "bytes", size, "max", maxSize)
+		if msg.Topic() == "s/ds" {
+			// the template id is the first field, a few bytes are enough to find it
+			templateId := operationTemplateID(msg.Payload()[:min(size, 16)])
+			rejectOperation(client, templateId, fmt.Errorf("operation of %d bytes exceeds the limit of %d bytes", size, maxSize))
+		}
+	}
+}
+
+// return code in SUBACK for a subscription the broker refused
+const subscribeFailure = 0x80
+
+// parseSubscribeQoS parses the QoS per topic given as "topic:qos,topic:qos"
+func parseSubscribeQoS(specs []string) (map[string]byte, error) {
+	qos := map[string]byte{}
+	for _, spec := range specs {
+		topic, value, found := strings.Cut(spec, ":")
+		q, err := strconv.ParseUint(value, 10, 8)
+		if !found || err != nil || q > 2 {
+			return nil, fmt.Errorf("%q must be topic:qos with QoS 0, 1 or 2", spec)
+		}
+		qos[topic] = byte(q)
+	}
+	return qos, nil
+}
+
+// applySubscribeQoS sets the configured QoS on the subscriptions, configuring a topic that isn't subscribed is an error
+func applySubscribeQoS(subscriptions []Subscription, qos map[string]byte) error {
+	for topic, q := range qos {
+		i := slices.IndexFunc(subscriptions, func(s Subscription) bool { return s.Topic == topic })
+		if i < 0 {
+			return fmt.Errorf("C8Y_SUBSCRIBE_QOS: not subscribed to topic %s", topic)
+		}
+		subscriptions[i].QoS = q
+	}
+	return nil
+}
+
+// parseSubscriptions parses additional subscriptions given as "topic[:qos],topic[:qos]"
+// messages on these topics are logged, devices with own handlers add them in code instead
+func parseSubscriptions(specs []string) ([]Subscription, error) {
+	var subscriptions []Subscription
+	for _, spec := range specs {
+		s := Subscription{Topic: spec, QoS: 1, Handler: logReceivedMessage}
+		if topic, qos, found := strings.Cut(spec, ":"); found {
+			q, err := strconv.ParseUint(qos, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid QoS in subscription %q", spec)
+			}
+			s.Topic, s.QoS = topic, byte(q)
+		}
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, nil
+}
+
+func logReceivedMessage(client mqtt.Client, msg mqtt.Message) {
+	logger.Info("Received MQTT message", "topic", msg.Topic(), "msg", string(msg.Payload()))
+}
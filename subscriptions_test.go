@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestLimitInboundSize(t *testing.T) {
+	const maxSize = 64
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		handled bool
+		// messages expected on s/us
+		published []string
+	}{
+		{"at the limit", "s/ds", "510," + strings.Repeat("x", maxSize-4), true, nil},
+		{"operation over the limit", "s/ds", "510," + strings.Repeat("x", maxSize-3), false, []string{"501,c8y_Restart", `502,c8y_Restart,C8Y-OP-REJECTED: Operation not accepted: operation of 65 bytes exceeds the limit of 64 bytes`}},
+		{"other topic over the limit", "s/e", strings.Repeat("x", maxSize+1), false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := false
+			handler := limitInboundSize(func(mqtt.Client, mqtt.Message) { handled = true }, maxSize)
+			client := &recordingClient{}
+			handler(client, simulatedMessage{topic: tt.topic, payload: []byte(tt.payload)})
+			if handled != tt.handled {
+				t.Errorf("handled = %t, want %t", handled, tt.handled)
+			}
+			published := client.messages("s/us")
+			if strings.Join(published, "\n") != strings.Join(tt.published, "\n") {
+				t.Errorf("published %q, want %q", published, tt.published)
+			}
+		})
+	}
+}
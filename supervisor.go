@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"sync"
+)
+
+// Supervisor runs the background goroutines of the client (measurement loops, monitors, reload watcher, ...)
+// so they share one lifecycle: Shutdown cancels their context and waits until all of them returned
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	tasks map[string]int
+}
+
+func NewSupervisor() *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Supervisor{ctx: ctx, cancel: cancel, tasks: map[string]int{}}
+}
+
+// Go runs fn in background, fn has to return once ctx is done
+// a panic is logged with its stack and only ends this goroutine, not the whole client
+func (s *Supervisor) Go(name string, fn func(ctx context.Context)) {
+	s.wg.Add(1)
+	s.mu.Lock()
+	s.tasks[name]++
+	s.mu.Unlock()
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.tasks[name]--; s.tasks[name] == 0 {
+				delete(s.tasks, name)
+			}
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("Background task panicked", "task", name, "panic", r, "stack", string(debug.Stack()))
+			}
+		}()
+		fn(s.ctx)
+	}()
+}
+
+// Shutdown cancels all background goroutines and waits for them until ctx is done
+func (s *Supervisor) Shutdown(ctx context.Context) error {
+	s.cancel()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background tasks still running: %w", ctx.Err())
+	}
+}
+
+// Tasks returns the names of the background goroutines still running
+func (s *Supervisor) Tasks() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(maps.Keys(s.tasks))
+}
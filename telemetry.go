@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// what happens to measurements published while telemetry is paused
+const (
+	pauseDiscard = "discard"
+	// kept up to C8Y_PAUSE_BUFFER_SIZE measurements and published on resume, the oldest are dropped beyond
+	pauseBuffer = "buffer"
+)
+
+// telemetryPause is the paused state of a MeasurementPublisher
+type telemetryPause struct {
+	mode    string
+	since   time.Time
+	held    []heldMeasurement
+	dropped int
+}
+
+type heldMeasurement struct {
+	measurement Measurement
+	childID     string
+	sourceID    string
+	// stamped with an unsynced clock, see Resume
+	restamp bool
+}
+
+// Pause stops publishing measurements until Resume, the loops producing them keep running. Measurements published
+// meanwhile are discarded or buffered depending on mode. Pausing again changes the mode, buffered measurements are kept
+func (p *MeasurementPublisher) Pause(mode string) error {
+	if mode != pauseDiscard && mode != pauseBuffer {
+		return fmt.Errorf("mode must be %s or %s, got %q", pauseDiscard, pauseBuffer, mode)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused == nil {
+		p.paused = &telemetryPause{since: time.Now()}
+	}
+	p.paused.mode = mode
+	return nil
+}
+
+// Resume publishes the buffered measurements and continues publishing, it returns how many were buffered and dropped
+func (p *MeasurementPublisher) Resume() (published int, dropped int) {
+	p.mu.Lock()
+	paused := p.paused
+	p.paused = nil
+	p.mu.Unlock()
+	if paused == nil {
+		return 0, 0
+	}
+	// measurements stamped while the clock wasn't synced get the time they were held at by the synced clock, the time
+	// passed since is taken from the monotonic clock (the stamp is from time.Now) which the clock being set doesn't affect
+	if clockMonitor.Synced() {
+		now := time.Now()
+		for i, h := range paused.held {
+			if h.restamp {
+				paused.held[i].measurement.Time = now.Add(-now.Sub(h.measurement.Time))
+			}
+		}
+	}
+	// one publish per source, in the order the measurements were held
+	for len(paused.held) > 0 {
+		first := paused.held[0]
+		var batch []Measurement
+		rest := paused.held[:0]
+		for _, h := range paused.held {
+			if h.childID == first.childID {
+				batch = append(batch, h.measurement)
+			} else {
+				rest = append(rest, h)
+			}
+		}
+		paused.held = rest
+		p.publish(batch, first.childID, first.sourceID)
+		published += len(batch)
+	}
+	return published, paused.dropped
+}
+
+// hold keeps the measurements from being published while paused, it reports whether they were held
+func (p *MeasurementPublisher) hold(measurements []Measurement, childID string, sourceID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused == nil {
+		return false
+	}
+	if p.paused.mode == pauseDiscard {
+		p.paused.dropped += len(measurements)
+		return true
+	}
+	for _, m := range measurements {
+		// measurements without time would get the time of arrival after resuming
+		restamp := false
+		if m.Time.IsZero() {
+			m.Time = time.Now()
+			restamp = !clockMonitor.Synced()
+		}
+		p.paused.held = append(p.paused.held, heldMeasurement{measurement: m, childID: childID, sourceID: sourceID, restamp: restamp})
+	}
+	if over := len(p.paused.held) - p.pauseBufferSize; over > 0 {
+		p.paused.held = p.paused.held[over:]
+		p.paused.dropped += over
+	}
+	return true
+}
+
+// telemetryCommand handles the "telemetry" command: "pause" discards measurements, "pause buffer" buffers them,
+// "resume" publishes the buffered ones and continues. The device leaves availability monitoring while paused
+func telemetryCommand(client mqtt.Client, serial string, measurements *MeasurementPublisher, requiredInterval *RequiredInterval) CommandHandler {
+	return func(args string) (string, error) {
+		command, mode, _ := strings.Cut(strings.TrimSpace(args), " ")
+		var output string
+		switch command {
+		case "pause":
+			if mode == "" {
+				mode = pauseDiscard
+			}
+			if err := measurements.Pause(mode); err != nil {
+				return "", err
+			}
+			if err := requiredInterval.SetTelemetryPaused(true); err != nil {
+				logger.Warn("Failed to take the device out of availability monitoring", "err", err)
+			}
+			logger.Info("Telemetry paused", "mode", mode)
+			output = "telemetry paused, mode " + mode
+		case "resume":
+			published, dropped := measurements.Resume()
+			if err := requiredInterval.SetTelemetryPaused(false); err != nil {
+				logger.Warn("Failed to restore availability monitoring", "err", err)
+			}
+			logger.Info("Telemetry resumed", "published", published, "dropped", dropped)
+			output = fmt.Sprintf("telemetry resumed, %d buffered measurements published, %d dropped", published, dropped)
+		default:
+			return "", fmt.Errorf("expected pause, pause buffer or resume, got %q", args)
+		}
+		if err := reportTelemetryState(client, serial, command == "pause", mode); err != nil {
+			return output, fmt.Errorf("reporting the telemetry state: %w", err)
+		}
+		return output, nil
+	}
+}
+
+// heldCount is the number of measurements buffered while paused
+func (p *MeasurementPublisher) heldCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.paused == nil {
+		return 0
+	}
+	return len(p.paused.held)
+}
+
+// reportTelemetryState updates the c8y_TelemetryPaused fragment of the device twin
+func reportTelemetryState(client mqtt.Client, serial string, paused bool, mode string) error {
+	state := map[string]any{"paused": paused}
+	if paused {
+		state["mode"] = mode
+		state["since"] = formatTimestamp(time.Now())
+	}
+	doc, err := json.Marshal(map[string]any{"c8y_TelemetryPaused": state})
+	if err != nil {
+		return err
+	}
+	return publishJsonViaMqttMessage(client, "inventory/managedObjects/update/"+serial, string(doc))
+}
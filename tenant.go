@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// tenantInfo is what the platform tells the device about the tenant it is connected to
+type tenantInfo struct {
+	// tenant id, e.g. t12345
+	Tenant string
+	// domain of the tenant, e.g. t12345.eu-latest.cumulocity.com, empty if unknown
+	Domain string
+}
+
+// queryTenant asks the platform which tenant the device is connected to
+// the device requests an access token on s/uat, the platform answers on s/dat with "71,<token>" and the token carries the tenant
+// see: https://cumulocity.com/docs/device-integration/mqtt/#json-web-token-authentication
+// configured is the handler of s/dat if it is one of the configured subscriptions (nil otherwise), it gets the response
+// as well and the subscription is kept afterwards
+func queryTenant(client mqtt.Client, timeout time.Duration, configured mqtt.MessageHandler) (tenantInfo, error) {
+	responses := make(chan []byte, 1)
+	token := client.Subscribe("s/dat", 1, func(client mqtt.Client, msg mqtt.Message) {
+		select {
+		case responses <- msg.Payload():
+		default:
+		}
+		if configured != nil {
+			configured(client, msg)
+		}
+	})
+	if !token.WaitTimeout(timeout) || token.Error() != nil {
+		return tenantInfo{}, fmt.Errorf("subscribing to s/dat: %v", token.Error())
+	}
+	if configured != nil {
+		defer client.AddRoute("s/dat", configured)
+	} else {
+		defer client.Unsubscribe("s/dat")
+	}
+
+	publishMqttMessage(client, "s/uat", "")
+	select {
+	case payload := <-responses:
+		accessToken, err := parseTokenResponse(payload)
+		if err != nil {
+			return tenantInfo{}, err
+		}
+		return tenantFromToken(accessToken)
+	case <-time.After(timeout):
+		return tenantInfo{}, fmt.Errorf("no response on s/dat within %s", timeout)
+	}
+}
+
+// parseTokenResponse returns the token of a "71,<token>" response
+func parseTokenResponse(payload []byte) (string, error) {
+	records, err := parseSmartRest(payload)
+	if err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if len(records) == 0 || len(records[0]) != 2 || records[0][0] != "71" || records[0][1] == "" {
+		return "", fmt.Errorf("invalid token response %q, expected 71,<token>", payload)
+	}
+	return records[0][1], nil
+}
+
+// tenantFromToken reads the tenant (claim "ten") and its domain (claim "iss") from the payload of a JWT
+// the signature isn't verified, the token has just been received from the broker we are authenticated with
+func tenantFromToken(token string) (tenantInfo, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tenantInfo{}, fmt.Errorf("malformed token, expected 3 parts but got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return tenantInfo{}, fmt.Errorf("malformed token payload: %w", err)
+	}
+	var claims struct {
+		Tenant string `json:"ten"`
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tenantInfo{}, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if !tenantPattern.MatchString(claims.Tenant) {
+		return tenantInfo{}, fmt.Errorf("token has no valid tenant, got %q", claims.Tenant)
+	}
+	return tenantInfo{Tenant: claims.Tenant, Domain: claims.Issuer}, nil
+}
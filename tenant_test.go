@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// tokenClient answers a token request on s/uat with "71,<token>" on s/dat, like the platform
+type tokenClient struct {
+	recordingClient
+	token string
+
+	mu           sync.Mutex
+	routes       map[string]mqtt.MessageHandler
+	unsubscribed []string
+}
+
+func newTokenClient(token string) *tokenClient {
+	return &tokenClient{token: token, routes: map[string]mqtt.MessageHandler{}}
+}
+
+func (c *tokenClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.AddRoute(topic, callback)
+	return &mqtt.DummyToken{}
+}
+
+func (c *tokenClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[topic] = callback
+}
+
+func (c *tokenClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+		c.unsubscribed = append(c.unsubscribed, topic)
+	}
+	return &mqtt.DummyToken{}
+}
+
+func (c *tokenClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	token := c.recordingClient.Publish(topic, qos, retained, payload)
+	if topic == "s/uat" {
+		c.mu.Lock()
+		handler := c.routes["s/dat"]
+		c.mu.Unlock()
+		if handler != nil {
+			go handler(c, simulatedMessage{topic: "s/dat", payload: []byte("71," + c.token)})
+		}
+	}
+	return token
+}
+
+// testToken is an unsigned JWT with the claims the platform puts in device tokens
+func testToken(claims string) string {
+	return "eyJhbGciOiJIUzUxMiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestQueryTenant(t *testing.T) {
+	client := newTokenClient(testToken(`{"ten":"t12345","iss":"t12345.eu-latest.cumulocity.com","sub":"device_DeviceSerial"}`))
+	info, err := queryTenant(client, 5*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Tenant != "t12345" || info.Domain != "t12345.eu-latest.cumulocity.com" {
+		t.Errorf("got %+v", info)
+	}
+	// s/dat was only subscribed for the query
+	if len(client.unsubscribed) != 1 || client.unsubscribed[0] != "s/dat" {
+		t.Errorf("unsubscribed %v, want s/dat", client.unsubscribed)
+	}
+}
+
+func TestQueryTenantKeepsConfiguredSubscription(t *testing.T) {
+	client := newTokenClient(testToken(`{"ten":"t12345","iss":"t12345.eu-latest.cumulocity.com"}`))
+	received := make(chan string, 2)
+	configured := func(client mqtt.Client, msg mqtt.Message) { received <- string(msg.Payload()) }
+	if _, err := queryTenant(client, 5*time.Second, configured); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.unsubscribed) > 0 {
+		t.Errorf("unsubscribed %v although s/dat is a configured subscription", client.unsubscribed)
+	}
+	// the configured handler got the response of the query and gets the following messages
+	select {
+	case payload := <-received:
+		if payload != "71,"+client.token {
+			t.Errorf("configured handler got %q", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("configured handler didn't get the response")
+	}
+	client.mu.Lock()
+	handler := client.routes["s/dat"]
+	client.mu.Unlock()
+	handler(client, simulatedMessage{topic: "s/dat", payload: []byte("71,next")})
+	if payload := <-received; payload != "71,next" {
+		t.Errorf("configured handler not restored, got %q", payload)
+	}
+}
+
+func TestTenantFromTokenInvalid(t *testing.T) {
+	for name, token := range map[string]string{
+		"not a JWT":        "abc",
+		"payload not JSON": "a." + base64.RawURLEncoding.EncodeToString([]byte("tenant")) + ".c",
+		"no tenant claim":  testToken(`{"iss":"t12345.eu-latest.cumulocity.com"}`),
+		"invalid tenant":   testToken(`{"ten":"t1/../x"}`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if info, err := tenantFromToken(token); err == nil {
+				t.Errorf("accepted, got %+v", info)
+			}
+		})
+	}
+}
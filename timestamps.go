@@ -0,0 +1,12 @@
+package main
+
+import "time"
+
+// zone the timestamps of measurements, events and alarms are formatted in, see C8Y_TIMESTAMP_ZONE
+// the platform stores the instant either way, only integrations keying off the textual offset see a difference
+var timestampLocation = time.UTC
+
+// formatTimestamp formats t as ISO 8601 with milliseconds, "Z" for UTC and the offset otherwise (e.g. +02:00)
+func formatTimestamp(t time.Time) string {
+	return t.In(timestampLocation).Format("2006-01-02T15:04:05.000Z07:00")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// the clock status is only available where readClockStatus is implemented, see timesync_linux.go
+var errClockStatusUnsupported = errors.New("clock sync status isn't available on this platform")
+
+// ClockStatus is the synchronization state of the system clock as the kernel sees it
+type ClockStatus struct {
+	// the kernel considers the clock synchronized (by NTP, chrony, ...)
+	Synced bool
+	// upper bound of the clock's error
+	MaxError time.Duration
+}
+
+// ClockMonitor checks periodically whether the system clock is synchronized and reports it as c8y_TimeSyncStatus
+// fragment. Embedded devices often boot without RTC, until NTP got hold of the clock their timestamps (and TLS
+// certificate checks) are off. A clock unsynced for longer than alarmAfter raises a c8y_ClockUnsynchronized alarm,
+// cleared once it is synced again
+type ClockMonitor struct {
+	client     mqtt.Client
+	serial     string
+	maxError   time.Duration
+	alarmAfter time.Duration
+	read       func() (ClockStatus, error)
+
+	mu            sync.Mutex
+	synced        bool
+	unsyncedSince time.Time
+	alarmActive   bool
+	reported      *bool
+}
+
+func NewClockMonitor(client mqtt.Client, serial string, maxError time.Duration, alarmAfter time.Duration) *ClockMonitor {
+	// assumed synced until the first check says otherwise
+	return &ClockMonitor{client: client, serial: serial, maxError: maxError, alarmAfter: alarmAfter, read: readClockStatus, synced: true}
+}
+
+// Synced reports whether the clock was synchronized on the last check, a nil monitor trusts the clock
+func (c *ClockMonitor) Synced() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.synced
+}
+
+func (c *ClockMonitor) Run(ctx context.Context, interval time.Duration) {
+	if _, err := c.read(); errors.Is(err, errClockStatusUnsupported) {
+		logger.Warn("Not monitoring the clock sync status", "err", err)
+		return
+	}
+	for {
+		c.check(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (c *ClockMonitor) check(now time.Time) {
+	status, err := c.read()
+	if err != nil {
+		logger.Warn("Failed to read the clock sync status", "err", err)
+		return
+	}
+	// an error bound beyond the limit makes the timestamps as unreliable as an unsynced clock
+	synced := status.Synced && status.MaxError <= c.maxError
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if synced != c.synced {
+		logger.Info("Clock sync status changed", "synced", synced, "maxError", status.MaxError)
+	}
+	c.synced = synced
+	if synced {
+		c.unsyncedSince = time.Time{}
+		if c.alarmActive && ClearAlarm(c.client, "c8y_ClockUnsynchronized") == nil {
+			c.alarmActive = false
+		}
+	} else {
+		if c.unsyncedSince.IsZero() {
+			c.unsyncedSince = now
+		}
+		if !c.alarmActive && now.Sub(c.unsyncedSince) >= c.alarmAfter {
+			err := RaiseAlarm(c.client, Alarm{
+				Type:     "c8y_ClockUnsynchronized",
+				Severity: "MAJOR",
+				Text:     fmt.Sprintf("System clock not synchronized for %s (max error %s), timestamps may be wrong", now.Sub(c.unsyncedSince).Round(time.Second), status.MaxError),
+			})
+			c.alarmActive = err == nil
+		}
+	}
+	if c.reported == nil || *c.reported != synced {
+		if err := c.report(status, synced); err != nil {
+			logger.Warn("Failed to report the clock sync status", "err", err)
+		} else {
+			c.reported = &synced
+		}
+	}
+}
+
+// report updates the c8y_TimeSyncStatus fragment of the device twin, called with mu held
+func (c *ClockMonitor) report(status ClockStatus, synced bool) error {
+	doc, err := json.Marshal(map[string]any{"c8y_TimeSyncStatus": map[string]any{
+		"synced":     synced,
+		"maxErrorMs": status.MaxError.Milliseconds(),
+		"checked":    formatTimestamp(time.Now()),
+	}})
+	if err != nil {
+		return err
+	}
+	return publishJsonViaMqttMessage(c.client, "inventory/managedObjects/update/"+c.serial, string(doc))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// see adjtimex(2)
+const (
+	timeError = 5
+	staUnsync = 0x0040
+)
+
+// readClockStatus asks the kernel for the state of the clock discipline, without changing anything
+func readClockStatus() (ClockStatus, error) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return ClockStatus{}, err
+	}
+	return ClockStatus{
+		Synced:   state != timeError && tx.Status&staUnsync == 0,
+		MaxError: time.Duration(tx.Maxerror) * time.Microsecond,
+	}, nil
+}
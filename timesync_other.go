@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// readClockStatus isn't implemented outside Linux, see timesync_linux.go
+func readClockStatus() (ClockStatus, error) {
+	return ClockStatus{}, errClockStatusUnsupported
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// values of the state posted to the connection webhook
+const (
+	stateConnected    = "connected"
+	stateDisconnected = "disconnected"
+)
+
+// ConnectionWebhook posts connection state changes to a local endpoint, so co-located software can react to the
+// connectivity (e.g. buffer data locally or flash an LED). Delivery is best effort: notifications are sent one after
+// another in the background and dropped when the endpoint fails or can't keep up, connecting never waits for it
+type ConnectionWebhook struct {
+	url     string
+	http    *http.Client
+	changes chan connectionChange
+}
+
+type connectionChange struct {
+	State  string    `json:"state"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// NewConnectionWebhook returns nil (which ignores notifications) if no URL is configured
+func NewConnectionWebhook(url string, timeout time.Duration) *ConnectionWebhook {
+	if url == "" {
+		return nil
+	}
+	w := &ConnectionWebhook{url: url, http: &http.Client{Timeout: timeout}, changes: make(chan connectionChange, 16)}
+	go w.run()
+	return w
+}
+
+// Notify queues the state change for posting
+func (w *ConnectionWebhook) Notify(state string, reason error) {
+	if w == nil {
+		return
+	}
+	change := connectionChange{State: state, Time: time.Now().UTC()}
+	if reason != nil {
+		change.Reason = reason.Error()
+	}
+	select {
+	case w.changes <- change:
+	default:
+		logger.Warn("Connection webhook can't keep up, dropping notification", "state", state)
+	}
+}
+
+func (w *ConnectionWebhook) run() {
+	for change := range w.changes {
+		if err := w.post(change); err != nil {
+			logger.Warn("Failed to notify connection webhook", "url", w.url, "state", change.State, "err", err)
+		}
+	}
+}
+
+func (w *ConnectionWebhook) post(change connectionChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}